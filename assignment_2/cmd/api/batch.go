@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// batchMaxOperations limits the number of operations in a single batch request.
+const batchMaxOperations = 500
+
+// A batchOperation is one element of the "operations" array in a batch request. Video
+// holds the fields to set: all of them for a create, and only those being changed for an
+// update. Version, when given, is the version the client expects the video to be at.
+type batchOperation struct {
+	Op      string `json:"op"`
+	ID      int64  `json:"id"`
+	Version *int32 `json:"version"`
+	Video   *struct {
+		Title       *string       `json:"title"`
+		Description *string       `json:"description"`
+		Language    *string       `json:"language"`
+		Year        *int32        `json:"year"`
+		Runtime     *data.Runtime `json:"runtime"`
+		Genres      []string      `json:"genres"`
+	} `json:"video"`
+}
+
+// A batchResult reports the outcome of one operation, using the status code and
+// response body that the equivalent single-video request would have received.
+type batchResult struct {
+	Index  int      `json:"index"`
+	Op     string   `json:"op"`
+	Status int      `json:"status"`
+	Body   envelope `json:"body"`
+}
+
+// The batchVideosHandler() handles "POST /v1/videos/batch". The request body holds a list
+// of create, update and delete operations:
+//
+//	{"atomic": true, "operations": [
+//		{"op": "create", "video": {"title": "...", "year": 2001, ...}},
+//		{"op": "update", "id": 12, "version": 3, "video": {"genres": ["drama"]}},
+//		{"op": "delete", "id": 40, "version": 1}
+//	]}
+//
+// With "atomic": true either every operation succeeds or none of them are saved, and the
+// operations which didn't fail are reported with 424 Failed Dependency. Otherwise each
+// operation succeeds or fails on its own. The response lists a result for every
+// operation, in order.
+func (app *application) batchVideosHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Atomic     bool             `json:"atomic"`
+		Operations []batchOperation `json:"operations"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if validateBatch(v, input.Operations); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Turn each operation into a data.VideoOperation, checking it in the same way as
+	// the single-video handlers would. Operations which fail here get their result
+	// straight away and aren't sent to the database.
+	results := make([]*batchResult, len(input.Operations))
+	var ops []*data.VideoOperation
+	var opIndexes []int
+	for i, in := range input.Operations {
+		results[i] = &batchResult{Index: i, Op: in.Op}
+		op, status, body := app.prepareBatchOperation(r, in)
+		if op == nil {
+			results[i].Status, results[i].Body = status, body
+			continue
+		}
+		ops = append(ops, op)
+		opIndexes = append(opIndexes, i)
+	}
+
+	failed := len(ops) < len(input.Operations)
+	if input.Atomic && failed {
+		// Something is already known to be wrong, so don't run any of the batch.
+		for _, i := range opIndexes {
+			results[i].Status, results[i].Body = batchAbortedResult()
+		}
+	} else if len(ops) > 0 {
+		err = app.models.Videos.ExecBatch(r.Context(), ops, input.Atomic, app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for n, op := range ops {
+			results[opIndexes[n]].Status, results[opIndexes[n]].Body = app.batchOperationResult(r, op)
+		}
+	}
+
+	succeeded := 0
+	for _, result := range results {
+		if result.Status < 300 {
+			succeeded++
+		}
+	}
+	env := envelope{
+		"atomic":    input.Atomic,
+		"succeeded": succeeded,
+		"failed":    len(results) - succeeded,
+		"results":   results,
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateBatch checks the shape of a batch request. Problems here reject the whole
+// request, whereas problems with the data in an operation only fail that operation.
+func validateBatch(v *validator.Validator, ops []batchOperation) {
+	v.Check(len(ops) > 0, "operations", "must contain at least 1 operation")
+	v.Check(len(ops) <= batchMaxOperations, "operations", fmt.Sprintf("must not contain more than %d operations", batchMaxOperations))
+	seen := make(map[int64]bool)
+	for i, op := range ops {
+		key := fmt.Sprintf("operations[%d]", i)
+		v.Check(validator.In(op.Op, data.BatchCreate, data.BatchUpdate, data.BatchDelete), key+".op", "must be one of create, update or delete")
+		switch op.Op {
+		case data.BatchCreate:
+			v.Check(op.ID == 0, key+".id", "must not be provided for create")
+			v.Check(op.Version == nil, key+".version", "must not be provided for create")
+			v.Check(op.Video != nil, key+".video", "must be provided")
+		case data.BatchUpdate, data.BatchDelete:
+			v.Check(op.ID > 0, key+".id", "must be a positive integer")
+			if op.Version != nil {
+				v.Check(*op.Version > 0, key+".version", "must be a positive integer")
+			}
+			if op.Op == data.BatchUpdate {
+				v.Check(op.Video != nil, key+".video", "must be provided")
+			} else {
+				v.Check(op.Video == nil, key+".video", "must not be provided for delete")
+			}
+			// Every operation on a video is checked against the version stored before
+			// the batch started, so a second operation on the same video would always
+			// conflict with the first.
+			v.Check(op.ID <= 0 || !seen[op.ID], key+".id", "must not appear more than once in a batch")
+			seen[op.ID] = true
+		}
+	}
+}
+
+// The prepareBatchOperation() method builds the data.VideoOperation for one operation
+// of a batch. If the operation can't go ahead, it returns nil along with the status code
+// and body to report instead.
+func (app *application) prepareBatchOperation(r *http.Request, in batchOperation) (*data.VideoOperation, int, envelope) {
+	op := &data.VideoOperation{Action: in.Op, Video: &data.Video{ID: in.ID}}
+	switch in.Op {
+	case data.BatchCreate:
+		op.Video.Language = data.DefaultLanguage
+	case data.BatchDelete:
+		if in.Version != nil {
+			op.Video.Version = *in.Version
+		}
+		return op, 0, nil
+	case data.BatchUpdate:
+		video, err := app.models.Videos.Get(r.Context(), in.ID)
+		if err != nil {
+			op.Err = err
+			status, body := app.batchOperationResult(r, op)
+			return nil, status, body
+		}
+		if in.Version != nil && *in.Version != video.Version {
+			op.Err = data.ErrEditConflict
+			status, body := app.batchOperationResult(r, op)
+			return nil, status, body
+		}
+		op.Video = video
+	}
+	if in.Video.Title != nil {
+		op.Video.Title = *in.Video.Title
+	}
+	if in.Video.Description != nil {
+		op.Video.Description = *in.Video.Description
+	}
+	if in.Video.Language != nil {
+		op.Video.Language = *in.Video.Language
+	}
+	if in.Video.Year != nil {
+		op.Video.Year = *in.Video.Year
+	}
+	if in.Video.Runtime != nil {
+		op.Video.Runtime = *in.Video.Runtime
+	}
+	if in.Video.Genres != nil {
+		op.Video.Genres = in.Video.Genres
+	}
+	v := validator.New()
+	if data.ValidateVideo(v, op.Video); !v.Valid() {
+		return nil, http.StatusUnprocessableEntity, envelope{"error": v.Errors}
+	}
+	if err := app.resolveVideoGenres(r, v, op.Video); err != nil {
+		op.Err = err
+		status, body := app.batchOperationResult(r, op)
+		return nil, status, body
+	}
+	if !v.Valid() {
+		return nil, http.StatusUnprocessableEntity, envelope{"error": v.Errors}
+	}
+	return op, 0, nil
+}
+
+// The batchOperationResult() method returns the status code and body for an operation
+// once it has been run, matching the responses of the single-video handlers.
+func (app *application) batchOperationResult(r *http.Request, op *data.VideoOperation) (int, envelope) {
+	var constraintErr *data.ConstraintError
+	switch {
+	case op.Err == nil && op.Action == data.BatchCreate:
+		return http.StatusCreated, envelope{"video": op.Video}
+	case op.Err == nil && op.Action == data.BatchUpdate:
+		return http.StatusOK, envelope{"video": op.Video}
+	case op.Err == nil:
+		return http.StatusOK, envelope{"message": "video moved to trash"}
+	case errors.Is(op.Err, data.ErrBatchAborted):
+		return batchAbortedResult()
+	case errors.As(op.Err, &constraintErr):
+		return http.StatusUnprocessableEntity, envelope{"error": map[string]string{constraintErr.Field: constraintErr.Message}}
+	case errors.Is(op.Err, data.ErrRecordNotFound):
+		return http.StatusNotFound, envelope{"error": "the requested resource could not be found"}
+	case errors.Is(op.Err, data.ErrEditConflict):
+		return http.StatusConflict, envelope{"error": "unable to update the record due to an edit conflict, please try again"}
+	default:
+		app.logError(r, op.Err)
+		return http.StatusInternalServerError, envelope{"error": "the server encountered a problem and could not process your request"}
+	}
+}
+
+func batchAbortedResult() (int, envelope) {
+	return http.StatusFailedDependency, envelope{"error": "not saved because another operation in the atomic batch failed"}
+}
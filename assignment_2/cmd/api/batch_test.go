@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"assignment_2.alexedwards.net/internal/data"
+)
+
+func TestBatchVideos(t *testing.T) {
+	// The operations refer to two existing videos, with IDs 1 and 2, at version 1.
+	const (
+		create    = `{"op": "create", "video": {"title": "Created", "year": 2001, "runtime": "102 mins", "genres": ["drama"]}}`
+		badCreate = `{"op": "create", "video": {"title": "Created", "year": 1500, "runtime": "102 mins", "genres": ["drama"]}}`
+		update    = `{"op": "update", "id": 1, "version": 1, "video": {"title": "Updated"}}`
+		stale     = `{"op": "update", "id": 1, "version": 7, "video": {"title": "Updated"}}`
+		remove    = `{"op": "delete", "id": 2, "version": 1}`
+		missing   = `{"op": "delete", "id": 99}`
+	)
+
+	tests := []struct {
+		name       string
+		atomic     bool
+		operations []string
+		wantStatus []int
+		// wantTitles holds the titles of the live videos afterwards, by ID.
+		wantTitles map[int64]string
+	}{
+		{
+			name:       "Best effort",
+			operations: []string{create, update, missing},
+			wantStatus: []int{http.StatusCreated, http.StatusOK, http.StatusNotFound},
+			wantTitles: map[int64]string{1: "Updated", 2: "Second", 3: "Created"},
+		},
+		{
+			name:       "Best effort with a stale version",
+			operations: []string{stale, remove},
+			wantStatus: []int{http.StatusConflict, http.StatusOK},
+			wantTitles: map[int64]string{1: "First"},
+		},
+		{
+			name:       "Atomic",
+			atomic:     true,
+			operations: []string{create, update, remove},
+			wantStatus: []int{http.StatusCreated, http.StatusOK, http.StatusOK},
+			wantTitles: map[int64]string{1: "Updated", 3: "Created"},
+		},
+		{
+			// The missing video is only found out when the batch runs, so the earlier
+			// operations have to be rolled back.
+			name:       "Atomic failing in the database",
+			atomic:     true,
+			operations: []string{create, update, missing},
+			wantStatus: []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound},
+			wantTitles: map[int64]string{1: "First", 2: "Second"},
+		},
+		{
+			name:       "Atomic failing validation",
+			atomic:     true,
+			operations: []string{update, badCreate, remove},
+			wantStatus: []int{http.StatusFailedDependency, http.StatusUnprocessableEntity, http.StatusFailedDependency},
+			wantTitles: map[int64]string{1: "First", 2: "Second"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			user, token := newTestUser(t, app, "alice@example.com", "videos:read", "videos:write")
+			newTestVideo(t, app, user.ID, "First")
+			newTestVideo(t, app, user.ID, "Second")
+
+			body := fmt.Sprintf(`{"atomic": %t, "operations": [`, tt.atomic)
+			for i, op := range tt.operations {
+				if i > 0 {
+					body += ", "
+				}
+				body += op
+			}
+			body += "]}"
+			code, _, resBody := ts.do(t, http.MethodPost, "/v1/videos/batch", token, nil, body)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", code, http.StatusOK, resBody)
+			}
+			var res struct {
+				Results []batchResult `json:"results"`
+			}
+			if err := json.Unmarshal([]byte(resBody), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Results) != len(tt.wantStatus) {
+				t.Fatalf("got %d results; want %d: %s", len(res.Results), len(tt.wantStatus), resBody)
+			}
+			for i, result := range res.Results {
+				if result.Index != i || result.Status != tt.wantStatus[i] {
+					t.Errorf("got status %d for operation %d; want %d: %v", result.Status, result.Index, tt.wantStatus[i], result.Body)
+				}
+			}
+
+			for id := int64(1); id <= 3; id++ {
+				video, err := app.models.Videos.Get(context.Background(), id)
+				want, ok := tt.wantTitles[id]
+				switch {
+				case !ok && err != data.ErrRecordNotFound:
+					t.Errorf("got error %v for video %d; want %v", err, id, data.ErrRecordNotFound)
+				case ok && err != nil:
+					t.Errorf("got error %v for video %d", err, id)
+				case ok && video.Title != want:
+					t.Errorf("got title %q for video %d; want %q", video.Title, id, want)
+				}
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/jwt"
 )
 
 // Define a custom contextKey type, with the underlying type string.
@@ -15,6 +16,14 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// tokenContextKey is the key for the plaintext authentication token which the request
+// was authenticated with.
+const tokenContextKey = contextKey("token")
+
+// claimsContextKey is the key for the claims of the signed token which the request was
+// authenticated with, if it was.
+const claimsContextKey = contextKey("claims")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
@@ -34,3 +43,33 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetToken() method returns a new copy of the request with the plaintext
+// authentication token added to the context, so that handlers can tell which of the
+// user's tokens made the request.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() method retrieves the plaintext authentication token from the
+// request context. It returns "" for an anonymous request.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// The contextSetClaims() method returns a new copy of the request with the claims of its
+// signed authentication token added to the context.
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// The contextGetClaims() method retrieves the claims of the request's signed
+// authentication token from the request context. It returns nil if the request wasn't
+// authenticated with a signed token.
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	return claims
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// exportFlushEvery is the number of rows written between flushes of the response, so
+// that the client starts receiving data straight away on a large export.
+const exportFlushEvery = 100
+
+// A videoEncoder writes videos to an export in one of the supported formats. begin() is
+// called once before the first video and end() once after the last. flush() pushes any
+// data held by the encoder itself through to the underlying writer.
+type videoEncoder interface {
+	begin() error
+	encode(video *data.Video) error
+	flush() error
+	end() error
+}
+
+// csvVideoEncoder writes one row per video. Runtimes are written in minutes and genres
+// are separated by "|", which is the same format accepted by importVideosHandler().
+type csvVideoEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvVideoEncoder) begin() error {
+	return e.w.Write([]string{"id", "title", "description", "language", "year", "runtime", "genres", "version"})
+}
+
+func (e *csvVideoEncoder) encode(video *data.Video) error {
+	return e.w.Write([]string{
+		strconv.FormatInt(video.ID, 10),
+		video.Title,
+		video.Description,
+		video.Language,
+		strconv.FormatInt(int64(video.Year), 10),
+		strconv.FormatInt(int64(video.Runtime), 10),
+		strings.Join(video.Genres, "|"),
+		strconv.FormatInt(int64(video.Version), 10),
+	})
+}
+
+func (e *csvVideoEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvVideoEncoder) end() error {
+	return e.flush()
+}
+
+// jsonVideoEncoder writes videos using Video.MarshalJSON(), either one per line (NDJSON)
+// or as the elements of a single JSON array.
+type jsonVideoEncoder struct {
+	w     *bufio.Writer
+	array bool
+	count int
+}
+
+func (e *jsonVideoEncoder) begin() error {
+	if e.array {
+		_, err := e.w.WriteString("[\n")
+		return err
+	}
+	return nil
+}
+
+func (e *jsonVideoEncoder) encode(video *data.Video) error {
+	js, err := json.Marshal(video)
+	if err != nil {
+		return err
+	}
+	if e.array && e.count > 0 {
+		e.w.WriteString(",\n")
+	}
+	e.count++
+	e.w.Write(js)
+	if !e.array {
+		return e.w.WriteByte('\n')
+	}
+	return nil
+}
+
+func (e *jsonVideoEncoder) flush() error {
+	return nil
+}
+
+func (e *jsonVideoEncoder) end() error {
+	if e.array {
+		_, err := e.w.WriteString("\n]\n")
+		return err
+	}
+	return nil
+}
+
+// The exportVideosHandler() handles "GET /v1/videos/export". It takes the same search
+// and sort parameters as listVideosHandler() (but no paging parameters, and no relevance
+// sort) and streams every matching video to the client as CSV, NDJSON or a JSON array,
+// depending on the format parameter.
+func (app *application) exportVideosHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	videoFilter := app.readVideoFilter(qs, v)
+	format := app.readString(qs, "format", "json")
+	filters := data.Filters{
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafelist: videoSortSafelist,
+	}
+	v.Check(validator.In(format, "csv", "ndjson", "json"), "format", "must be one of csv, ndjson or json")
+	v.Check(validator.In(filters.Sort, filters.SortSafelist...), "sort", "invalid sort value")
+	if data.ValidateVideoFilter(v, videoFilter); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if err := app.resolveFilterGenres(r, &videoFilter); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	buf := bufio.NewWriter(w)
+	var enc videoEncoder
+	var contentType string
+	switch format {
+	case "csv":
+		enc, contentType = &csvVideoEncoder{w: csv.NewWriter(buf)}, "text/csv"
+	case "ndjson":
+		enc, contentType = &jsonVideoEncoder{w: buf}, "application/x-ndjson"
+	default:
+		enc, contentType = &jsonVideoEncoder{w: buf, array: true}, "application/json"
+	}
+
+	// An export can run for longer than the server's WriteTimeout, so lift the write
+	// deadline for this response. The request context still ends the export if the
+	// client goes away or the server shuts down.
+	rc := http.NewResponseController(w)
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Headers are only sent once the first row is ready (or the export is finished), so
+	// that if the query fails straight away we can still send a proper error response.
+	started := false
+	start := func() error {
+		started = true
+		filename := fmt.Sprintf("videos-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.WriteHeader(http.StatusOK)
+		return enc.begin()
+	}
+	rows := 0
+	err = app.models.Videos.Stream(r.Context(), videoFilter, filters, func(video *data.Video) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := enc.encode(video); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushEvery == 0 {
+			if err := enc.flush(); err != nil {
+				return err
+			}
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && !started {
+		err = start()
+	}
+	if err == nil {
+		err = enc.end()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		if !started {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// The status code has already been sent, so log the error and abort the
+		// response. Panicking with http.ErrAbortHandler makes the server drop the
+		// connection instead of ending the response cleanly, so the client can tell
+		// that the export is incomplete.
+		app.logError(r, err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// The listGenresHandler() handles "GET /v1/genres", which returns the whole taxonomy.
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+	genres, err := app.models.Genres.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"genres": genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createGenreHandler() handles "POST /v1/genres". If the slug is left out it's
+// derived from the name, and aliases may be given in any spelling: they're stored in
+// slug form, which is how video genres are matched against them.
+func (app *application) createGenreHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Slug     string   `json:"slug"`
+		Name     string   `json:"name"`
+		Aliases  []string `json:"aliases"`
+		ParentID *int64   `json:"parent_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	genre := &data.Genre{
+		Slug:     input.Slug,
+		Name:     input.Name,
+		Aliases:  genreAliases(input.Aliases),
+		ParentID: input.ParentID,
+	}
+	if genre.Slug == "" {
+		genre.Slug = data.GenreSlug(input.Name)
+	}
+	v := validator.New()
+	if data.ValidateGenre(v, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Genres.Insert(r.Context(), genre)
+	if err != nil {
+		app.genreWriteErrorResponse(w, r, v, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/genres/%d", genre.ID))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"genre": genre}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showGenreHandler(w http.ResponseWriter, r *http.Request) {
+	genre, ok := app.readGenre(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"genre": genre}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateGenreHandler() handles "PATCH /v1/genres/:id". The name, aliases and parent
+// can be changed, but not the slug, because videos refer to genres by slug. The aliases
+// replace the existing ones, and a parent_id of 0 removes the genre's parent.
+func (app *application) updateGenreHandler(w http.ResponseWriter, r *http.Request) {
+	genre, ok := app.readGenre(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Name     *string  `json:"name"`
+		Aliases  []string `json:"aliases"`
+		ParentID *int64   `json:"parent_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Name != nil {
+		genre.Name = *input.Name
+	}
+	if input.Aliases != nil {
+		genre.Aliases = genreAliases(input.Aliases)
+	}
+	if input.ParentID != nil {
+		genre.ParentID = input.ParentID
+		if *input.ParentID == 0 {
+			genre.ParentID = nil
+		}
+	}
+	v := validator.New()
+	if data.ValidateGenre(v, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Genres.Update(r.Context(), genre)
+	if err != nil {
+		app.genreWriteErrorResponse(w, r, v, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"genre": genre}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteGenreHandler() handles "DELETE /v1/genres/:id". A genre can only be deleted
+// once no video uses it and it has no child genres.
+func (app *application) deleteGenreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Genres.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrGenreInUse):
+			app.errorResponse(w, r, http.StatusConflict, "the genre is still used by a video or another genre")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "genre successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readGenre() helper fetches the genre named by the ":id" URL parameter. If it
+// can't, it sends the error response itself and returns false.
+func (app *application) readGenre(w http.ResponseWriter, r *http.Request) (*data.Genre, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	genre, err := app.models.Genres.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return genre, true
+}
+
+// genreAliases converts aliases to the slug form that they're stored and matched in,
+// sorted in the same order that they're read back from the database.
+func genreAliases(aliases []string) []string {
+	slugs := make([]string, len(aliases))
+	for i, alias := range aliases {
+		slugs[i] = data.GenreSlug(alias)
+	}
+	sort.Strings(slugs)
+	return slugs
+}
+
+// The genreWriteErrorResponse() helper sends the response for an error returned when
+// saving a genre.
+func (app *application) genreWriteErrorResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator, err error) {
+	switch {
+	case errors.Is(err, data.ErrDuplicateGenre):
+		v.AddError("genre", "the slug or one of the aliases is already used by another genre")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrInvalidGenreParent):
+		v.AddError("parent_id", "must be an existing genre which isn't a descendant of this one")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrEditConflict):
+		app.editConflictResponse(w, r)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
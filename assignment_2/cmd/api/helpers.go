@@ -4,13 +4,17 @@ import (
 	"encoding/json" // New import
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"net"
 
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"assignment_2.alexedwards.net/internal/data"
 	"assignment_2.alexedwards.net/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -49,6 +53,64 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readBool() helper reads a boolean value from the query string. It accepts the same
+// values as strconv.ParseBool() ("true", "false", "1", "0" and so on), and works in the
+// same way as readInt() when the key is missing or the value can't be parsed.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return b
+}
+
+// The readTime() helper reads a timestamp from the query string. Both full RFC 3339
+// timestamps and plain dates in the format YYYY-MM-DD (taken as midnight UTC) are
+// accepted. It returns the zero time.Time if the key is missing.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+	v.AddError(key, "must be an RFC 3339 timestamp or a date in the format YYYY-MM-DD")
+	return time.Time{}
+}
+
+// The readIDList() helper reads a comma-separated list of IDs from the query string,
+// recording an error in the validator if any of them isn't an integer.
+func (app *application) readIDList(qs url.Values, key string, v *validator.Validator) []int64 {
+	var ids []int64
+	for _, s := range app.readCSV(qs, key, nil) {
+		id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			v.AddError(key, "must be a comma-separated list of integer values")
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// clientIP returns the IP address of the client which made the request.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter.
 	app.wg.Add(1)
@@ -77,6 +139,47 @@ func (app *application) readString(qs url.Values, key string, defaultValue strin
 	return s
 }
 
+// The videoETag() helper returns the entity tag for a video's representation, in the
+// form "<id>-<version>-<digest>". The version number is incremented on every update, but
+// the rating summary and the poster change without a new version, so the digest of those
+// is added to make sure that a client's copy is only Not Modified if all of it is current.
+func (app *application) videoETag(video *data.Video) string {
+	h := fnv.New64a()
+	if video.Rating != nil {
+		fmt.Fprintf(h, "%v:%d", video.Rating.Average, video.Rating.Count)
+	}
+	fmt.Fprintf(h, ":%s", video.Poster)
+	return fmt.Sprintf(`"%d-%d-%x"`, video.ID, video.Version, h.Sum64())
+}
+
+// The videoVersionMatches() helper reports whether an If-Match header value matches the
+// current version of a video. Only the ID and version parts of the entity tags are
+// compared, so other users' ratings don't stop a client from updating a video it has
+// seen the latest version of. As with etagMatches(), weak tags never match.
+func (app *application) videoVersionMatches(header string, video *data.Video) bool {
+	prefix := fmt.Sprintf(`"%d-%d-`, video.ID, video.Version)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.HasPrefix(candidate, prefix) && strings.HasSuffix(candidate, `"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// The etagMatches() helper reports whether an If-None-Match header value matches the
+// given entity tag. The header may contain "*" or a comma-separated list of tags, which
+// are compared with the weak comparison function from RFC 7232, ignoring any W/ prefix.
+func (app *application) etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func (app *application) readIDParam(r *http.Request) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
@@ -86,6 +189,53 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// The readVersionParam() helper reads the ":version" URL parameter, in the same way as
+// readIDParam() reads ":id".
+func (app *application) readVersionParam(r *http.Request) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid version parameter")
+	}
+	return int32(version), nil
+}
+
+// The readReviewIDParam() helper reads the ":review_id" URL parameter, in the same way
+// as readIDParam() reads ":id".
+func (app *application) readReviewIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.ParseInt(params.ByName("review_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid review_id parameter")
+	}
+	return id, nil
+}
+
+// The userHasPermission() helper reports whether the user making the request has been
+// granted the permission code. Unlike the requirePermission() middleware it doesn't send
+// a response, so handlers can use it when what a user may do depends on the request.
+func (app *application) userHasPermission(r *http.Request, code string) (bool, error) {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return false, nil
+	}
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		return false, err
+	}
+	return permissions.Include(code), nil
+}
+
+// The userPermissions() helper returns the permissions of the user making the request.
+// A signed authentication token carries the permissions the user had when it was issued,
+// so they're taken from its claims instead of the database.
+func (app *application) userPermissions(r *http.Request) (data.Permissions, error) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		return data.Permissions(claims.Permissions), nil
+	}
+	return app.models.Permissions.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+}
+
 // Define a writeJSON() helper for sending responses. This takes the destination
 // http.ResponseWriter, the HTTP status code to send, the data to encode to JSON, and a
 // header map containing any additional HTTP headers we want to include in the response.
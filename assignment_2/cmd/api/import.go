@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+const (
+	// importMaxBytes limits the size of an import request body. Imports are streamed,
+	// so this is much higher than the 1MB limit that readJSON() applies.
+	importMaxBytes = 64 << 20
+	// importBatchSize is the number of valid rows inserted per transaction.
+	importBatchSize = 100
+)
+
+// An importRow is the outcome for a single row of an import, as reported to the client.
+// Status is one of "created", "valid" (in a dry run), "invalid" or "failed".
+type importRow struct {
+	Row    int               `json:"row"`
+	Status string            `json:"status"`
+	ID     int64             `json:"id,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type importReport struct {
+	DryRun  bool         `json:"dry_run"`
+	Total   int          `json:"total"`
+	Created int          `json:"created"`
+	Invalid int          `json:"invalid"`
+	Failed  int          `json:"failed"`
+	Error   string       `json:"error,omitempty"`
+	Rows    []*importRow `json:"rows"`
+}
+
+// An importRowError means that a row couldn't be decoded, but that the reader can carry
+// on with the next row.
+type importRowError struct {
+	errors map[string]string
+}
+
+func (e *importRowError) Error() string {
+	return fmt.Sprintf("invalid row: %v", e.errors)
+}
+
+// A videoReader decodes videos from an import stream. Read() returns io.EOF at the end
+// of the stream, an *importRowError for a row that can be skipped, and any other error
+// when the stream itself is unreadable.
+type videoReader interface {
+	Read() (*data.Video, error)
+}
+
+// csvVideoReader reads CSV with a header row naming the title, year, runtime and genres
+// columns, and optionally description and language columns (in any order). Runtimes are
+// given in minutes, either as "102" or "102 mins", and genres are separated by "|".
+type csvVideoReader struct {
+	r       *csv.Reader
+	columns map[string]int
+}
+
+func newCSVVideoReader(r io.Reader) (*csvVideoReader, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("body must not be empty")
+		}
+		return nil, fmt.Errorf("unable to read CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !validator.In(name, "title", "description", "language", "year", "runtime", "genres") {
+			return nil, fmt.Errorf("CSV header contains unknown column %q", name)
+		}
+		columns[name] = i
+	}
+	for _, name := range []string{"title", "year", "runtime", "genres"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("CSV header is missing the %q column", name)
+		}
+	}
+	// Every record must have the same number of fields as the header.
+	cr.FieldsPerRecord = len(header)
+	return &csvVideoReader{r: cr, columns: columns}, nil
+}
+
+func (cr *csvVideoReader) Read() (*data.Video, error) {
+	record, err := cr.r.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && errors.Is(parseErr.Err, csv.ErrFieldCount) {
+			return nil, &importRowError{map[string]string{"row": "has the wrong number of fields"}}
+		}
+		return nil, err
+	}
+	rowErrors := make(map[string]string)
+	video := &data.Video{Title: record[cr.columns["title"]], Language: data.DefaultLanguage}
+	if i, ok := cr.columns["description"]; ok {
+		video.Description = record[i]
+	}
+	if i, ok := cr.columns["language"]; ok && strings.TrimSpace(record[i]) != "" {
+		video.Language = strings.TrimSpace(record[i])
+	}
+
+	year, err := strconv.ParseInt(strings.TrimSpace(record[cr.columns["year"]]), 10, 32)
+	if err != nil {
+		rowErrors["year"] = "must be an integer value"
+	}
+	video.Year = int32(year)
+
+	runtime := strings.TrimSuffix(strings.TrimSpace(record[cr.columns["runtime"]]), " mins")
+	minutes, err := strconv.ParseInt(runtime, 10, 32)
+	if err != nil {
+		rowErrors["runtime"] = "must be an integer number of minutes"
+	}
+	video.Runtime = data.Runtime(minutes)
+
+	if genres := strings.TrimSpace(record[cr.columns["genres"]]); genres != "" {
+		for _, genre := range strings.Split(genres, "|") {
+			video.Genres = append(video.Genres, strings.TrimSpace(genre))
+		}
+	}
+	if len(rowErrors) > 0 {
+		return nil, &importRowError{rowErrors}
+	}
+	return video, nil
+}
+
+// ndjsonVideoReader reads one JSON object per line, in the same format as the request
+// body for createVideoHandler().
+type ndjsonVideoReader struct {
+	dec *json.Decoder
+}
+
+func newNDJSONVideoReader(r io.Reader) *ndjsonVideoReader {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return &ndjsonVideoReader{dec: dec}
+}
+
+func (nr *ndjsonVideoReader) Read() (*data.Video, error) {
+	var input struct {
+		Title       string       `json:"title"`
+		Description string       `json:"description"`
+		Language    string       `json:"language"`
+		Year        int32        `json:"year"`
+		Runtime     data.Runtime `json:"runtime"`
+		Genres      []string     `json:"genres"`
+	}
+	input.Language = data.DefaultLanguage
+	err := nr.dec.Decode(&input)
+	if err != nil {
+		// The decoder reads a whole JSON value before unmarshalling it, so after a type
+		// error or an unknown field we can carry on with the next line. Syntax errors
+		// leave the stream in an unknown state, so those end the import.
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil, io.EOF
+		case errors.As(err, &syntaxError):
+			return nil, fmt.Errorf("badly-formed JSON (at character %d)", syntaxError.Offset)
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return nil, errors.New("badly-formed JSON")
+		case errors.As(err, &unmarshalTypeError):
+			return nil, &importRowError{map[string]string{unmarshalTypeError.Field: "has an incorrect JSON type"}}
+		case errors.Is(err, data.ErrInvalidRuntimeFormat):
+			return nil, &importRowError{map[string]string{"runtime": "must be in the format \"<runtime> mins\""}}
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return nil, &importRowError{map[string]string{"row": "contains unknown key " + fieldName}}
+		case err.Error() == "http: request body too large":
+			return nil, fmt.Errorf("body must not be larger than %d bytes", importMaxBytes)
+		default:
+			return nil, err
+		}
+	}
+	return &data.Video{
+		Title:       input.Title,
+		Description: input.Description,
+		Language:    input.Language,
+		Year:        input.Year,
+		Runtime:     input.Runtime,
+		Genres:      input.Genres,
+	}, nil
+}
+
+// The importVideosHandler() handles "POST /v1/videos/import". The request body is a CSV
+// file (Content-Type: text/csv) or newline-delimited JSON (Content-Type:
+// application/x-ndjson), which is read a row at a time. Each row is validated with
+// data.ValidateVideo(), and valid rows are inserted in transactions of importBatchSize
+// rows. With ?dry_run=true the rows are validated but nothing is written. The response
+// reports the outcome for every row. If the import can't finish, the report says how far
+// it got, because the batches before that point have been committed: it's sent with a
+// 400 Bad Request if the body couldn't be read, or a 500 Internal Server Error if the
+// server failed.
+func (app *application) importVideosHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	dryRun := app.readBool(r.URL.Query(), "dry_run", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxBytes)
+
+	var reader videoReader
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		cr, err := newCSVVideoReader(r.Body)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		reader = cr
+	case "application/x-ndjson", "application/ndjson":
+		reader = newNDJSONVideoReader(r.Body)
+	default:
+		app.unsupportedMediaTypeResponse(w, r, "text/csv", "application/x-ndjson")
+		return
+	}
+
+	report := &importReport{DryRun: dryRun, Rows: []*importRow{}}
+	var batch []*data.Video
+	var batchRows []*importRow
+
+	status := http.StatusOK
+	// fail marks the rows of the pending batch as failed, because the server can't
+	// carry on with the import. Earlier batches have already been committed, which the
+	// report makes clear.
+	fail := func(err error) {
+		app.logError(r, err)
+		for _, row := range batchRows {
+			row.Status = "failed"
+			report.Failed++
+		}
+		batch, batchRows = nil, nil
+		report.Error = "the server encountered a problem and could not finish the import"
+		status = http.StatusInternalServerError
+	}
+	// flush inserts the pending batch, and records the outcome against its rows. It
+	// returns false if the import can't continue.
+	flush := func() bool {
+		defer func() { batch, batchRows = nil, nil }()
+		if dryRun {
+			return true
+		}
+		for len(batch) > 0 {
+			err := app.models.Videos.InsertBatch(r.Context(), batch, app.contextGetUser(r).ID)
+			if err == nil {
+				for i, row := range batchRows {
+					row.Status, row.ID = "created", batch[i].ID
+					report.Created++
+				}
+				return true
+			}
+			var batchErr *data.BatchError
+			var constraintErr *data.ConstraintError
+			if !errors.As(err, &batchErr) || !errors.As(err, &constraintErr) {
+				fail(err)
+				return false
+			}
+			// One row broke a database constraint and the whole batch was rolled back,
+			// so report that row and try again without it.
+			i := batchErr.Index
+			batchRows[i].Status = "invalid"
+			batchRows[i].Errors = map[string]string{constraintErr.Field: constraintErr.Message}
+			report.Invalid++
+			batch = append(batch[:i], batch[i+1:]...)
+			batchRows = append(batchRows[:i], batchRows[i+1:]...)
+		}
+		return true
+	}
+
+	for {
+		video, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *importRowError
+		if err != nil && !errors.As(err, &rowErr) {
+			// The stream itself is unreadable. Insert the rows read so far, and report
+			// what we've done.
+			report.Error = err.Error()
+			status = http.StatusBadRequest
+			break
+		}
+		report.Total++
+		row := &importRow{Row: report.Total}
+		report.Rows = append(report.Rows, row)
+		if rowErr != nil {
+			row.Status, row.Errors = "invalid", rowErr.errors
+			report.Invalid++
+			continue
+		}
+		v := validator.New()
+		data.ValidateVideo(v, video)
+		if v.Valid() {
+			if err := app.resolveVideoGenres(r, v, video); err != nil {
+				batchRows = append(batchRows, row)
+				fail(err)
+				break
+			}
+		}
+		if !v.Valid() {
+			row.Status, row.Errors = "invalid", v.Errors
+			report.Invalid++
+			continue
+		}
+		row.Status = "valid"
+		batch = append(batch, video)
+		batchRows = append(batchRows, row)
+		if len(batch) == importBatchSize && !flush() {
+			break
+		}
+	}
+	// After a server error the pending batch has already been marked as failed and
+	// dropped, so this only inserts rows when the import got to the end of the body (or
+	// stopped because the body couldn't be read).
+	flush()
+
+	err := app.writeJSON(w, status, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"assignment_2.alexedwards.net/internal/data"
+)
+
+// failingVideoModel stands in for the database when it rejects some of a batch. Videos
+// titled "Constraint" break a constraint, and a video titled "Outage" fails the whole
+// insert the way a lost connection would.
+type failingVideoModel struct {
+	data.VideoRepository
+}
+
+func (m failingVideoModel) InsertBatch(ctx context.Context, videos []*data.Video, userID int64) error {
+	for i, video := range videos {
+		switch video.Title {
+		case "Constraint":
+			return &data.BatchError{Index: i, Err: &data.ConstraintError{Constraint: "movies_year_check", Field: "year", Message: "must be a valid year"}}
+		case "Outage":
+			return &data.BatchError{Index: i, Err: errors.New("connection reset by peer")}
+		}
+	}
+	return m.VideoRepository.InsertBatch(ctx, videos, userID)
+}
+
+// failingGenreModel fails to look up the "outage" genre, the way a lost connection would.
+type failingGenreModel struct {
+	data.GenreRepository
+}
+
+func (m failingGenreModel) Resolve(ctx context.Context, names []string) ([]string, []string, error) {
+	for _, name := range names {
+		if name == "outage" {
+			return nil, nil, errors.New("connection reset by peer")
+		}
+	}
+	return m.GenreRepository.Resolve(ctx, names)
+}
+
+func TestImportVideosBatchErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		titles     []string
+		wantCode   int
+		wantStatus []string
+		wantStored int
+	}{
+		{
+			name:       "Constraint violation",
+			titles:     []string{"Alpha", "Constraint", "Bravo", "Constraint"},
+			wantCode:   http.StatusOK,
+			wantStatus: []string{"created", "invalid", "created", "invalid"},
+			wantStored: 2,
+		},
+		{
+			name:       "Server error",
+			titles:     []string{"Alpha", "Outage", "Bravo"},
+			wantCode:   http.StatusInternalServerError,
+			wantStatus: []string{"failed", "failed", "failed"},
+			wantStored: 0,
+		},
+		{
+			// The import stops at the row whose genres can't be looked up, and the rows
+			// before it in the same batch aren't inserted either.
+			name:       "Genre lookup error",
+			titles:     []string{"Alpha", "Bravo", "Genre outage", "Charlie"},
+			wantCode:   http.StatusInternalServerError,
+			wantStatus: []string{"failed", "failed", "failed"},
+			wantStored: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models.Videos = failingVideoModel{app.models.Videos}
+			app.models.Genres = failingGenreModel{app.models.Genres}
+			ts := newTestServer(t, app)
+			_, token := newTestUser(t, app, "alice@example.com", "videos:read", "videos:write")
+
+			var body string
+			for _, title := range tt.titles {
+				genre := "drama"
+				if title == "Genre outage" {
+					genre = "outage"
+				}
+				body += `{"title": "` + title + `", "year": 2001, "runtime": "102 mins", "genres": ["` + genre + `"]}` + "\n"
+			}
+			header := http.Header{"Content-Type": {"application/x-ndjson"}}
+			code, _, resBody := ts.do(t, http.MethodPost, "/v1/videos/import", token, header, body)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", code, tt.wantCode, resBody)
+			}
+			var res struct {
+				Report importReport `json:"report"`
+			}
+			if err := json.Unmarshal([]byte(resBody), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Report.Rows) != len(tt.wantStatus) {
+				t.Fatalf("got %d rows; want %d", len(res.Report.Rows), len(tt.wantStatus))
+			}
+			for i, row := range res.Report.Rows {
+				if row.Status != tt.wantStatus[i] {
+					t.Errorf("got status %q for row %d; want %q", row.Status, row.Row, tt.wantStatus[i])
+				}
+			}
+			if wantError := tt.wantCode != http.StatusOK; (res.Report.Error != "") != wantError {
+				t.Errorf("got error %q in the report", res.Report.Error)
+			}
+
+			videos, _, err := app.models.Videos.GetAll(context.Background(), data.VideoFilter{}, data.Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(videos) != tt.wantStored {
+				t.Errorf("got %d stored videos; want %d", len(videos), tt.wantStored)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/jwt"
+)
+
+// The loadKeyset() function returns the keys for signing and verifying tokens when the
+// authentication mode is "jwt", and nil when it's "token". Keys are given as
+// "<kid>:<alg>:<base64>" (see jwt.ParseKey()). To rotate keys, add the new key, make it
+// the signing key, and remove the old one once the tokens it signed have expired.
+func loadKeyset(cfg config) (*jwt.Keyset, error) {
+	switch cfg.authMode {
+	case "token":
+		return nil, nil
+	case "jwt":
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", cfg.authMode)
+	}
+	if cfg.jwt.revocationSync <= 0 {
+		return nil, errors.New("jwt-revocation-sync must be greater than zero")
+	}
+	var keys []*jwt.Key
+	for _, s := range strings.Fields(cfg.jwt.keys) {
+		key, err := jwt.ParseKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwt-keys must contain at least one key when auth-mode is jwt")
+	}
+	signingKeyID := cfg.jwt.signingKey
+	if signingKeyID == "" {
+		signingKeyID = keys[0].ID
+	}
+	return jwt.NewKeyset(cfg.jwt.issuer, signingKeyID, keys...)
+}
+
+// The newJWT() helper returns a signed authentication token for the user, carrying
+// their activation state and current permissions. Unlike the opaque tokens it isn't
+// stored anywhere, so it can't be deleted, only revoked.
+func (app *application) newJWT(ctx context.Context, user *data.User, family string, ttl time.Duration) (*data.Token, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	claims := jwt.NewClaims(strconv.FormatInt(user.ID, 10), now, ttl)
+	claims.Activated, claims.Permissions, claims.Family = user.Activated, permissions, family
+	plaintext, err := app.jwt.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	token := &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    time.Unix(claims.ExpiresAt, 0),
+		Scope:     data.ScopeAuthentication,
+		CreatedAt: now,
+		Family:    family,
+	}
+	return token, nil
+}
+
+// The verifyJWT() helper checks a signed authentication token and returns its claims,
+// and the user it was issued to. The user only has the fields which the claims carry:
+// the ID and activation state.
+func (app *application) verifyJWT(token string) (*jwt.Claims, *data.User, error) {
+	claims, err := app.jwt.Verify(token, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	if app.revocations.revoked(claims, id) {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	return claims, &data.User{ID: id, Activated: claims.Activated}, nil
+}
+
+// The revokeJWT() helper records a revocation, and adds it to this server's revocation
+// list so that it applies immediately rather than after the next sync.
+func (app *application) revokeJWT(ctx context.Context, revocation *data.Revocation) error {
+	err := app.models.Revocations.Insert(ctx, revocation)
+	if err != nil {
+		return err
+	}
+	app.revocations.add(revocation)
+	return nil
+}
+
+// The revokeAllJWTs() helper revokes every signed token issued to the user so far. It
+// does nothing when signed tokens aren't in use.
+func (app *application) revokeAllJWTs(ctx context.Context, userID int64) error {
+	revocation := app.newUserRevocation(userID)
+	if revocation == nil {
+		return nil
+	}
+	return app.revokeJWT(ctx, revocation)
+}
+
+// The newFamilyRevocation() helper returns a revocation of the signed tokens issued from
+// a refresh token family, or nil when signed tokens aren't in use. Those tokens are
+// issued with the access token lifetime, so the revocation lasts as long as that. The
+// user ID and family are left for the caller to fill in.
+func (app *application) newFamilyRevocation() *data.Revocation {
+	if app.jwt == nil {
+		return nil
+	}
+	return &data.Revocation{Expiry: time.Now().Add(app.config.tokens.accessTTL)}
+}
+
+// The newUserRevocation() helper returns a revocation of every signed token issued to
+// the user so far, or nil when signed tokens aren't in use. The revocation lasts as long
+// as the longest-lived token this server issues.
+func (app *application) newUserRevocation(userID int64) *data.Revocation {
+	if app.jwt == nil {
+		return nil
+	}
+	ttl := 24 * time.Hour
+	if app.config.tokens.accessTTL > ttl {
+		ttl = app.config.tokens.accessTTL
+	}
+	return &data.Revocation{UserID: userID, Expiry: time.Now().Add(ttl)}
+}
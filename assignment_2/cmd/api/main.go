@@ -3,6 +3,7 @@ package main
 import (
 	"context"      // New import
 	"database/sql" // New import
+	"errors"
 	"flag"
 	"fmt"
 	"strings"
@@ -11,7 +12,6 @@ import (
 	// "github.com/golang-migrate/migrate/v4/database/postgres" // New import
 	// _ "github.com/golang-migrate/migrate/v4/source/file"     // New import
 	// "greenlight.alexedwards.net/internal/data"
-	"net/http"
 	"os"
 	"sync"
 	"time"
@@ -19,8 +19,10 @@ import (
 	// Import the pq driver so that it can register itself with the database/sql
 	// package. Note that we alias this import to the blank identifier, to stop the Go
 	// compiler complaining that the package isn't being used.
+	"assignment_2.alexedwards.net/internal/blob"
 	"assignment_2.alexedwards.net/internal/data"
 	"assignment_2.alexedwards.net/internal/jsonlog"
+	"assignment_2.alexedwards.net/internal/jwt"
 	"assignment_2.alexedwards.net/internal/mailer"
 	_ "github.com/lib/pq"
 )
@@ -30,20 +32,18 @@ const version = "1.0.0"
 // Add a db struct field to hold the configuration settings for our database connection
 // pool. For now this only holds the DSN, which we will read in from a command-line flag.
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port    int
+	env     string
+	storage string
+	db      struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		queryTimeout time.Duration
 	}
-	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
-	}
-	smtp struct {
+	limiter limiterConfig
+	smtp    struct {
 		host     string
 		port     int
 		username string
@@ -53,36 +53,113 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	trash struct {
+		retention     time.Duration
+		purgeInterval time.Duration
+	}
+	// suggestLimiter is used for the autocomplete endpoint instead of limiter.
+	suggestLimiter limiterConfig
+	blob           struct {
+		dir string
+	}
+	posters struct {
+		maxBytes int64
+	}
+	activation struct {
+		resendInterval time.Duration
+	}
+	passwordReset struct {
+		resendInterval time.Duration
+	}
+	// tokens holds the lifetimes of the tokens issued when a client asks for a refresh
+	// token. Tokens issued without one last 24 hours.
+	tokens struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	// authMode selects the kind of authentication token issued: "token" for opaque
+	// tokens which are looked up in the database, or "jwt" for signed tokens which are
+	// verified without one.
+	authMode string
+	jwt      struct {
+		keys           string
+		signingKey     string
+		issuer         string
+		revocationSync time.Duration
+	}
 }
+
+// limiterConfig holds the settings for one of the per-client rate limiters.
+type limiterConfig struct {
+	rps     float64
+	burst   int
+	enabled bool
+}
+
 type application struct {
 	config config
 	logger *jsonlog.Logger
 	models data.Models
 	mailer mailer.Mailer
+	blobs  blob.Store
 	wg     sync.WaitGroup
+	// activationThrottle limits how often activation emails are resent to each
+	// address, and passwordResetThrottle how often password reset emails are sent.
+	activationThrottle    *throttle
+	passwordResetThrottle *throttle
+	// jwt signs and verifies authentication tokens when the auth mode is "jwt", and is
+	// nil otherwise. revocations holds the signed tokens which have been revoked.
+	jwt         *jwt.Keyset
+	revocations *revocationList
 }
 
 func main() {
 	var cfg config
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.storage, "storage", "postgres", "Storage backend (postgres|memory)")
 
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("GREENLIGHT_DB_DSN"), "PostgreSQL DSN")
 
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "PostgreSQL per-query timeout")
 
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
+	// Autocomplete is called on every keystroke, so it has its own, more generous, rate
+	// limiter instead of counting towards the main one.
+	flag.Float64Var(&cfg.suggestLimiter.rps, "suggest-limiter-rps", 10, "Autocomplete rate limiter maximum requests per second")
+	flag.IntVar(&cfg.suggestLimiter.burst, "suggest-limiter-burst", 20, "Autocomplete rate limiter maximum burst")
+	flag.BoolVar(&cfg.suggestLimiter.enabled, "suggest-limiter-enabled", true, "Enable autocomplete rate limiter")
+
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
 	flag.StringVar(&cfg.smtp.username, "smtp-username", "0abf276416b183", "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "d8672aa2264bb5", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.alexedwards.net>", "SMTP sender")
 
+	flag.DurationVar(&cfg.trash.retention, "trash-retention", 30*24*time.Hour, "How long deleted videos are kept in the trash")
+	flag.DurationVar(&cfg.trash.purgeInterval, "trash-purge-interval", time.Hour, "How often to purge the trash (0 to disable)")
+
+	flag.StringVar(&cfg.blob.dir, "blob-dir", "./uploads", "Directory for uploaded files such as posters")
+	flag.Int64Var(&cfg.posters.maxBytes, "poster-max-bytes", 10<<20, "Maximum size of an uploaded poster image in bytes")
+
+	flag.DurationVar(&cfg.activation.resendInterval, "activation-resend-interval", 5*time.Minute, "Minimum time between activation emails resent to the same address")
+	flag.DurationVar(&cfg.passwordReset.resendInterval, "password-reset-interval", 5*time.Minute, "Minimum time between password reset emails sent to the same address")
+
+	flag.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "Lifetime of authentication tokens issued with a refresh token")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+
+	flag.StringVar(&cfg.authMode, "auth-mode", "token", "Authentication token type (token|jwt)")
+	flag.StringVar(&cfg.jwt.keys, "jwt-keys", os.Getenv("GREENLIGHT_JWT_KEYS"), "JWT keys as kid:alg:base64, where alg is HS256 or EdDSA (space separated)")
+	flag.StringVar(&cfg.jwt.signingKey, "jwt-signing-key", "", "ID of the JWT key to sign tokens with (defaults to the first key)")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "greenlight", "JWT issuer claim")
+	flag.DurationVar(&cfg.jwt.revocationSync, "jwt-revocation-sync", 30*time.Second, "How often to reload the JWT revocation list")
+
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
@@ -90,41 +167,71 @@ func main() {
 	flag.Parse()
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	db, err := openDB(cfg)
+	// A zero or negative timeout would make every query fail immediately, so refuse to
+	// start rather than serving nothing but 500 responses.
+	if cfg.db.queryTimeout <= 0 {
+		logger.PrintFatal(errors.New("db-query-timeout must be greater than zero"), nil)
+	}
+	// Likewise, a zero retention would purge videos the moment they were deleted.
+	if cfg.trash.retention <= 0 {
+		logger.PrintFatal(errors.New("trash-retention must be greater than zero"), nil)
+	}
+	if cfg.tokens.accessTTL <= 0 || cfg.tokens.refreshTTL <= 0 {
+		logger.PrintFatal(errors.New("access-token-ttl and refresh-token-ttl must be greater than zero"), nil)
+	}
+	if cfg.posters.maxBytes <= 0 {
+		logger.PrintFatal(errors.New("poster-max-bytes must be greater than zero"), nil)
+	}
+	keyset, err := loadKeyset(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	var models data.Models
+	switch cfg.storage {
+	case "postgres":
+		db, err := openDB(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		defer db.Close()
+		// Also log a message to say that the connection pool has been successfully
+		// established.
+		logger.PrintInfo("database connection pool established", nil)
+		models = data.NewModels(db, cfg.db.queryTimeout)
+	case "memory":
+		// The in-memory store needs no setup, but everything in it is lost when the
+		// server stops, so it's only suitable for local development and tests.
+		logger.PrintInfo("using in-memory storage", nil)
+		models = data.NewMemoryModels()
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown storage backend %q", cfg.storage), nil)
+	}
+
+	blobs, err := blob.NewDiskStore(cfg.blob.dir)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 
-	defer db.Close()
-	// Also log a message to say that the connection pool has been successfully
-	// established.
-	logger.PrintInfo("database connection pool established", nil)
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db),
+		models: models,
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		blobs:  blobs,
+
+		activationThrottle:    newThrottle(cfg.activation.resendInterval),
+		passwordResetThrottle: newThrottle(cfg.passwordReset.resendInterval),
+		jwt:                   keyset,
+		revocations:           newRevocationList(),
 	}
 
+	// Call app.serve() to start the server. It blocks until the server has been shut
+	// down gracefully, so there's nothing left to do afterwards.
 	err = app.serve()
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.port),
-		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
-	}
-	logger.PrintInfo("starting server", map[string]string{
-		"addr": srv.Addr,
-		"env":  cfg.env,
-	})
-	// Because the err variable is now already declared in the code above, we need
-	// to use the = operator here, instead of the := operator.
-	err = srv.ListenAndServe()
-	logger.PrintFatal(err, nil)
 }
 
 // The openDB() function returns a sql.DB connection pool.
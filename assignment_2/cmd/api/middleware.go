@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/jwt"
 	"assignment_2.alexedwards.net/internal/validator"
 	"golang.org/x/time/rate"
 )
@@ -22,6 +23,12 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 			// Use the builtin recover function to check if there has been a panic or
 			// not.
 			if err := recover(); err != nil {
+				// http.ErrAbortHandler is used deliberately to abort a response which
+				// has already started, such as a streamed export. Re-panic so that the
+				// server closes the connection, rather than treating it as a bug.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
 				// If there was a panic, set a "Connection: close" header on the
 				// response. This acts as a trigger to make Go's HTTP server
 				// automatically close the current connection after a response has been
@@ -39,7 +46,10 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
+// The rateLimit() middleware limits each client IP address to the rate in the given
+// config. Requests for which skip returns true aren't counted, which lets a route have a
+// separate limiter of its own. skip may be nil.
+func (app *application) rateLimit(limiter limiterConfig, skip func(*http.Request) bool, next http.Handler) http.Handler {
 	// Define a client struct to hold the rate limiter and last seen time for each
 	// client.
 	type client struct {
@@ -72,7 +82,7 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	}()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Only carry out the check if rate limiting is enabled.
-		if app.config.limiter.enabled {
+		if limiter.enabled && (skip == nil || !skip(r)) {
 			ip, _, err := net.SplitHostPort(r.RemoteAddr)
 			if err != nil {
 				app.serverErrorResponse(w, r, err)
@@ -83,7 +93,7 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 				clients[ip] = &client{
 					// Use the requests-per-second and burst values from the config
 					// struct.
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
+					limiter: rate.NewLimiter(rate.Limit(limiter.rps), limiter.burst),
 				}
 			}
 			clients[ip].lastSeen = time.Now()
@@ -129,6 +139,20 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
+		// When signed tokens are in use they're verified here, without touching the
+		// database. Opaque tokens issued before the switch still work until they
+		// expire, so anything which doesn't look like a JWT carries on below.
+		if app.jwt != nil && jwt.IsJWT(token) {
+			claims, user, err := app.verifyJWT(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			r = app.contextSetUser(r, user)
+			r = app.contextSetClaims(r, claims)
+			next.ServeHTTP(w, r)
+			return
+		}
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 		// If the token isn't valid, use the invalidAuthenticationTokenResponse()
@@ -142,7 +166,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// again calling the invalidAuthenticationTokenResponse() helper if no
 		// matching record was found. IMPORTANT: Notice that we are using
 		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -152,9 +176,16 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 			return
 		}
+		// Record which client used the token for the user's list of sessions. That's
+		// only bookkeeping, so a failure is logged rather than failing the request.
+		err = app.models.Tokens.Touch(r.Context(), token, clientIP(r), r.UserAgent())
+		if err != nil {
+			app.logError(r, err)
+		}
 		// Call the contextSetUser() helper to add the user information to the request
 		// context.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
@@ -189,10 +220,8 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
-		user := app.contextGetUser(r)
 		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.userPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -221,6 +250,9 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					// Let browser clients read the ETag header, which they need in order
+					// to send conditional PATCH and DELETE requests.
+					w.Header().Set("Access-Control-Expose-Headers", "ETag")
 					// Check if the request has the HTTP method OPTIONS and contains the
 					// "Access-Control-Request-Method" header. If it does, then we treat
 					// it as a preflight request.
@@ -228,7 +260,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 						// Set the necessary preflight response headers, as discussed
 						// previously.
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match")
 						// Write the headers along with a 200 OK status and return from
 						// the middleware with no further action.
 						w.WriteHeader(http.StatusOK)
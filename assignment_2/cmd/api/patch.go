@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/jsonpatch"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// The media types for the patch formats accepted by updateVideoHandler().
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// The readVideoPatch() helper reads a JSON Merge Patch or JSON Patch from the request
+// body and applies it to the editable part of the video's JSON representation (the
+// document the client gets from showVideoHandler(), less the read-only members such as
+// the rating and poster), then copies the result back onto the video. Problems
+// with the request body itself are returned as errors, as is jsonpatch.ErrTestFailed.
+// A well-formed patch which can't be applied to this particular video is reported
+// through the validator instead, and leaves the video unchanged.
+//
+// The id and version members are part of the document, so a JSON Patch can "test" the
+// version, but they can't be changed.
+func (app *application) readVideoPatch(w http.ResponseWriter, r *http.Request, mediaType string, video *data.Video, v *validator.Validator) error {
+	// Copy only the editable fields, so that the read-only members which MarshalJSON()
+	// adds to a stored video don't end up in the patched document and get rejected as
+	// unknown keys below.
+	editable := data.Video{
+		ID:          video.ID,
+		Title:       video.Title,
+		Description: video.Description,
+		Language:    video.Language,
+		Year:        video.Year,
+		Runtime:     video.Runtime,
+		Genres:      video.Genres,
+		Version:     video.Version,
+	}
+	js, err := json.Marshal(editable)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return err
+	}
+
+	var patched interface{}
+	switch mediaType {
+	case mergePatchType:
+		var patch interface{}
+		if err := app.readJSON(w, r, &patch); err != nil {
+			return err
+		}
+		patched = jsonpatch.MergePatch(doc, patch)
+	default:
+		var patch jsonpatch.Patch
+		if err := app.readJSON(w, r, &patch); err != nil {
+			return err
+		}
+		if err := patch.Validate(); err != nil {
+			return err
+		}
+		patched, err = patch.Apply(doc)
+		if err != nil {
+			if errors.Is(err, jsonpatch.ErrTestFailed) {
+				return err
+			}
+			v.AddError("patch", err.Error())
+			return nil
+		}
+	}
+
+	// Decode the patched document in the same way as a plain JSON body, except that
+	// problems are the fault of the patch rather than of the request's syntax.
+	js, err = json.Marshal(patched)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		ID          int64        `json:"id"`
+		Title       string       `json:"title"`
+		Description string       `json:"description"`
+		Language    string       `json:"language"`
+		Year        int32        `json:"year"`
+		Runtime     data.Runtime `json:"runtime"`
+		Genres      []string     `json:"genres"`
+		Version     int32        `json:"version"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&result)
+	if err != nil {
+		var unmarshalTypeError *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &unmarshalTypeError) && unmarshalTypeError.Field != "":
+			v.AddError(unmarshalTypeError.Field, "has an incorrect JSON type")
+		case errors.Is(err, data.ErrInvalidRuntimeFormat):
+			v.AddError("runtime", "must be in the format \"<runtime> mins\"")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			v.AddError("patch", "must not add unknown key "+fieldName)
+		default:
+			v.AddError("patch", "must leave the video as a JSON object")
+		}
+		return nil
+	}
+	v.Check(result.ID == video.ID, "id", "must not be changed")
+	v.Check(result.Version == video.Version, "version", "must not be changed")
+	if !v.Valid() {
+		return nil
+	}
+	video.Title = result.Title
+	video.Description = result.Description
+	video.Language = result.Language
+	video.Year = result.Year
+	video.Runtime = result.Runtime
+	video.Genres = result.Genres
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+func TestUpdateVideoPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantCode    int
+		wantBody    string
+		wantTitle   string
+	}{
+		{
+			name:        "Merge patch",
+			contentType: mergePatchType,
+			body:        `{"title": "Patched", "description": null}`,
+			wantCode:    http.StatusOK,
+			wantTitle:   "Patched",
+		},
+		{
+			name:        "JSON Patch",
+			contentType: jsonPatchType,
+			body:        `[{"op": "test", "path": "/version", "value": 1}, {"op": "replace", "path": "/title", "value": "Patched"}]`,
+			wantCode:    http.StatusOK,
+			wantTitle:   "Patched",
+		},
+		{
+			name:        "JSON Patch adding a genre",
+			contentType: jsonPatchType,
+			body:        `[{"op": "add", "path": "/genres/-", "value": "comedy"}]`,
+			wantCode:    http.StatusOK,
+			wantTitle:   "Original",
+		},
+		{
+			name:        "Failed test",
+			contentType: jsonPatchType,
+			body:        `[{"op": "test", "path": "/version", "value": 7}, {"op": "replace", "path": "/title", "value": "Patched"}]`,
+			wantCode:    http.StatusConflict,
+			wantTitle:   "Original",
+		},
+		{
+			name:        "Changed ID",
+			contentType: mergePatchType,
+			body:        `{"id": 99}`,
+			wantCode:    http.StatusUnprocessableEntity,
+			wantBody:    `"id": "must not be changed"`,
+			wantTitle:   "Original",
+		},
+		{
+			name:        "Unknown key",
+			contentType: mergePatchType,
+			body:        `{"director": "Someone"}`,
+			wantCode:    http.StatusUnprocessableEntity,
+			wantBody:    `must not add unknown key \"director\"`,
+			wantTitle:   "Original",
+		},
+		{
+			name:        "Read-only key",
+			contentType: jsonPatchType,
+			body:        `[{"op": "add", "path": "/rating", "value": {"average": 10, "count": 1}}]`,
+			wantCode:    http.StatusUnprocessableEntity,
+			wantBody:    `must not add unknown key \"rating\"`,
+			wantTitle:   "Original",
+		},
+		{
+			name:        "Invalid result",
+			contentType: mergePatchType,
+			body:        `{"title": ""}`,
+			wantCode:    http.StatusUnprocessableEntity,
+			wantBody:    `"title": "must be provided"`,
+			wantTitle:   "Original",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			user, token := newTestUser(t, app, "alice@example.com", "videos:read", "videos:write")
+			rater, _ := newTestUser(t, app, "bob@example.com")
+			video := newTestVideo(t, app, user.ID, "Original")
+			// A rating and a poster give the stored video read-only members which aren't
+			// part of the patch document.
+			_, err := app.models.Ratings.Insert(context.Background(), &data.Rating{VideoID: video.ID, UserID: rater.ID, Score: 8})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = app.models.Videos.SetPoster(context.Background(), video.ID, fmt.Sprintf("posters/%d/original.png", video.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := fmt.Sprintf("/v1/videos/%d", video.ID)
+			header := http.Header{"Content-Type": {tt.contentType}}
+			code, _, body := ts.do(t, http.MethodPatch, path, token, header, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", code, tt.wantCode, body)
+			}
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("got body %s; want it to contain %s", body, tt.wantBody)
+			}
+
+			stored, err := app.models.Videos.Get(context.Background(), video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Title != tt.wantTitle {
+				t.Errorf("got title %q; want %q", stored.Title, tt.wantTitle)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var res struct {
+				Video struct {
+					Version int32              `json:"version"`
+					Rating  data.RatingSummary `json:"rating"`
+					Poster  map[string]string  `json:"poster"`
+				} `json:"video"`
+			}
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Video.Version != 2 {
+				t.Errorf("got version %d; want 2", res.Video.Version)
+			}
+			if res.Video.Rating.Count != 1 {
+				t.Errorf("got rating count %d; want 1", res.Video.Rating.Count)
+			}
+			if res.Video.Poster["original"] == "" {
+				t.Errorf("got poster %v; want the original's URL", res.Video.Poster)
+			}
+		})
+	}
+}
+
+// Every read-only member which MarshalJSON() can add must be left out of the patch
+// document, whatever the patch format.
+func TestReadVideoPatchReadOnlyMembers(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{mergePatchType, `{"title": "Patched"}`},
+		{jsonPatchType, `[{"op": "replace", "path": "/title", "value": "Patched"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			app := newTestApplication(t)
+			inWatchlist := true
+			video := &data.Video{
+				ID:          1,
+				Title:       "Original",
+				Year:        2001,
+				Runtime:     102,
+				Genres:      []string{"drama"},
+				Version:     3,
+				Search:      &data.SearchHit{Rank: 0.5, Title: "<b>Original</b>"},
+				Credits:     []*data.Credit{{PersonID: 1, PersonName: "Someone", Role: "director"}},
+				Rating:      &data.RatingSummary{Average: 8, Count: 1},
+				InWatchlist: &inWatchlist,
+				Poster:      "posters/1/original.png",
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPatch, "/v1/videos/1", strings.NewReader(tt.body))
+			v := validator.New()
+			err := app.readVideoPatch(w, r, tt.contentType, video, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !v.Valid() {
+				t.Fatalf("got errors %v", v.Errors)
+			}
+			if video.Title != "Patched" {
+				t.Errorf("got title %q; want %q", video.Title, "Patched")
+			}
+			if video.Poster != "posters/1/original.png" || video.Rating.Count != 1 || len(video.Credits) != 1 {
+				t.Errorf("read-only fields changed: %+v", video)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Register the GIF decoder with image.Decode().
+	"image/jpeg"
+	_ "image/png" // Register the PNG decoder with image.Decode().
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"assignment_2.alexedwards.net/internal/blob"
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// posterOverheadBytes is added to the poster size limit to allow for the multipart
+	// boundaries and headers, and for any small form fields sent with the poster.
+	posterOverheadBytes = 64 << 10
+	// maxPosterPixels limits the dimensions of an uploaded poster. A small compressed
+	// file can decode to an enormous image, so the dimensions are checked before the
+	// image is decoded.
+	maxPosterPixels = 25_000_000
+	// posterJPEGQuality is the quality the thumbnails are encoded with.
+	posterJPEGQuality = 85
+)
+
+// posterTypes maps the content types accepted for a poster, as sniffed from the
+// uploaded file, to the file extension the original is stored with.
+var posterTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// The uploadPosterHandler() handles "POST /v1/videos/:id/poster". The poster is sent in
+// a multipart/form-data body as the "poster" file. Its content type is sniffed from the
+// file itself rather than trusted from the client, and the original is stored alongside
+// JPEG thumbnails in each of data.PosterSizes. Any previous poster is deleted.
+func (app *application) uploadPosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	video, err := app.models.Videos.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	maxBytes := app.config.posters.maxBytes
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+posterOverheadBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("body must be multipart/form-data"))
+		return
+	}
+	v := validator.New()
+	content, err := readPosterPart(mr, maxBytes)
+	if err != nil {
+		switch {
+		case errors.Is(err, errPosterTooLarge):
+			v.AddError("poster", fmt.Sprintf("must not be larger than %d bytes", maxBytes))
+			app.failedValidationResponse(w, r, v.Errors)
+		case err.Error() == "http: request body too large":
+			app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytes+posterOverheadBytes))
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+	v.Check(content != nil, "poster", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ext, ok := posterTypes[http.DetectContentType(content)]
+	v.Check(ok, "poster", "must be a JPEG, PNG or GIF image")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	v.Check(err == nil, "poster", "must be a valid image")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	v.Check(config.Width > 0 && config.Height > 0, "poster", "must not be empty")
+	v.Check(config.Width*config.Height <= maxPosterPixels, "poster", "must not be larger than 25 megapixels")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	v.Check(err == nil, "poster", "must be a valid image")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	thumbnails, err := posterThumbnails(img)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Each upload gets a new random directory, so the blobs under a key never change and
+	// the media endpoint can let clients cache them forever.
+	key, err := newPosterKey(video.ID, ext)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.putPoster(r.Context(), key, content, thumbnails)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	old, err := app.models.Videos.SetPoster(r.Context(), video.ID, key)
+	if err != nil {
+		app.deletePoster(key)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if old != "" {
+		app.deletePoster(old)
+	}
+
+	video.Poster = key
+	headers := make(http.Header)
+	headers.Set("ETag", app.videoETag(video))
+	err = app.writeJSON(w, http.StatusOK, envelope{"video": video}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deletePosterHandler() handles "DELETE /v1/videos/:id/poster".
+func (app *application) deletePosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	old, err := app.models.Videos.SetPoster(r.Context(), id, "")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if old == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+	app.deletePoster(old)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "poster successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showMediaHandler() handles "GET /v1/media/*key", which serves the uploaded files
+// in the blob store. It doesn't require authentication, because the URLs are used
+// directly in <img> tags, which can't send a bearer token. The keys are random, so a
+// file can only be found through a video which links to it.
+func (app *application) showMediaHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	key := strings.TrimPrefix(params.ByName("key"), "/")
+	if !blob.ValidKey(key) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	file, err := app.blobs.Get(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, blob.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.WriteHeader(http.StatusOK)
+	// The status has already been sent, so a failure part way through can only be
+	// logged.
+	if _, err := io.Copy(w, file); err != nil {
+		app.logError(r, err)
+	}
+}
+
+var errPosterTooLarge = errors.New("poster too large")
+
+// readPosterPart reads the "poster" file from a multipart body, skipping any other
+// parts. It returns a nil slice if there's no poster part, and errPosterTooLarge if the
+// file is larger than maxBytes.
+func readPosterPart(mr *multipart.Reader, maxBytes int64) ([]byte, error) {
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if part.FormName() != "poster" {
+			part.Close()
+			continue
+		}
+		defer part.Close()
+		content, err := io.ReadAll(io.LimitReader(part, maxBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(content)) > maxBytes {
+			return nil, errPosterTooLarge
+		}
+		return content, nil
+	}
+}
+
+// newPosterKey returns the blob key for a new poster of the given video, in a directory
+// of its own under "posters/<id>/".
+func newPosterKey(videoID int64, ext string) (string, error) {
+	randomBytes := make([]byte, 8)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("posters/%d/%s/original%s", videoID, hex.EncodeToString(randomBytes), ext), nil
+}
+
+// The putPoster() helper stores a poster's original and its thumbnails. If any of them
+// can't be stored, the ones that were are deleted again.
+func (app *application) putPoster(ctx context.Context, key string, original []byte, thumbnails map[string][]byte) error {
+	err := app.blobs.Put(ctx, key, bytes.NewReader(original))
+	if err == nil {
+		for _, size := range data.PosterSizes {
+			err = app.blobs.Put(ctx, data.PosterThumbnailKey(key, size.Name), bytes.NewReader(thumbnails[size.Name]))
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		app.deletePoster(key)
+	}
+	return err
+}
+
+// The deletePoster() helper deletes a poster's original and its thumbnails. The poster
+// is no longer referred to by then, so a failure is logged rather than returned.
+func (app *application) deletePoster(key string) {
+	for _, k := range data.PosterKeys(key) {
+		err := app.blobs.Delete(context.Background(), k)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"blob": k})
+		}
+	}
+}
+
+// posterThumbnails encodes a JPEG thumbnail of img in each of data.PosterSizes, keyed by
+// size name. Each size is scaled down from the next larger one, which is much cheaper
+// than scaling every size from a large original. An image which is already narrower
+// than a size is never scaled up.
+func posterThumbnails(img image.Image) (map[string][]byte, error) {
+	// JPEG has no transparency, so transparent areas are flattened onto white.
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Over)
+
+	thumbnails := make(map[string][]byte, len(data.PosterSizes))
+	for i := len(data.PosterSizes) - 1; i >= 0; i-- {
+		size := data.PosterSizes[i]
+		if src.Bounds().Dx() > size.Width {
+			src = scaleDown(src, size.Width)
+		}
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, src, &jpeg.Options{Quality: posterJPEGQuality})
+		if err != nil {
+			return nil, err
+		}
+		thumbnails[size.Name] = buf.Bytes()
+	}
+	return thumbnails, nil
+}
+
+// scaleDown resizes src to the given width, keeping its aspect ratio, by averaging the
+// block of source pixels which falls under each destination pixel. The width must be
+// smaller than the width of src.
+func scaleDown(src *image.RGBA, width int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	height := (sh*width + sw/2) / sw
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += int(row[i])
+					g += int(row[i+1])
+					bl += int(row[i+2])
+					a += int(row[i+3])
+					n++
+				}
+			}
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(bl / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"testing"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/blob"
+	"assignment_2.alexedwards.net/internal/data"
+)
+
+// uploadTestPoster uploads a small PNG as the video's poster, and returns the response's
+// headers.
+func uploadTestPoster(t *testing.T, ts *testServer, token string, videoID int64) http.Header {
+	t.Helper()
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 40, 60))); err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("poster", "poster.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(img.Bytes())
+	mw.Close()
+
+	header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+	code, resHeader, resBody := ts.do(t, http.MethodPost, fmt.Sprintf("/v1/videos/%d/poster", videoID), token, header, body.String())
+	if code != http.StatusOK {
+		t.Fatalf("got status %d for the upload; want %d: %s", code, http.StatusOK, resBody)
+	}
+	return resHeader
+}
+
+// Changing a poster doesn't change the video's version, but the entity tag sent back must
+// still be a new one, so that clients don't keep serving the old poster's URLs.
+func TestUploadPosterETag(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	user, token := newTestUser(t, app, "alice@example.com", "videos:read", "videos:write")
+	video := newTestVideo(t, app, user.ID, "Original")
+	path := fmt.Sprintf("/v1/videos/%d", video.ID)
+
+	etags := map[string]bool{}
+	_, header, _ := ts.do(t, http.MethodGet, path, token, nil, "")
+	etags[header.Get("ETag")] = true
+	for i := 0; i < 2; i++ {
+		etag := uploadTestPoster(t, ts, token, video.ID).Get("ETag")
+		if etags[etag] {
+			t.Fatalf("got entity tag %s again after upload %d", etag, i+1)
+		}
+		etags[etag] = true
+		code, _, _ := ts.do(t, http.MethodGet, path, token, http.Header{"If-None-Match": {etag}}, "")
+		if code != http.StatusNotModified {
+			t.Errorf("got status %d for the uploaded entity tag; want %d", code, http.StatusNotModified)
+		}
+	}
+}
+
+func TestPurgeTrashDeletesPosters(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	user, token := newTestUser(t, app, "alice@example.com", "videos:read", "videos:write")
+	purged := newTestVideo(t, app, user.ID, "Purged")
+	kept := newTestVideo(t, app, user.ID, "Kept")
+	uploadTestPoster(t, ts, token, purged.ID)
+	uploadTestPoster(t, ts, token, kept.ID)
+	ctx := context.Background()
+	var posters []string
+	for _, id := range []int64{purged.ID, kept.ID} {
+		video, err := app.models.Videos.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		posters = append(posters, video.Poster)
+	}
+	if err := app.models.Videos.Delete(ctx, purged.ID, 0, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deletion times are truncated to the second, so a negative retention is needed to
+	// purge a video which has only just been deleted.
+	app.config.trash.retention = -time.Second
+	app.purgeTrash()
+
+	for i, poster := range posters {
+		wantDeleted := i == 0
+		for _, key := range data.PosterKeys(poster) {
+			rc, err := app.blobs.Get(ctx, key)
+			if err == nil {
+				rc.Close()
+			}
+			if deleted := errors.Is(err, blob.ErrNotFound); deleted != wantDeleted {
+				t.Errorf("got blob %s deleted %t; want %t", key, deleted, wantDeleted)
+			}
+		}
+	}
+}
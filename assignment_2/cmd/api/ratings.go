@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// The showRatingHandler() handles "GET /v1/videos/:id/rating", which returns the current
+// user's rating of the video.
+func (app *application) showRatingHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	rating, err := app.models.Ratings.Get(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"rating": rating}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createRatingHandler() handles "POST /v1/videos/:id/rating". Each user can rate a
+// video once; after that the rating is changed with PUT. The response includes the
+// video's new rating summary.
+func (app *application) createRatingHandler(w http.ResponseWriter, r *http.Request) {
+	rating, ok := app.readRating(w, r)
+	if !ok {
+		return
+	}
+	summary, err := app.models.Ratings.Insert(r.Context(), rating)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateRating):
+			app.errorResponse(w, r, http.StatusConflict, "you have already rated this video, use PUT to change your rating")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"rating": rating, "video_rating": summary}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateRatingHandler() handles "PUT /v1/videos/:id/rating", which changes the score
+// of the current user's existing rating.
+func (app *application) updateRatingHandler(w http.ResponseWriter, r *http.Request) {
+	rating, ok := app.readRating(w, r)
+	if !ok {
+		return
+	}
+	summary, err := app.models.Ratings.Update(r.Context(), rating)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"rating": rating, "video_rating": summary}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteRatingHandler() handles "DELETE /v1/videos/:id/rating", which removes the
+// current user's rating.
+func (app *application) deleteRatingHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	summary, err := app.models.Ratings.Delete(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "rating successfully deleted", "video_rating": summary}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readRating() helper builds the current user's rating for the video named by the
+// ":id" URL parameter from the request body, and validates it. If it can't, it sends the
+// error response itself and returns false.
+func (app *application) readRating(w http.ResponseWriter, r *http.Request) (*data.Rating, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	var input struct {
+		Score int32 `json:"score"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+	rating := &data.Rating{
+		VideoID: id,
+		UserID:  app.contextGetUser(r).ID,
+		Score:   input.Score,
+	}
+	v := validator.New()
+	if data.ValidateRating(v, rating); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+	return rating, true
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// The listReviewsHandler() handles "GET /v1/videos/:id/reviews". Only approved reviews
+// are listed by default; moderators can list the pending or rejected reviews with the
+// status parameter.
+func (app *application) listReviewsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	status := app.readString(qs, "status", data.ReviewApproved)
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "-created_at"),
+		SortSafelist: []string{"created_at", "-created_at"},
+	}
+	v.Check(validator.In(status, data.ReviewStatuses...), "status", "must be one of pending, approved or rejected")
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if status != data.ReviewApproved {
+		moderator, err := app.userHasPermission(r, "reviews:moderate")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !moderator {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+	// Check that the video exists, so that a missing video is a 404 rather than an
+	// empty list.
+	_, err = app.models.Videos.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	reviews, metadata, err := app.models.Reviews.GetAllForVideo(r.Context(), id, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"reviews": reviews, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createReviewHandler() handles "POST /v1/videos/:id/reviews". Each user can review
+// a video once, and the review is pending until a moderator approves it.
+func (app *application) createReviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	var input struct {
+		Body string `json:"body"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	review := &data.Review{
+		VideoID: id,
+		UserID:  app.contextGetUser(r).ID,
+		Body:    input.Body,
+		Status:  data.ReviewPending,
+	}
+	v := validator.New()
+	if data.ValidateReview(v, review); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Reviews.Insert(r.Context(), review)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateReview):
+			app.errorResponse(w, r, http.StatusConflict, "you have already reviewed this video")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/videos/%d/reviews/%d", review.VideoID, review.ID))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"review": review}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showReviewHandler() handles "GET /v1/videos/:id/reviews/:review_id". A review
+// which hasn't been approved can only be seen by its author and by moderators.
+func (app *application) showReviewHandler(w http.ResponseWriter, r *http.Request) {
+	review, moderator, ok := app.readReview(w, r)
+	if !ok {
+		return
+	}
+	if review.Status != data.ReviewApproved && review.UserID != app.contextGetUser(r).ID && !moderator {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"review": review}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateReviewHandler() handles "PATCH /v1/videos/:id/reviews/:review_id". The
+// author can change the body, which sends the review back for moderation, and
+// moderators can change the status.
+func (app *application) updateReviewHandler(w http.ResponseWriter, r *http.Request) {
+	review, moderator, ok := app.readReview(w, r)
+	if !ok {
+		return
+	}
+	author := review.UserID == app.contextGetUser(r).ID
+	if !author && !moderator {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	var input struct {
+		Body   *string `json:"body"`
+		Status *string `json:"status"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if (input.Body != nil && !author) || (input.Status != nil && !moderator) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	if input.Body != nil {
+		review.Body = *input.Body
+		review.Status = data.ReviewPending
+	}
+	if input.Status != nil {
+		review.Status = *input.Status
+	}
+	v := validator.New()
+	if data.ValidateReview(v, review); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Reviews.Update(r.Context(), review)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"review": review}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteReviewHandler() handles "DELETE /v1/videos/:id/reviews/:review_id". A
+// review can be deleted by its author or by a moderator.
+func (app *application) deleteReviewHandler(w http.ResponseWriter, r *http.Request) {
+	review, moderator, ok := app.readReview(w, r)
+	if !ok {
+		return
+	}
+	if review.UserID != app.contextGetUser(r).ID && !moderator {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	err := app.models.Reviews.Delete(r.Context(), review.VideoID, review.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "review successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readReview() helper fetches the review named by the ":id" and ":review_id" URL
+// parameters, and reports whether the current user is a moderator. If it can't, it
+// sends the error response itself and returns false.
+func (app *application) readReview(w http.ResponseWriter, r *http.Request) (*data.Review, bool, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false, false
+	}
+	reviewID, err := app.readReviewIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false, false
+	}
+	review, err := app.models.Reviews.Get(r.Context(), id, reviewID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false, false
+	}
+	moderator, err := app.userHasPermission(r, "reviews:moderate")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false, false
+	}
+	return review, moderator, true
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// The listVideoRevisionsHandler() handles "GET /v1/videos/:id/revisions". Revisions are
+// listed newest first by default, and are still available while the video is in the
+// trash.
+func (app *application) listVideoRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "-version"),
+		SortSafelist: []string{"version", "-version"},
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	revisions, metadata, err := app.models.Revisions.GetAllForVideo(r.Context(), id, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Every video has at least one revision, so an empty first page means that there is
+	// no such video (or that it has been purged).
+	if len(revisions) == 0 && filters.Page == 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"revisions": revisions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showVideoRevisionHandler() handles "GET /v1/videos/:id/revisions/:version". The
+// response includes the revision's snapshots and a list of the fields which changed.
+func (app *application) showVideoRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	revision, ok := app.readVideoRevision(w, r)
+	if !ok {
+		return
+	}
+	changes, err := revision.Changes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"revision": revision, "changes": changes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The restoreVideoRevisionHandler() handles "POST /v1/videos/:id/revisions/:version/restore".
+// It copies the content of the revision's "after" snapshot back onto the live video and
+// saves it in the same way as updateVideoHandler(): the result is validated against the
+// current rules, If-Match is honoured, a concurrent edit gives a 409 Conflict, and the
+// rollback is itself recorded as a new revision.
+func (app *application) restoreVideoRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	revision, ok := app.readVideoRevision(w, r)
+	if !ok {
+		return
+	}
+	video, err := app.models.Videos.Get(r.Context(), revision.VideoID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && !app.videoVersionMatches(match, video) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+	video.Title = revision.After.Title
+	video.Description = revision.After.Description
+	// Revisions recorded before videos had a search language don't include one, so
+	// those keep the video's current language.
+	if revision.After.Language != "" {
+		video.Language = revision.After.Language
+	}
+	video.Year = revision.After.Year
+	video.Runtime = revision.After.Runtime
+	video.Genres = revision.After.Genres
+
+	v := validator.New()
+	if data.ValidateVideo(v, video); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Older revisions may name genres by an alias, or by a spelling from before the
+	// genre taxonomy, so they're resolved again just like a normal update.
+	if err := app.resolveVideoGenres(r, v, video); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Videos.Update(r.Context(), video, app.contextGetUser(r).ID)
+	if err != nil {
+		app.videoWriteErrorResponse(w, r, v, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", app.videoETag(video))
+	err = app.writeJSON(w, http.StatusOK, envelope{"video": video}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readVideoRevision() helper fetches the revision named by the ":id" and ":version"
+// URL parameters. If it can't, it sends the error response itself and returns false.
+func (app *application) readVideoRevision(w http.ResponseWriter, r *http.Request) (*data.VideoRevision, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	version, err := app.readVersionParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	revision, err := app.models.Revisions.Get(r.Context(), id, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return revision, true
+}
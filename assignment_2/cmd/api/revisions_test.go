@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"assignment_2.alexedwards.net/internal/data"
+)
+
+func TestRestoreVideoRevision(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int32
+		// ifMatch returns the If-Match header to send, given the video at version 3.
+		ifMatch     func(video *data.Video) string
+		wantCode    int
+		wantTitle   string
+		wantVersion int32
+	}{
+		{
+			name:        "First version",
+			version:     1,
+			wantCode:    http.StatusOK,
+			wantTitle:   "Original",
+			wantVersion: 4,
+		},
+		{
+			name:        "Current version",
+			version:     3,
+			wantCode:    http.StatusOK,
+			wantTitle:   "Third",
+			wantVersion: 4,
+		},
+		{
+			name:        "Current If-Match",
+			version:     1,
+			ifMatch:     func(video *data.Video) string { return fmt.Sprintf(`"%d-3-0"`, video.ID) },
+			wantCode:    http.StatusOK,
+			wantTitle:   "Original",
+			wantVersion: 4,
+		},
+		{
+			name:        "Stale If-Match",
+			version:     1,
+			ifMatch:     func(video *data.Video) string { return fmt.Sprintf(`"%d-2-0"`, video.ID) },
+			wantCode:    http.StatusPreconditionFailed,
+			wantTitle:   "Third",
+			wantVersion: 3,
+		},
+		{
+			name:        "Missing revision",
+			version:     9,
+			wantCode:    http.StatusNotFound,
+			wantTitle:   "Third",
+			wantVersion: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			user, token := newTestUser(t, app, "alice@example.com", "videos:read", "videos:write")
+			video := newTestVideo(t, app, user.ID, "Original")
+			path := fmt.Sprintf("/v1/videos/%d", video.ID)
+			header := http.Header{"Content-Type": {"application/json"}}
+			for _, title := range []string{"Second", "Third"} {
+				code, _, body := ts.do(t, http.MethodPatch, path, token, header, `{"title": "`+title+`"}`)
+				if code != http.StatusOK {
+					t.Fatalf("got status %d for the update; want %d: %s", code, http.StatusOK, body)
+				}
+			}
+
+			header = http.Header{}
+			if tt.ifMatch != nil {
+				header.Set("If-Match", tt.ifMatch(video))
+			}
+			code, _, body := ts.do(t, http.MethodPost, fmt.Sprintf("%s/revisions/%d/restore", path, tt.version), token, header, "")
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", code, tt.wantCode, body)
+			}
+
+			ctx := context.Background()
+			stored, err := app.models.Videos.Get(ctx, video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Title != tt.wantTitle || stored.Version != tt.wantVersion {
+				t.Errorf("got %q at version %d; want %q at version %d", stored.Title, stored.Version, tt.wantTitle, tt.wantVersion)
+			}
+			// The restore is recorded as a revision of its own.
+			filters := data.Filters{Page: 1, PageSize: 20, Sort: "version", SortSafelist: []string{"version"}}
+			revisions, _, err := app.models.Revisions.GetAllForVideo(ctx, video.ID, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(revisions) != int(tt.wantVersion) {
+				t.Errorf("got %d revisions; want %d", len(revisions), tt.wantVersion)
+			}
+		})
+	}
+}
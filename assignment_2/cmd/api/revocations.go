@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/jwt"
+)
+
+// A revocationList is the in-memory copy of the token_revocations table which the
+// authenticate() middleware checks signed tokens against, so that doing so doesn't need
+// a database query. Revocations made by this server are added to it straight away, and
+// those made by other servers are picked up by startRevocationSync().
+type revocationList struct {
+	mu sync.RWMutex
+	// tokens holds the revocations of single tokens, keyed by token ID.
+	tokens map[string]*data.Revocation
+	// families holds the revocations of refresh token families, keyed by family.
+	families map[string]*data.Revocation
+	// users holds the latest revocation of all of a user's tokens, keyed by user ID.
+	users map[int64]*data.Revocation
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		tokens:   make(map[string]*data.Revocation),
+		families: make(map[string]*data.Revocation),
+		users:    make(map[int64]*data.Revocation),
+	}
+}
+
+// add records revocations. Revocations are never undone, so the list only shrinks when
+// they expire.
+func (l *revocationList) add(revocations ...*data.Revocation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, revocation := range revocations {
+		switch {
+		case revocation.TokenID != "":
+			l.tokens[revocation.TokenID] = revocation
+			continue
+		case revocation.Family != "":
+			l.families[revocation.Family] = revocation
+			continue
+		}
+		if latest, ok := l.users[revocation.UserID]; !ok || revocation.RevokedAt.After(latest.RevokedAt) {
+			l.users[revocation.UserID] = revocation
+		}
+	}
+}
+
+// prune forgets the revocations which have expired.
+func (l *revocationList) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, revocation := range l.tokens {
+		if !revocation.Expiry.After(now) {
+			delete(l.tokens, id)
+		}
+	}
+	for family, revocation := range l.families {
+		if !revocation.Expiry.After(now) {
+			delete(l.families, family)
+		}
+	}
+	for id, revocation := range l.users {
+		if !revocation.Expiry.After(now) {
+			delete(l.users, id)
+		}
+	}
+}
+
+// revoked reports whether the token with the given claims has been revoked, by ID, along
+// with the rest of its refresh token family, or along with all of its user's tokens.
+// Tokens record when they were issued to the millisecond, so one issued in the same
+// millisecond as its user's tokens were revoked counts as revoked too.
+func (l *revocationList) revoked(claims *jwt.Claims, userID int64) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, ok := l.tokens[claims.ID]; ok {
+		return true
+	}
+	if _, ok := l.families[claims.Family]; ok && claims.Family != "" {
+		return true
+	}
+	revocation, ok := l.users[userID]
+	return ok && !claims.IssuedTime().After(revocation.RevokedAt)
+}
+
+// The startRevocationSync() method loads the revocation list and launches a background
+// goroutine which reloads it every sync interval, picking up the revocations made by
+// other servers, and deletes the revocations which have expired. It only runs when
+// signed tokens are in use. The returned function stops the goroutine.
+func (app *application) startRevocationSync() (stop func()) {
+	if app.jwt == nil {
+		return func() {}
+	}
+	// Load the list before returning, so that the server doesn't start by accepting
+	// tokens which have been revoked.
+	app.syncRevocations()
+	done := make(chan struct{})
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		ticker := time.NewTicker(app.config.jwt.revocationSync)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				app.syncRevocations()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// The syncRevocations() method runs a single reload. The active revocations are merged
+// into the list rather than replacing it, so that a revocation this server makes while
+// they're being read isn't lost. As with purgeTrash(), errors and panics are logged.
+func (app *application) syncRevocations() {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.PrintError(fmt.Errorf("%s", err), nil)
+		}
+	}()
+	ctx := context.Background()
+	err := app.models.Revocations.DeleteExpired(ctx)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"task": "sync revocations"})
+	}
+	revocations, err := app.models.Revocations.GetActive(ctx)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"task": "sync revocations"})
+		return
+	}
+	app.revocations.add(revocations...)
+	app.revocations.prune(time.Now())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/jwt"
+)
+
+func TestRevocationListRevoked(t *testing.T) {
+	revokedAt := time.Date(2024, 1, 2, 3, 4, 5, 500*int(time.Millisecond), time.UTC)
+	expiry := revokedAt.Add(time.Hour)
+	l := newRevocationList()
+	l.add(
+		&data.Revocation{TokenID: "revoked", UserID: 2, RevokedAt: revokedAt, Expiry: expiry},
+		&data.Revocation{Family: "revoked-family", UserID: 2, RevokedAt: revokedAt, Expiry: expiry},
+		&data.Revocation{UserID: 1, RevokedAt: revokedAt, Expiry: expiry},
+	)
+
+	tests := []struct {
+		name     string
+		id       string
+		family   string
+		userID   int64
+		issuedAt time.Time
+		want     bool
+	}{
+		{"Revoked ID", "revoked", "", 2, revokedAt.Add(time.Minute), true},
+		{"Revoked family", "other", "revoked-family", 2, revokedAt.Add(time.Minute), true},
+		{"Other family", "other", "other-family", 2, revokedAt.Add(-time.Minute), false},
+		{"Issued before user revocation", "other", "", 1, revokedAt.Add(-time.Millisecond), true},
+		{"Issued at user revocation", "other", "", 1, revokedAt, true},
+		{"Issued later in the same second", "other", "", 1, revokedAt.Add(time.Millisecond), false},
+		{"Other user", "other", "", 2, revokedAt.Add(-time.Minute), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.NewClaims("", tt.issuedAt, time.Hour)
+			claims.ID, claims.Family = tt.id, tt.family
+			if got := l.revoked(claims, tt.userID); got != tt.want {
+				t.Errorf("got revoked %t; want %t", got, tt.want)
+			}
+		})
+	}
+
+	// Expired revocations are pruned.
+	l.prune(expiry)
+	claims := jwt.NewClaims("", revokedAt.Add(-time.Minute), time.Hour)
+	claims.ID, claims.Family = "revoked", "revoked-family"
+	if l.revoked(claims, 1) {
+		t.Error("got revoked true after pruning; want false")
+	}
+}
@@ -15,17 +15,110 @@ func (app *application) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
+	// httprouter doesn't allow a fixed path segment like "facets" in the same position as
+	// the ":id" wildcard, so the fixed paths under /v1/videos/ are listed here per method
+	// and dispatched by fixedSegment() before falling back to the per-video handler.
+	// The autocomplete endpoint is rate limited on its own, and isExemptFromRateLimit()
+	// stops its requests counting towards the main limiter.
+	suggest := app.rateLimit(app.config.suggestLimiter, nil, app.requirePermission("videos:read", app.suggestVideosHandler))
+	videoActions := map[string]map[string]http.HandlerFunc{
+		http.MethodGet: {
+			"suggest": suggest.ServeHTTP,
+			"facets":  app.requirePermission("videos:read", app.videoFacetsHandler),
+			"export":  app.requirePermission("videos:read", app.exportVideosHandler),
+			"trash":   app.requirePermission("videos:write", app.listTrashHandler),
+		},
+		http.MethodPost: {
+			"import": app.requirePermission("videos:write", app.importVideosHandler),
+			"batch":  app.requirePermission("videos:write", app.batchVideosHandler),
+		},
+	}
+
 	router.HandlerFunc(http.MethodGet, "/v1/videos", app.requirePermission("videos:read", app.listVideosHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/videos", app.requirePermission("videos:write", app.createVideoHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/videos/:id", app.requirePermission("videos:read", app.showVideoHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/videos/:id", app.fixedSegment(videoActions[http.MethodGet], app.requirePermission("videos:read", app.showVideoHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/videos/:id", app.fixedSegment(videoActions[http.MethodPost], nil))
 	router.HandlerFunc(http.MethodPatch, "/v1/videos/:id", app.requirePermission("videos:write", app.updateVideoHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/videos/:id", app.requirePermission("videos:write", app.deleteVideoHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/videos/:id/restore", app.requirePermission("videos:write", app.restoreVideoHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/videos/:id/revisions", app.requirePermission("videos:read", app.listVideoRevisionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/videos/:id/revisions/:version", app.requirePermission("videos:read", app.showVideoRevisionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/videos/:id/revisions/:version/restore", app.requirePermission("videos:write", app.restoreVideoRevisionHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/videos/:id/credits", app.requirePermission("videos:write", app.updateVideoCreditsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/videos/:id/poster", app.requirePermission("videos:write", app.uploadPosterHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/videos/:id/poster", app.requirePermission("videos:write", app.deletePosterHandler))
+
+	// Uploaded files are served without authentication; see showMediaHandler().
+	router.HandlerFunc(http.MethodGet, "/v1/media/*key", app.showMediaHandler)
+
+	// Any activated user can rate and review videos. Moderation is checked inside the
+	// review handlers, because authors can also edit and delete their own reviews.
+	router.HandlerFunc(http.MethodGet, "/v1/videos/:id/rating", app.requireActivatedUser(app.showRatingHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/videos/:id/rating", app.requireActivatedUser(app.createRatingHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/videos/:id/rating", app.requireActivatedUser(app.updateRatingHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/videos/:id/rating", app.requireActivatedUser(app.deleteRatingHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/videos/:id/reviews", app.requirePermission("videos:read", app.listReviewsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/videos/:id/reviews", app.requireActivatedUser(app.createReviewHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/videos/:id/reviews/:review_id", app.requirePermission("videos:read", app.showReviewHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/videos/:id/reviews/:review_id", app.requireActivatedUser(app.updateReviewHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/videos/:id/reviews/:review_id", app.requireActivatedUser(app.deleteReviewHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/genres", app.requirePermission("videos:read", app.listGenresHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/genres", app.requirePermission("genres:write", app.createGenreHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/genres/:id", app.requirePermission("videos:read", app.showGenreHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/genres/:id", app.requirePermission("genres:write", app.updateGenreHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/genres/:id", app.requirePermission("genres:write", app.deleteGenreHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/people", app.requirePermission("videos:read", app.listPeopleHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/people", app.requirePermission("people:write", app.createPersonHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/people/:id", app.requirePermission("videos:read", app.showPersonHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/people/:id", app.requirePermission("people:write", app.updatePersonHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/people/:id", app.requirePermission("people:write", app.deletePersonHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+
+	// The watchlist routes are always scoped to the authenticated user.
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/watchlists", app.requireActivatedUser(app.listWatchlistsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/watchlist", app.requireActivatedUser(app.showWatchlistHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/watchlist", app.requireActivatedUser(app.addWatchlistItemHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/watchlist/:id", app.requireActivatedUser(app.updateWatchlistItemHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/watchlist/:id", app.requireActivatedUser(app.removeWatchlistItemHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+
+	return app.recoverPanic(app.enableCORS(app.rateLimit(app.config.limiter, isExemptFromRateLimit, app.authenticate(router))))
 
-	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
+}
+
+// The fixedSegment() helper returns a handler for a route ending in the ":id" wildcard
+// which first checks whether the segment is one of the fixed names in actions, and if
+// so calls that handler instead. If fallback is nil and no action matches, the client
+// gets a 405 Method Not Allowed, just as if the route had never been registered.
+func (app *application) fixedSegment(actions map[string]http.HandlerFunc, fallback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		if action, ok := actions[params.ByName("id")]; ok {
+			action(w, r)
+			return
+		}
+		if fallback == nil {
+			app.methodNotAllowedResponse(w, r)
+			return
+		}
+		fallback(w, r)
+	}
+}
 
+// isExemptFromRateLimit reports whether a request is left out of the main rate limiter
+// because its route has a limiter of its own.
+func isExemptFromRateLimit(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Path == "/v1/videos/suggest"
 }
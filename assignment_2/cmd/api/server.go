@@ -4,6 +4,7 @@ import (
 	"context" // New import
 	"errors"  // New import
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,13 +13,25 @@ import (
 )
 
 func (app *application) serve() error {
+	// Every request context is derived from baseCtx (via the BaseContext hook below), and
+	// handlers pass r.Context() down to the models. Cancelling baseCtx therefore aborts
+	// any database queries which are still running.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
+	// Start the trash purger and the revocation list sync. They're stopped once the
+	// server has shut down, before we wait for the background tasks to finish.
+	stopPurger := app.startTrashPurger()
+	stopRevocationSync := app.startRevocationSync()
 	shutdownError := make(chan error)
 	go func() {
 		quit := make(chan os.Signal, 1)
@@ -33,13 +46,20 @@ func (app *application) serve() error {
 		// shutdownError channel if it returns an error.
 		err := srv.Shutdown(ctx)
 		if err != nil {
+			// If Shutdown() gave up waiting, some requests are still in flight. Cancel
+			// their contexts so that slow queries are abandoned instead of holding on to
+			// database connections after we return.
+			cancelBase()
 			shutdownError <- err
+			return
 		}
 		// Log a message to say that we're waiting for any background goroutines to
 		// complete their tasks.
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
+		stopPurger()
+		stopRevocationSync()
 		// Call Wait() to block until our WaitGroup counter is zero --- essentially
 		// blocking until the background goroutines have finished. Then we return nil on
 		// the shutdownError channel, to indicate that the shutdown completed without
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// The suggestVideosHandler() handles "GET /v1/videos/suggest?q=". It returns up to limit
+// (default 10) title completions for the text the client has typed so far, tolerating
+// typos. Clients call it on every keystroke, so the results may be cached for a short
+// while.
+func (app *application) suggestVideosHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	query := app.readString(qs, "q", "")
+	limit := app.readInt(qs, "limit", 10, v)
+	if data.ValidateSuggestQuery(v, query, limit); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	suggestions, err := app.models.Videos.Suggest(r.Context(), query, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "private, max-age=60")
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
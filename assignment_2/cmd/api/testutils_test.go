@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/blob"
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/jsonlog"
+)
+
+// newTestApplication returns an application backed by the in-memory models, with the
+// settings main() would give it by default. Nothing is logged, and there's no mailer, so
+// background tasks which send email fail quietly.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+	blobs, err := blob.NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		logger:                jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:                data.NewMemoryModels(),
+		blobs:                 blobs,
+		activationThrottle:    newThrottle(time.Minute),
+		passwordResetThrottle: newThrottle(time.Minute),
+		revocations:           newRevocationList(),
+	}
+	app.config.authMode = "token"
+	app.config.db.queryTimeout = 3 * time.Second
+	app.config.posters.maxBytes = 10 << 20
+	app.config.tokens.accessTTL = 15 * time.Minute
+	app.config.tokens.refreshTTL = 24 * time.Hour
+	t.Cleanup(app.wg.Wait)
+	return app
+}
+
+type testServer struct {
+	*httptest.Server
+}
+
+// newTestServer starts a server for the application's routes, which is closed when the
+// test finishes.
+func newTestServer(t *testing.T, app *application) *testServer {
+	ts := httptest.NewServer(app.routes())
+	t.Cleanup(ts.Close)
+	return &testServer{ts}
+}
+
+// do sends a request to the test server, authenticated with token unless it's "", and
+// returns the response's status code, headers and body.
+func (ts *testServer) do(t *testing.T, method, urlPath, token string, header http.Header, body string) (int, http.Header, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+urlPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, res.Header, string(b)
+}
+
+// newTestUser inserts an activated user with the given permissions, and returns the user
+// and an authentication token for them.
+func newTestUser(t *testing.T, app *application, email string, permissions ...string) (*data.User, string) {
+	t.Helper()
+	ctx := context.Background()
+	user := &data.User{Name: "Test User", Email: email, Activated: true}
+	if err := user.Password.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Permissions.AddForUser(ctx, user.ID, permissions...); err != nil {
+		t.Fatal(err)
+	}
+	token, err := app.models.Tokens.New(ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token.Plaintext
+}
+
+// newTestVideo inserts a video and returns it.
+func newTestVideo(t *testing.T, app *application, userID int64, title string) *data.Video {
+	t.Helper()
+	video := &data.Video{
+		Title:    title,
+		Language: "english",
+		Year:     2001,
+		Runtime:  102,
+		Genres:   []string{"drama"},
+	}
+	if err := app.models.Videos.Insert(context.Background(), video, userID); err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A throttle allows one event per key in each interval, such as one email per address.
+// Unlike the rate limiters in rateLimit(), which are keyed by client IP address, it's
+// used inside handlers for keys taken from the request body.
+type throttle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+	swept    time.Time
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	return &throttle{
+		interval: interval,
+		last:     make(map[string]time.Time),
+		swept:    time.Now(),
+	}
+}
+
+// Allow reports whether an event for key may happen now, and if so records it. It
+// returns false if there was already an event for key within the interval.
+func (t *throttle) Allow(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	// Forget the keys which have served their interval every so often, so that the map
+	// doesn't grow without limit.
+	if now.Sub(t.swept) > t.interval {
+		for k, last := range t.last {
+			if now.Sub(last) >= t.interval {
+				delete(t.last, k)
+			}
+		}
+		t.swept = now
+	}
+	if last, ok := t.last[key]; ok && now.Sub(last) < t.interval {
+		return false
+	}
+	t.last[key] = now
+	return true
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"assignment_2.alexedwards.net/internal/data"
@@ -12,9 +16,12 @@ import (
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the email and password from the request body.
 
+	// If refresh is true, the client gets a short-lived authentication token and a
+	// refresh token to renew it with, instead of a single 24-hour token.
 	var input struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Refresh  bool   `json:"refresh"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -32,7 +39,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// Lookup the user record based on the email address. If no matching user was
 	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
 	// Unauthorized response to the client (we will create this helper in a moment).
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -54,9 +61,63 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
+	if input.Refresh {
+		family, err := data.NewTokenFamily()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		access, refresh, err := app.newTokenPair(r, user.ID, family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		tokens := []*data.Token{refresh, access}
+		// A signed authentication token takes the place of the opaque one, and isn't
+		// stored. The refresh token is opaque either way. The tokens are inserted
+		// together, so that a failure can't leave a refresh token without the
+		// authentication token it was issued with.
+		if app.jwt != nil {
+			access, err = app.newJWT(r.Context(), user, family, app.config.tokens.accessTTL)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			tokens = tokens[:1]
+		}
+		err = app.models.Tokens.Insert(r.Context(), tokens...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": access, "refresh_token": refresh}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if app.jwt != nil {
+		token, err := app.newJWT(r.Context(), user, "", 24*time.Hour)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// expiry time and the scope 'authentication', recording the client which asked for
+	// it so that it can be told apart in the user's list of sessions.
+	token, err := data.GenerateToken(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token.ClientIP, token.UserAgent = clientIP(r), r.UserAgent()
+	err = app.models.Tokens.Insert(r.Context(), token)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -68,3 +129,310 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The createPasswordResetTokenHandler() handles "POST /v1/tokens/password-reset". If the
+// email address belongs to an activated user, a password reset token is emailed to them.
+// The response is the same whether or not it does, so that the endpoint can't be used to
+// find out which email addresses have accounts. Emails to each address are throttled, so
+// that the endpoint can't be used to flood someone's inbox either.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// As with activation emails, the throttle applies whether or not the address has an
+	// account.
+	if !app.passwordResetThrottle.Allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+	// Looking up the user and creating the token happen in the background along with
+	// sending the email, so that the response time doesn't give away whether the user
+	// exists either. The request's context is cancelled once the response has been sent,
+	// so they use a context of their own.
+	app.background(func() {
+		ctx := context.Background()
+		user, err := app.models.Users.GetByEmail(ctx, input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+		if !user.Activated {
+			return
+		}
+		token, err := app.models.Tokens.New(ctx, user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+		data := map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		}
+		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	env := envelope{"message": "if that email address belongs to an activated account, you will receive an email containing password reset instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createActivationTokenHandler() handles "POST /v1/tokens/activation", which sends a
+// new activation email to a user who hasn't activated their account, in case the first
+// one was lost or its token expired. The old activation tokens stop working. Emails to
+// each address are throttled, and as with password resets the response doesn't reveal
+// whether the address has an account.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// The throttle applies whether or not the address has an account, so being
+	// throttled doesn't give anything away either. Email addresses are compared
+	// case-insensitively, like the users.email column.
+	if !app.activationThrottle.Allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+	app.background(func() {
+		ctx := context.Background()
+		user, err := app.models.Users.GetByEmail(ctx, input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+		if user.Activated {
+			return
+		}
+		err = app.models.Tokens.DeleteAllForUser(ctx, data.ScopeActivation, user.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+		token, err := app.models.Tokens.New(ctx, user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+		data := map[string]interface{}{
+			"activationToken": token.Plaintext,
+		}
+		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	env := envelope{"message": "if that email address belongs to an account which isn't activated yet, you will receive an email containing activation instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAuthenticationTokenHandler() handles "DELETE /v1/tokens/authentication",
+// which logs out by revoking the token that the request was made with, along with the
+// refresh token it came from, if any. A signed token is revoked by adding it to the
+// revocation list, along with the other tokens issued from the same refresh token family,
+// just as the family's stored tokens are deleted.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		revocation := &data.Revocation{
+			TokenID: claims.ID,
+			UserID:  app.contextGetUser(r).ID,
+			Expiry:  time.Unix(claims.ExpiresAt, 0),
+		}
+		if claims.Family != "" {
+			revocation = app.newFamilyRevocation()
+			revocation.Family, revocation.UserID = claims.Family, app.contextGetUser(r).ID
+		}
+		err := app.revokeJWT(r.Context(), revocation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.models.Tokens.DeleteFamily(r.Context(), claims.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		err := app.models.Tokens.Delete(r.Context(), data.ScopeAuthentication, app.contextGetToken(r))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAllAuthenticationTokensHandler() handles "DELETE
+// /v1/tokens/authentication/all", which logs the current user out of every session,
+// including the one the request was made with, and revokes their refresh tokens.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	for _, scope := range []string{data.ScopeRefresh, data.ScopeAuthentication} {
+		err := app.models.Tokens.DeleteAllForUser(r.Context(), scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err := app.revokeAllJWTs(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all authentication tokens successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listSessionsHandler() handles "GET /v1/users/me/sessions", which lists the current
+// user's unexpired authentication tokens, marking the one the request was made with.
+// Signed authentication tokens aren't stored, so when they're in use the sessions are the
+// user's refresh token families instead, and the current one is the family of the
+// request's token. Signed tokens issued without a refresh token don't belong to a family,
+// so they aren't listed; they last 24 hours, and can be revoked by logging out.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	claims := app.contextGetClaims(r)
+	var sessions []*data.Session
+	var err error
+	if claims != nil {
+		sessions, err = app.models.Tokens.GetRefreshSessions(r.Context(), user.ID)
+	} else {
+		sessions, err = app.models.Tokens.GetSessions(r.Context(), user.ID)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	current := sha256.Sum256([]byte(app.contextGetToken(r)))
+	for _, session := range sessions {
+		if claims != nil {
+			session.Current = claims.Family != "" && session.Family == claims.Family
+		} else {
+			session.Current = bytes.Equal(session.Hash, current[:])
+		}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The refreshTokenHandler() handles "POST /v1/tokens/refresh". It exchanges a refresh
+// token for a new authentication token and a new refresh token, and the old refresh
+// token stops working. If a refresh token is exchanged twice, then either the client or
+// an attacker has a copy of a token which should have been thrown away, so every token
+// descended from the same login is revoked and the user has to log in again.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// The user ID and family are filled in by Refresh() from the old refresh token.
+	access, refresh, err := app.newTokenPair(r, 0, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	tokens := []*data.Token{refresh, access}
+	if app.jwt != nil {
+		tokens = tokens[:1]
+	}
+	// If the refresh token has been used before, the signed tokens issued from its
+	// family are revoked along with the family's stored tokens.
+	reuse := app.newFamilyRevocation()
+	err = app.models.Tokens.Refresh(r.Context(), input.TokenPlaintext, reuse, tokens...)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			if reuse != nil {
+				app.revocations.add(reuse)
+			}
+			app.logger.PrintInfo("refresh token reused, token family revoked", map[string]string{
+				"client_ip": clientIP(r),
+			})
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// A signed authentication token is issued once the refresh token has been exchanged,
+	// because it needs the user's current activation state and permissions.
+	if app.jwt != nil {
+		user, err := app.models.Users.Get(r.Context(), refresh.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		access, err = app.newJWT(r.Context(), user, refresh.Family, app.config.tokens.accessTTL)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": access, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The newTokenPair() helper generates, but doesn't save, a short-lived authentication
+// token and a refresh token in the given family, for the client making the request.
+func (app *application) newTokenPair(r *http.Request, userID int64, family string) (*data.Token, *data.Token, error) {
+	access, err := data.GenerateToken(userID, app.config.tokens.accessTTL, data.ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := data.GenerateToken(userID, app.config.tokens.refreshTTL, data.ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, token := range []*data.Token{access, refresh} {
+		token.ClientIP, token.UserAgent, token.Family = clientIP(r), r.UserAgent(), family
+	}
+	return access, refresh, nil
+}
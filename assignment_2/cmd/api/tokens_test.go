@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/jwt"
+)
+
+// newTestJWTApplication returns a test application which issues signed authentication
+// tokens.
+func newTestJWTApplication(t *testing.T) *application {
+	t.Helper()
+	app := newTestApplication(t)
+	key, err := jwt.NewHMACKey("test", bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.jwt, err = jwt.NewKeyset("greenlight-test", key.ID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.config.authMode = "jwt"
+	return app
+}
+
+// login creates an authentication token and refresh token for the user, and returns
+// their plaintexts.
+func (ts *testServer) login(t *testing.T, email string) (string, string) {
+	t.Helper()
+	body := `{"email": "` + email + `", "password": "pa55word1234", "refresh": true}`
+	code, _, resBody := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", nil, body)
+	if code != http.StatusCreated {
+		t.Fatalf("got status %d for login; want %d: %s", code, http.StatusCreated, resBody)
+	}
+	return readTokenPair(t, resBody)
+}
+
+func readTokenPair(t *testing.T, body string) (string, string) {
+	t.Helper()
+	var res struct {
+		Access  struct{ Token string } `json:"authentication_token"`
+		Refresh struct{ Token string } `json:"refresh_token"`
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Access.Token, res.Refresh.Token
+}
+
+func TestJWTRevocation(t *testing.T) {
+	tests := []struct {
+		name string
+		// revoke does whatever should revoke the signed tokens from the login it's
+		// given, and returns the tokens which should still work afterwards.
+		revoke func(t *testing.T, ts *testServer, access, refresh string) []string
+	}{
+		{
+			name: "Reused refresh token",
+			revoke: func(t *testing.T, ts *testServer, access, refresh string) []string {
+				code, _, body := ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", nil, `{"token": "`+refresh+`"}`)
+				if code != http.StatusCreated {
+					t.Fatalf("got status %d for the first refresh; want %d: %s", code, http.StatusCreated, body)
+				}
+				refreshed, _ := readTokenPair(t, body)
+				code, _, body = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", nil, `{"token": "`+refresh+`"}`)
+				if code != http.StatusUnauthorized {
+					t.Fatalf("got status %d for the reused refresh; want %d: %s", code, http.StatusUnauthorized, body)
+				}
+				// The token from the first refresh came from the same family, so it's
+				// revoked along with the original.
+				if code, _, _ := ts.do(t, http.MethodGet, "/v1/videos", refreshed, nil, ""); code != http.StatusUnauthorized {
+					t.Errorf("got status %d for the refreshed token; want %d", code, http.StatusUnauthorized)
+				}
+				return nil
+			},
+		},
+		{
+			name: "Logout",
+			revoke: func(t *testing.T, ts *testServer, access, refresh string) []string {
+				code, _, body := ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", nil, `{"token": "`+refresh+`"}`)
+				if code != http.StatusCreated {
+					t.Fatalf("got status %d for the refresh; want %d: %s", code, http.StatusCreated, body)
+				}
+				refreshed, _ := readTokenPair(t, body)
+				other, _ := ts.login(t, "alice@example.com")
+				if code, _, body := ts.do(t, http.MethodDelete, "/v1/tokens/authentication", refreshed, nil, ""); code != http.StatusOK {
+					t.Fatalf("got status %d for logout; want %d: %s", code, http.StatusOK, body)
+				}
+				if code, _, _ := ts.do(t, http.MethodGet, "/v1/videos", refreshed, nil, ""); code != http.StatusUnauthorized {
+					t.Errorf("got status %d for the logged out token; want %d", code, http.StatusUnauthorized)
+				}
+				return []string{other}
+			},
+		},
+		{
+			name: "Logout everywhere",
+			revoke: func(t *testing.T, ts *testServer, access, refresh string) []string {
+				if code, _, body := ts.do(t, http.MethodDelete, "/v1/tokens/authentication/all", access, nil, ""); code != http.StatusOK {
+					t.Fatalf("got status %d for logout; want %d: %s", code, http.StatusOK, body)
+				}
+				// Logging in again straight away, within the same second, works.
+				again, _ := ts.login(t, "alice@example.com")
+				return []string{again}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestJWTApplication(t)
+			ts := newTestServer(t, app)
+			newTestUser(t, app, "alice@example.com", "videos:read")
+			access, refresh := ts.login(t, "alice@example.com")
+			if code, _, body := ts.do(t, http.MethodGet, "/v1/videos", access, nil, ""); code != http.StatusOK {
+				t.Fatalf("got status %d before revoking; want %d: %s", code, http.StatusOK, body)
+			}
+
+			valid := tt.revoke(t, ts, access, refresh)
+			if code, _, _ := ts.do(t, http.MethodGet, "/v1/videos", access, nil, ""); code != http.StatusUnauthorized {
+				t.Errorf("got status %d for the original token; want %d", code, http.StatusUnauthorized)
+			}
+			for _, token := range valid {
+				if code, _, body := ts.do(t, http.MethodGet, "/v1/videos", token, nil, ""); code != http.StatusOK {
+					t.Errorf("got status %d for a token which wasn't revoked; want %d: %s", code, http.StatusOK, body)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateActivationTokenThrottle(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	// The cases run in order against the same server, so each one sees the emails
+	// requested by the cases before it.
+	tests := []struct {
+		email    string
+		wantCode int
+	}{
+		{"alice", http.StatusUnprocessableEntity},
+		{"alice@example.com", http.StatusAccepted},
+		{"alice@example.com", http.StatusTooManyRequests},
+		{"ALICE@example.com", http.StatusTooManyRequests},
+		{"bob@example.com", http.StatusAccepted},
+		{"bob@example.com", http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		body := `{"email": "` + tt.email + `"}`
+		code, _, resBody := ts.do(t, http.MethodPost, "/v1/tokens/activation", "", nil, body)
+		if code != tt.wantCode {
+			t.Errorf("got status %d for %s; want %d: %s", code, tt.email, tt.wantCode, resBody)
+		}
+	}
+}
+
+func TestCreatePasswordResetTokenThrottle(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+
+	// The cases run in order against the same server, so each one sees the emails
+	// requested by the cases before it.
+	tests := []struct {
+		email    string
+		wantCode int
+	}{
+		{"alice@example.com", http.StatusAccepted},
+		{"alice@example.com", http.StatusTooManyRequests},
+		{"Alice@Example.com", http.StatusTooManyRequests},
+		{"bob@example.com", http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		body := `{"email": "` + tt.email + `"}`
+		code, _, resBody := ts.do(t, http.MethodPost, "/v1/tokens/password-reset", "", nil, body)
+		if code != tt.wantCode {
+			t.Errorf("got status %d for %s; want %d: %s", code, tt.email, tt.wantCode, resBody)
+		}
+	}
+}
+
+// Signed tokens aren't stored, so their sessions are the refresh token families.
+func TestListSessionsJWT(t *testing.T) {
+	app := newTestJWTApplication(t)
+	ts := newTestServer(t, app)
+	newTestUser(t, app, "alice@example.com", "videos:read")
+	first, _ := ts.login(t, "alice@example.com")
+	_, refresh := ts.login(t, "alice@example.com")
+	code, _, body := ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", nil, `{"token": "`+refresh+`"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("got status %d for the refresh; want %d: %s", code, http.StatusCreated, body)
+	}
+	refreshed, _ := readTokenPair(t, body)
+
+	tests := []struct {
+		name          string
+		token         string
+		wantRefreshed bool
+	}{
+		{"Refreshed login", refreshed, true},
+		{"First login", first, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.do(t, http.MethodGet, "/v1/users/me/sessions", tt.token, nil, "")
+			if code != http.StatusOK {
+				t.Fatalf("got status %d; want %d: %s", code, http.StatusOK, body)
+			}
+			var res struct {
+				Sessions []struct {
+					LastUsedAt *string `json:"last_used_at"`
+					Current    bool    `json:"current"`
+				} `json:"sessions"`
+			}
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Sessions) != 2 {
+				t.Fatalf("got %d sessions; want 2: %s", len(res.Sessions), body)
+			}
+			// Only the family the token came from is current, and only the family which
+			// was refreshed has been used.
+			for _, session := range res.Sessions {
+				if used := session.LastUsedAt != nil; used != (session.Current == tt.wantRefreshed) {
+					t.Errorf("got current %t and used %t: %s", session.Current, used, body)
+				}
+			}
+			if res.Sessions[0].Current == res.Sessions[1].Current {
+				t.Errorf("got both sessions current %t; want one", res.Sessions[0].Current)
+			}
+		})
+	}
+}
+
+func TestLogoutSessions(t *testing.T) {
+	tests := []struct {
+		name string
+		// logout is the path the current token is logged out with, if any.
+		logout          string
+		wantCurrentCode int
+		wantOtherCode   int
+		// wantSessions is the number of sessions listed afterwards, with the current
+		// token if it still works, or else with the other one.
+		wantSessions int
+	}{
+		{"Not logged out", "", http.StatusOK, http.StatusOK, 2},
+		{"Logged out", "/v1/tokens/authentication", http.StatusUnauthorized, http.StatusOK, 1},
+		{"Logged out everywhere", "/v1/tokens/authentication/all", http.StatusUnauthorized, http.StatusUnauthorized, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			user, current := newTestUser(t, app, "alice@example.com", "videos:read")
+			token, err := app.models.Tokens.New(context.Background(), user.ID, time.Hour, data.ScopeAuthentication)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other := token.Plaintext
+
+			if tt.logout != "" {
+				code, _, body := ts.do(t, http.MethodDelete, tt.logout, current, nil, "")
+				if code != http.StatusOK {
+					t.Fatalf("got status %d for the logout; want %d: %s", code, http.StatusOK, body)
+				}
+			}
+			code, _, body := ts.do(t, http.MethodGet, "/v1/users/me/sessions", current, nil, "")
+			if code != tt.wantCurrentCode {
+				t.Fatalf("got status %d for the current token; want %d: %s", code, tt.wantCurrentCode, body)
+			}
+			code, _, otherBody := ts.do(t, http.MethodGet, "/v1/users/me/sessions", other, nil, "")
+			if code != tt.wantOtherCode {
+				t.Fatalf("got status %d for the other token; want %d: %s", code, tt.wantOtherCode, otherBody)
+			}
+			if tt.wantCurrentCode != http.StatusOK {
+				body = otherBody
+			}
+			if tt.wantSessions == 0 {
+				return
+			}
+
+			var res struct {
+				Sessions []struct {
+					Current bool `json:"current"`
+				} `json:"sessions"`
+			}
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Sessions) != tt.wantSessions {
+				t.Fatalf("got %d sessions; want %d: %s", len(res.Sessions), tt.wantSessions, body)
+			}
+			// Only the token the sessions were listed with is marked as current.
+			currentCount := 0
+			for _, session := range res.Sessions {
+				if session.Current {
+					currentCount++
+				}
+			}
+			if currentCount != 1 {
+				t.Errorf("got %d current sessions; want 1: %s", currentCount, body)
+			}
+		})
+	}
+}
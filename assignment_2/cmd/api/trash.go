@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// The listTrashHandler() handles "GET /v1/videos/trash". It lists the videos which have
+// been deleted but not yet purged, most recently deleted first, and accepts the same
+// search and paging parameters as listVideosHandler() (except for cursor pagination).
+func (app *application) listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	videoFilter := app.readVideoFilter(qs, v)
+	videoFilter.Trashed = true
+	filters := data.Filters{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+		Sort:     app.readString(qs, "sort", "-deleted_at"),
+		SortSafelist: []string{
+			"id", "title", "year", "runtime", "deleted_at",
+			"-id", "-title", "-year", "-runtime", "-deleted_at",
+		},
+	}
+	data.ValidateVideoFilter(v, videoFilter)
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if err := app.resolveFilterGenres(r, &videoFilter); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	videos, metadata, err := app.models.Videos.GetAll(r.Context(), videoFilter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": videos, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The restoreVideoHandler() handles "POST /v1/videos/:id/restore", which takes a video
+// out of the trash. A 404 Not Found response is sent if the video isn't in the trash,
+// including when it has already been purged.
+func (app *application) restoreVideoHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	video, err := app.models.Videos.Restore(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/videos/%d", video.ID))
+	headers.Set("ETag", app.videoETag(video))
+	err = app.writeJSON(w, http.StatusOK, envelope{"video": video}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The startTrashPurger() method launches a background goroutine which permanently
+// deletes the videos that have been in the trash for longer than the configured
+// retention period, checking once every purge interval. The returned function stops the
+// purger; a purge which is already running is allowed to finish, and is covered by the
+// application's WaitGroup like any other background task.
+func (app *application) startTrashPurger() (stop func()) {
+	if app.config.trash.purgeInterval <= 0 {
+		app.logger.PrintInfo("trash purging disabled", nil)
+		return func() {}
+	}
+	done := make(chan struct{})
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		ticker := time.NewTicker(app.config.trash.purgeInterval)
+		defer ticker.Stop()
+		for {
+			app.purgeTrash()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// The purgeTrash() method runs a single purge. Errors (and panics) are logged rather than
+// returned, so that one failed purge doesn't stop the next one from running.
+func (app *application) purgeTrash() {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.PrintError(fmt.Errorf("%s", err), nil)
+		}
+	}()
+	cutoff := time.Now().Add(-app.config.trash.retention)
+	posters, purged, err := app.models.Videos.Purge(context.Background(), cutoff)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"task": "purge trash"})
+		return
+	}
+	for _, key := range posters {
+		app.deletePoster(key)
+	}
+	if purged > 0 {
+		app.logger.PrintInfo("purged videos from trash", map[string]string{
+			"count":  strconv.FormatInt(purged, 10),
+			"before": cutoff.UTC().Format(time.RFC3339),
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTrashRestore(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup does whatever happens to the video before it's restored.
+		setup        func(t *testing.T, app *application, ts *testServer, token, path string)
+		wantTrashed  bool
+		wantCode     int
+		wantShowCode int
+	}{
+		{
+			name:         "Not deleted",
+			setup:        func(t *testing.T, app *application, ts *testServer, token, path string) {},
+			wantCode:     http.StatusNotFound,
+			wantShowCode: http.StatusOK,
+		},
+		{
+			name: "Deleted",
+			setup: func(t *testing.T, app *application, ts *testServer, token, path string) {
+				deleteTestVideo(t, ts, token, path)
+			},
+			wantTrashed:  true,
+			wantCode:     http.StatusOK,
+			wantShowCode: http.StatusOK,
+		},
+		{
+			name: "Already restored",
+			setup: func(t *testing.T, app *application, ts *testServer, token, path string) {
+				deleteTestVideo(t, ts, token, path)
+				if code, _, body := ts.do(t, http.MethodPost, path+"/restore", token, nil, ""); code != http.StatusOK {
+					t.Fatalf("got status %d for the first restore; want %d: %s", code, http.StatusOK, body)
+				}
+			},
+			wantCode:     http.StatusNotFound,
+			wantShowCode: http.StatusOK,
+		},
+		{
+			name: "Within the retention period",
+			setup: func(t *testing.T, app *application, ts *testServer, token, path string) {
+				deleteTestVideo(t, ts, token, path)
+				app.config.trash.retention = time.Hour
+				app.purgeTrash()
+			},
+			wantTrashed:  true,
+			wantCode:     http.StatusOK,
+			wantShowCode: http.StatusOK,
+		},
+		{
+			name: "Purged",
+			setup: func(t *testing.T, app *application, ts *testServer, token, path string) {
+				deleteTestVideo(t, ts, token, path)
+				// Deletion times are truncated to the second, so a negative retention
+				// is needed to purge a video which has only just been deleted.
+				app.config.trash.retention = -time.Second
+				app.purgeTrash()
+			},
+			wantCode:     http.StatusNotFound,
+			wantShowCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			user, token := newTestUser(t, app, "alice@example.com", "videos:read", "videos:write")
+			video := newTestVideo(t, app, user.ID, "Original")
+			newTestVideo(t, app, user.ID, "Other")
+			path := fmt.Sprintf("/v1/videos/%d", video.ID)
+
+			tt.setup(t, app, ts, token, path)
+			code, _, body := ts.do(t, http.MethodGet, "/v1/videos/trash", token, nil, "")
+			if code != http.StatusOK {
+				t.Fatalf("got status %d for the trash; want %d: %s", code, http.StatusOK, body)
+			}
+			var res struct {
+				Videos []struct {
+					ID int64 `json:"id"`
+				} `json:"movies"`
+			}
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatal(err)
+			}
+			if trashed := len(res.Videos) == 1 && res.Videos[0].ID == video.ID; trashed != tt.wantTrashed || len(res.Videos) > 1 {
+				t.Errorf("got trash %s; want the video listed %t", body, tt.wantTrashed)
+			}
+
+			code, _, body = ts.do(t, http.MethodPost, path+"/restore", token, nil, "")
+			if code != tt.wantCode {
+				t.Errorf("got status %d for the restore; want %d: %s", code, tt.wantCode, body)
+			}
+			if code, _, body := ts.do(t, http.MethodGet, path, token, nil, ""); code != tt.wantShowCode {
+				t.Errorf("got status %d for the video; want %d: %s", code, tt.wantShowCode, body)
+			}
+		})
+	}
+}
+
+// deleteTestVideo moves the video at path to the trash.
+func deleteTestVideo(t *testing.T, ts *testServer, token, path string) {
+	t.Helper()
+	if code, _, body := ts.do(t, http.MethodDelete, path, token, nil, ""); code != http.StatusOK {
+		t.Fatalf("got status %d for the delete; want %d: %s", code, http.StatusOK, body)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/data"
+)
+
+func TestUpdateUserPassword(t *testing.T) {
+	tests := []struct {
+		name        string
+		password    string
+		token       func(resetToken string) string
+		wantCode    int
+		wantBody    string
+		wantChanged bool
+	}{
+		{
+			name:        "Valid",
+			password:    "n3wpa55word",
+			token:       func(resetToken string) string { return resetToken },
+			wantCode:    http.StatusOK,
+			wantChanged: true,
+		},
+		{
+			name:     "Unknown token",
+			password: "n3wpa55word",
+			token:    func(string) string { return strings.Repeat("A", 26) },
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "invalid or expired password reset token",
+		},
+		{
+			name:     "Short password",
+			password: "short",
+			token:    func(resetToken string) string { return resetToken },
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "must be at least 8 bytes long",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			user, authToken := newTestUser(t, app, "alice@example.com", "videos:read")
+			ctx := context.Background()
+			resetToken, err := app.models.Tokens.New(ctx, user.ID, time.Hour, data.ScopePasswordReset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := `{"password": "` + tt.password + `", "token": "` + tt.token(resetToken.Plaintext) + `"}`
+			code, _, resBody := ts.do(t, http.MethodPut, "/v1/users/password", "", nil, body)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", code, tt.wantCode, resBody)
+			}
+			if !strings.Contains(resBody, tt.wantBody) {
+				t.Errorf("got body %s; want it to contain %s", resBody, tt.wantBody)
+			}
+
+			stored, err := app.models.Users.Get(ctx, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed, err := stored.Password.Matches(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("got password changed %t; want %t", changed, tt.wantChanged)
+			}
+			// A successful reset logs out every session and uses up the reset token.
+			wantAuthCode := http.StatusOK
+			if tt.wantChanged {
+				wantAuthCode = http.StatusUnauthorized
+			}
+			if code, _, _ := ts.do(t, http.MethodGet, "/v1/videos", authToken, nil, ""); code != wantAuthCode {
+				t.Errorf("got status %d for the old session; want %d", code, wantAuthCode)
+			}
+			_, err = app.models.Users.GetForToken(ctx, data.ScopePasswordReset, resetToken.Plaintext)
+			if tt.wantChanged && err != data.ErrRecordNotFound {
+				t.Errorf("got error %v for the used reset token; want %v", err, data.ErrRecordNotFound)
+			}
+		})
+	}
+}
@@ -3,22 +3,29 @@ package main
 import (
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
 
 	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/jsonpatch"
 	"assignment_2.alexedwards.net/internal/validator"
 	// "time"
 )
 
-// Add a createVideoHandler for the "POST /v1/Videos" endpoint. For now we simply
-// return a plain-text placeholder response.
+// Add a createVideoHandler for the "POST /v1/videos" endpoint. The video is validated
+// before it is inserted, and a 422 response is sent if any checks fail.
 func (app *application) createVideoHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title       string       `json:"title"`
+		Description string       `json:"description"`
+		Language    string       `json:"language"`
+		Year        int32        `json:"year"`
+		Runtime     data.Runtime `json:"runtime"`
+		Genres      []string     `json:"genres"`
 	}
+	// The search language defaults to English when the client doesn't give one.
+	input.Language = data.DefaultLanguage
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
@@ -26,33 +33,45 @@ func (app *application) createVideoHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Copy the values from the input struct to a new video struct.
 	video := &data.Video{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:       input.Title,
+		Description: input.Description,
+		Language:    input.Language,
+		Year:        input.Year,
+		Runtime:     input.Runtime,
+		Genres:      input.Genres,
 	}
 	// Initialize a new Validator.
-	// v := validator.New()
-	// Call the Validatevideo() function and return a response containing the errors if
+	v := validator.New()
+	// Call the ValidateVideo() function and return a response containing the errors if
 	// any of the checks fail.
-	err = app.models.Videos.Insert(video)
-
-	// if data.ValidateVideo(v, video); !v.Valid() {
-	// 	app.failedValidationResponse(w, r, v.Errors)
-	// 	return
-	// }
-
+	if data.ValidateVideo(v, video); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Replace the genres with the slugs of their canonical genres, rejecting any which
+	// aren't in the taxonomy.
+	if err := app.resolveVideoGenres(r, v, video); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Videos.Insert(r.Context(), video, app.contextGetUser(r).ID)
+	if err != nil {
+		app.videoWriteErrorResponse(w, r, v, err)
+		return
+	}
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/videos/%d", video.ID))
+	headers.Set("ETag", app.videoETag(video))
 	// Write a JSON response with a 201 Created status code, the video data in the
 	// response body, and the Location header.
 	err = app.writeJSON(w, http.StatusCreated, envelope{"video": video}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-
-	fmt.Fprintf(w, "%+v\n", input)
-
 }
 
 // Add a showVideoHandler for the "GET /v1/Videos/:id" endpoint. For now, we retrieve
@@ -64,10 +83,21 @@ func (app *application) showVideoHandler(w http.ResponseWriter, r *http.Request)
 		app.notFoundResponse(w, r)
 		return
 	}
+	// The include parameter lists related data to embed in the video. For now the only
+	// option is "credits".
+	v := validator.New()
+	include := app.readCSV(r.URL.Query(), "include", []string{})
+	for _, value := range include {
+		v.Check(validator.In(value, "credits"), "include", "must only contain credits")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 	// Call the Get() method to fetch the data for a specific video. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
-	video, err := app.models.Videos.Get(id)
+	video, err := app.models.Videos.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -77,35 +107,96 @@ func (app *application) showVideoHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"video": video}, nil)
+	// A video's credits don't change its version, so a response which embeds them can't
+	// be identified by the video's entity tag and is sent without one.
+	if validator.In("credits", include...) {
+		video.Credits, err = app.models.Credits.GetForVideo(r.Context(), video.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusOK, envelope{"video": video}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Send the entity tag with every response. If the client already holds the current
+	// representation of the video, reply with 304 Not Modified and an empty body instead.
+	etag := app.videoETag(video)
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match != "" && app.etagMatches(match, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"video": video}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// videoSortSafelist holds the sort values accepted wherever videos are listed, by
+// listVideosHandler() and exportVideosHandler().
+var videoSortSafelist = []string{
+	"id", "title", "year", "runtime", "rating", "rating_count",
+	"-id", "-title", "-year", "-runtime", "-rating", "-rating_count",
+}
+
 func (app *application) listVideosHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		data.VideoFilter
 		data.Filters
 	}
 	v := validator.New()
 	qs := r.URL.Query()
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.VideoFilter = app.readVideoFilter(qs, v)
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	// Add the supported sort values for this endpoint to the sort safelist.
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	// A full-text search is sorted by relevance unless the client asks otherwise. Cursor
+	// pagination needs a stable column to page on, so it keeps the usual default.
+	defaultSort := "id"
+	if input.VideoFilter.Search != "" && !qs.Has("after") {
+		defaultSort = "relevance"
+	}
+	input.Filters.Sort = app.readString(qs, "sort", defaultSort)
+	// The presence of an "after" parameter switches the listing to cursor pagination.
+	// It's empty for the first page, and afterwards holds the next_cursor or
+	// prev_cursor value from the previous response's metadata.
+	input.Filters.CursorMode = qs.Has("after")
+	input.Filters.Cursor = qs.Get("after")
+	input.Filters.IncludeTotal = app.readBool(qs, "include_total", false, v)
+	// Add the supported sort values for this endpoint to the sort safelist. Only a
+	// search has a relevance to sort by.
+	input.Filters.SortSafelist = append([]string{"relevance"}, videoSortSafelist...)
 	// Execute the validation checks on the Filters struct and send a response
 	// containing the errors if necessary.
+	data.ValidateVideoFilter(v, input.VideoFilter)
+	if input.Filters.Sort == "relevance" {
+		v.Check(input.VideoFilter.Search != "", "sort", "relevance can only be used with a q search")
+		v.Check(!input.Filters.CursorMode, "sort", "relevance can't be used with cursor pagination")
+	}
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	movies, metadata, err := app.models.Videos.GetAll(input.Title, input.Genres, input.Filters)
+	if err := app.resolveFilterGenres(r, &input.VideoFilter); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	movies, metadata, err := app.models.Videos.GetAll(r.Context(), input.VideoFilter, input.Filters)
 	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			v.AddError("after", "must be a cursor returned by a previous request")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err := app.annotateWatchlist(r, movies); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
@@ -114,8 +205,70 @@ func (app *application) listVideosHandler(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
+}
+
+// The videoFacetsHandler() handles "GET /v1/videos/facets". It accepts the same search
+// parameters as listVideosHandler() and returns the number of matching videos broken
+// down by genre, decade and runtime bucket.
+func (app *application) videoFacetsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	videoFilter := app.readVideoFilter(r.URL.Query(), v)
+	if data.ValidateVideoFilter(v, videoFilter); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if err := app.resolveFilterGenres(r, &videoFilter); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	facets, err := app.models.Videos.GetFacets(r.Context(), videoFilter)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"facets": facets}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readVideoFilter() helper reads the search parameters for the video listing from
+// the query string. Any parse errors are recorded in the validator; the values
+// themselves are checked afterwards with data.ValidateVideoFilter().
+func (app *application) readVideoFilter(qs url.Values, v *validator.Validator) data.VideoFilter {
+	return data.VideoFilter{
+		Title:         app.readString(qs, "title", ""),
+		Search:        app.readString(qs, "q", ""),
+		Genres:        app.readCSV(qs, "genres", []string{}),
+		GenresMode:    app.readString(qs, "genres_mode", data.GenresModeAll),
+		YearMin:       int32(app.readInt(qs, "year_min", 0, v)),
+		YearMax:       int32(app.readInt(qs, "year_max", 0, v)),
+		RuntimeMin:    data.Runtime(app.readInt(qs, "runtime_min", 0, v)),
+		RuntimeMax:    data.Runtime(app.readInt(qs, "runtime_max", 0, v)),
+		CreatedAfter:  app.readTime(qs, "created_after", v),
+		CreatedBefore: app.readTime(qs, "created_before", v),
+		ExcludeIDs:    app.readIDList(qs, "exclude_ids", v),
+		PersonID:      int64(app.readInt(qs, "person_id", 0, v)),
+		PersonRole:    app.readString(qs, "person_role", ""),
+	}
+}
 
-	fmt.Fprintf(w, "%+v\n", input)
+// The resolveFilterGenres() helper resolves the genres in a filter in the same way as
+// resolveVideoGenres(), so that a search can name genres by their aliases. Genres
+// which aren't in the taxonomy are kept in slug form, where they simply match nothing.
+func (app *application) resolveFilterGenres(r *http.Request, videoFilter *data.VideoFilter) error {
+	if len(videoFilter.Genres) == 0 {
+		return nil
+	}
+	genres, unknown, err := app.models.Genres.Resolve(r.Context(), videoFilter.Genres)
+	if err != nil {
+		return err
+	}
+	for _, genre := range unknown {
+		genres = append(genres, data.GenreSlug(genre))
+	}
+	videoFilter.Genres = genres
+	return nil
 }
 
 func (app *application) updateVideoHandler(w http.ResponseWriter, r *http.Request) {
@@ -127,29 +280,96 @@ func (app *application) updateVideoHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Fetch the existing video record from the database, sending a 404 Not Found
 	// response to the client if we couldn't find a matching record.
-	video, err := app.models.Videos.Get(id)
+	video, err := app.models.Videos.Get(r.Context(), id)
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
+	// If the client sent an If-Match header, only go ahead when it matches the version
+	// we just fetched. Otherwise they would be overwriting changes they haven't seen.
+	if match := r.Header.Get("If-Match"); match != "" && !app.videoVersionMatches(match, video) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
 
+	// The Content-Type header selects how the request body describes the changes. A
+	// plain JSON body (which is also assumed when there's no Content-Type) sets the
+	// fields it contains, while the two patch formats are applied to the video's JSON
+	// representation.
+	v := validator.New()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "", "application/json":
+		err = app.readVideoFields(w, r, video)
+	case mergePatchType, jsonPatchType:
+		err = app.readVideoPatch(w, r, mediaType, video, v)
+	default:
+		app.unsupportedMediaTypeResponse(w, r, "application/json", mergePatchType, jsonPatchType)
+		return
+	}
+	if err != nil {
+		switch {
+		// A failed "test" operation means the video isn't in the state the client
+		// expected, which is a conflict rather than a problem with the request.
+		case errors.Is(err, jsonpatch.ErrTestFailed):
+			app.editConflictResponse(w, r)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+	// Validate the updated video record, sending the client a 422 Unprocessable Entity
+	// response if any checks fail.
+	if data.ValidateVideo(v, video); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if err := app.resolveVideoGenres(r, v, video); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Update() still checks the version in the WHERE clause, so if another request
+	// changed the video after the If-Match check we get an ErrEditConflict here and send
+	// a 409 Conflict response.
+	err = app.models.Videos.Update(r.Context(), video, app.contextGetUser(r).ID)
+	if err != nil {
+		app.videoWriteErrorResponse(w, r, v, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", app.videoETag(video))
+	err = app.writeJSON(w, http.StatusOK, envelope{"video": video}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readVideoFields() helper reads a plain JSON update from the request body. Each
+// field which is present in the body is copied onto the video, and the rest are left
+// unchanged.
+func (app *application) readVideoFields(w http.ResponseWriter, r *http.Request, video *data.Video) error {
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+		Title       *string       `json:"title"`
+		Description *string       `json:"description"`
+		Language    *string       `json:"language"`
+		Year        *int32        `json:"year"`
+		Runtime     *data.Runtime `json:"runtime"`
+		Genres      []string      `json:"genres"`
 	}
 	// Decode the JSON as normal.
-	err = app.readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
-		app.badRequestResponse(w, r, err)
-		return
+		return err
 	}
 	// If the input.Title value is nil then we know that no corresponding "title" key/
 	// value pair was provided in the JSON request body. So we move on and leave the
@@ -161,6 +381,12 @@ func (app *application) updateVideoHandler(w http.ResponseWriter, r *http.Reques
 		video.Title = *input.Title
 	}
 	// We also do the same for the other fields in the input struct.
+	if input.Description != nil {
+		video.Description = *input.Description
+	}
+	if input.Language != nil {
+		video.Language = *input.Language
+	}
 	if input.Year != nil {
 		video.Year = *input.Year
 	}
@@ -170,20 +396,7 @@ func (app *application) updateVideoHandler(w http.ResponseWriter, r *http.Reques
 	if input.Genres != nil {
 		video.Genres = input.Genres // Note that we don't need to dereference a slice.
 	}
-	// v := validator.New()
-	// if data.ValidateVideo(v, video); !v.Valid() {
-	// 	app.failedValidationResponse(w, r, v.Errors)
-	// 	return
-	// }
-	err = app.models.Videos.Update(video)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"video": video}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
+	return nil
 }
 
 func (app *application) deleteVideoHandler(w http.ResponseWriter, r *http.Request) {
@@ -193,21 +406,82 @@ func (app *application) deleteVideoHandler(w http.ResponseWriter, r *http.Reques
 		app.notFoundResponse(w, r)
 		return
 	}
-	// Delete the video from the database, sending a 404 Not Found response to the
-	// client if there isn't a matching record.
-	err = app.models.Videos.Delete(id)
+	// When the client sends an If-Match header, fetch the current record first and
+	// refuse to delete it if it has changed since the client last saw it. The version we
+	// checked is passed on to Delete(), so that a change made after the check is caught
+	// there as an edit conflict instead of being deleted over.
+	var version int32
+	if match := r.Header.Get("If-Match"); match != "" {
+		video, err := app.models.Videos.Get(r.Context(), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if !app.videoVersionMatches(match, video) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+		version = video.Version
+	}
+	// Move the video to the trash, recording who deleted it, and send a 404 Not Found
+	// response to the client if there isn't a matching record.
+	user := app.contextGetUser(r)
+	err = app.models.Videos.Delete(r.Context(), id, version, user.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 	// Return a 200 OK status code along with a success message.
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "video successfully deleted"}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "video moved to trash"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The resolveVideoGenres() helper replaces a video's genres with the slugs of the
+// canonical genres they name, so that "Sci-Fi" and "science fiction" can both be used
+// for the genre "sci-fi" if it has those aliases. Any genres which aren't in the taxonomy
+// are recorded in the validator. It should only be called once ValidateVideo() passes.
+func (app *application) resolveVideoGenres(r *http.Request, v *validator.Validator, video *data.Video) error {
+	genres, unknown, err := app.models.Genres.Resolve(r.Context(), video.Genres)
 	if err != nil {
+		return err
+	}
+	for _, genre := range unknown {
+		v.AddError("genres", fmt.Sprintf("contains unknown genre %q", genre))
+	}
+	if len(unknown) > 0 {
+		return nil
+	}
+	video.Genres = genres
+	return nil
+}
+
+// The videoWriteErrorResponse() method handles the errors returned by VideoModel.Insert()
+// and VideoModel.Update(). Constraint violations are reported under the same field keys
+// as ValidateVideo(), so the client sees a single 422 format regardless of whether the
+// check happened in Go or in the database.
+func (app *application) videoWriteErrorResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator, err error) {
+	var constraintErr *data.ConstraintError
+	switch {
+	case errors.As(err, &constraintErr):
+		v.AddError(constraintErr.Field, constraintErr.Message)
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrEditConflict):
+		app.editConflictResponse(w, r)
+	default:
 		app.serverErrorResponse(w, r, err)
 	}
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"assignment_2.alexedwards.net/internal/data"
+)
+
+func TestShowVideoConditional(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	user, token := newTestUser(t, app, "alice@example.com", "videos:read")
+	video := newTestVideo(t, app, user.ID, "Original")
+	etag := app.videoETag(video)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantCode    int
+	}{
+		{"No header", "", http.StatusOK},
+		{"Current version", etag, http.StatusNotModified},
+		{"Weak current version", "W/" + etag, http.StatusNotModified},
+		{"One of several", `"other", ` + etag, http.StatusNotModified},
+		{"Wildcard", "*", http.StatusNotModified},
+		{"Old version", fmt.Sprintf(`"%d-%d-0"`, video.ID, video.Version-1), http.StatusOK},
+		{"ID and version only", fmt.Sprintf(`"%d-%d"`, video.ID, video.Version), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.ifNoneMatch != "" {
+				header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			code, resHeader, body := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/videos/%d", video.ID), token, header, "")
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", code, tt.wantCode, body)
+			}
+			if got := resHeader.Get("ETag"); got != etag {
+				t.Errorf("got ETag %s; want %s", got, etag)
+			}
+			if code == http.StatusNotModified && body != "" {
+				t.Errorf("got body %q for a 304 response; want none", body)
+			}
+		})
+	}
+}
+
+// The rating summary and poster don't change a video's version, but they're part of its
+// representation, so a change to either must stop a client's old copy being Not Modified.
+// Writes only check the version, so the old entity tag can still be used for If-Match.
+func TestVideoETagReadOnlyMembers(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, app *application, video *data.Video, userID int64)
+	}{
+		{
+			name: "Rating",
+			change: func(t *testing.T, app *application, video *data.Video, userID int64) {
+				_, err := app.models.Ratings.Insert(context.Background(), &data.Rating{VideoID: video.ID, UserID: userID, Score: 8})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "Poster",
+			change: func(t *testing.T, app *application, video *data.Video, userID int64) {
+				_, err := app.models.Videos.SetPoster(context.Background(), video.ID, fmt.Sprintf("posters/%d/original.png", video.ID))
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			user, token := newTestUser(t, app, "alice@example.com", "videos:read", "videos:write")
+			video := newTestVideo(t, app, user.ID, "Original")
+			path := fmt.Sprintf("/v1/videos/%d", video.ID)
+			_, header, _ := ts.do(t, http.MethodGet, path, token, nil, "")
+			etag := header.Get("ETag")
+
+			tt.change(t, app, video, user.ID)
+			code, header, body := ts.do(t, http.MethodGet, path, token, http.Header{"If-None-Match": {etag}}, "")
+			if code != http.StatusOK {
+				t.Fatalf("got status %d for the old entity tag; want %d: %s", code, http.StatusOK, body)
+			}
+			if header.Get("ETag") == etag {
+				t.Errorf("got the same entity tag %s after the change", etag)
+			}
+			header = http.Header{"Content-Type": {"application/json"}, "If-Match": {etag}}
+			code, _, body = ts.do(t, http.MethodPatch, path, token, header, `{"title": "Patched"}`)
+			if code != http.StatusOK {
+				t.Errorf("got status %d for If-Match with the old entity tag; want %d: %s", code, http.StatusOK, body)
+			}
+		})
+	}
+}
+
+func TestVideoIfMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		// ifMatch returns the If-Match header to send for a video at version 1.
+		ifMatch     func(video *data.Video) string
+		wantCode    int
+		wantVersion int32
+		wantDeleted bool
+	}{
+		{
+			name:        "Update current version",
+			method:      http.MethodPatch,
+			ifMatch:     func(video *data.Video) string { return fmt.Sprintf(`"%d-1-0"`, video.ID) },
+			wantCode:    http.StatusOK,
+			wantVersion: 2,
+		},
+		{
+			name:        "Update old version",
+			method:      http.MethodPatch,
+			ifMatch:     func(video *data.Video) string { return fmt.Sprintf(`"%d-0-0"`, video.ID) },
+			wantCode:    http.StatusPreconditionFailed,
+			wantVersion: 1,
+		},
+		{
+			name:        "Update weak tag",
+			method:      http.MethodPatch,
+			ifMatch:     func(video *data.Video) string { return fmt.Sprintf(`W/"%d-1-0"`, video.ID) },
+			wantCode:    http.StatusPreconditionFailed,
+			wantVersion: 1,
+		},
+		{
+			name:        "Delete current version",
+			method:      http.MethodDelete,
+			ifMatch:     func(video *data.Video) string { return fmt.Sprintf(`"%d-1-0"`, video.ID) },
+			wantCode:    http.StatusOK,
+			wantDeleted: true,
+		},
+		{
+			name:        "Delete old version",
+			method:      http.MethodDelete,
+			ifMatch:     func(video *data.Video) string { return fmt.Sprintf(`"%d-0-0"`, video.ID) },
+			wantCode:    http.StatusPreconditionFailed,
+			wantVersion: 1,
+		},
+		{
+			name:        "Delete without If-Match",
+			method:      http.MethodDelete,
+			ifMatch:     func(video *data.Video) string { return "" },
+			wantCode:    http.StatusOK,
+			wantDeleted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			ts := newTestServer(t, app)
+			user, token := newTestUser(t, app, "alice@example.com", "videos:read", "videos:write")
+			video := newTestVideo(t, app, user.ID, "Original")
+
+			header := http.Header{"Content-Type": {"application/json"}}
+			if match := tt.ifMatch(video); match != "" {
+				header.Set("If-Match", match)
+			}
+			path := fmt.Sprintf("/v1/videos/%d", video.ID)
+			code, _, body := ts.do(t, tt.method, path, token, header, `{"title": "Patched"}`)
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", code, tt.wantCode, body)
+			}
+
+			stored, err := app.models.Videos.Get(context.Background(), video.ID)
+			if tt.wantDeleted {
+				if err != data.ErrRecordNotFound {
+					t.Errorf("got error %v for the deleted video; want %v", err, data.ErrRecordNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Version != tt.wantVersion {
+				t.Errorf("got version %d; want %d", stored.Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestListVideosSort(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	user, token := newTestUser(t, app, "alice@example.com", "videos:read")
+	for _, title := range []string{"Bravo", "Alpha", "Charlie"} {
+		newTestVideo(t, app, user.ID, title)
+	}
+
+	tests := []struct {
+		sort     string
+		wantCode int
+		want     []string
+	}{
+		{"", http.StatusOK, []string{"Bravo", "Alpha", "Charlie"}},
+		{"title", http.StatusOK, []string{"Alpha", "Bravo", "Charlie"}},
+		{"-title", http.StatusOK, []string{"Charlie", "Bravo", "Alpha"}},
+		{"-id", http.StatusOK, []string{"Charlie", "Alpha", "Bravo"}},
+		{"director", http.StatusUnprocessableEntity, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			code, _, body := ts.do(t, http.MethodGet, "/v1/videos?sort="+tt.sort, token, nil, "")
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", code, tt.wantCode, body)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var res struct {
+				Videos []struct {
+					Title string `json:"title"`
+				} `json:"movies"`
+			}
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, video := range res.Videos {
+				got = append(got, video.Title)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportVideos(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app)
+	user, token := newTestUser(t, app, "alice@example.com", "videos:read")
+	rated := newTestVideo(t, app, user.ID, "Bravo")
+	newTestVideo(t, app, user.ID, "Alpha")
+	ctx := context.Background()
+	if _, err := app.models.Ratings.Insert(ctx, &data.Rating{VideoID: rated.ID, UserID: user.ID, Score: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.models.Videos.SetPoster(ctx, rated.ID, fmt.Sprintf("posters/%d/original.png", rated.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCode  int
+		wantType  string
+		wantFirst string
+	}{
+		{"NDJSON", "format=ndjson", http.StatusOK, "application/x-ndjson", "Bravo"},
+		{"NDJSON sorted", "format=ndjson&sort=title", http.StatusOK, "application/x-ndjson", "Alpha"},
+		{"CSV", "format=csv&sort=-title", http.StatusOK, "text/csv", "Bravo"},
+		{"Relevance sort", "sort=relevance", http.StatusUnprocessableEntity, "application/json", ""},
+		{"Unknown format", "format=xml", http.StatusUnprocessableEntity, "application/json", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, header, body := ts.do(t, http.MethodGet, "/v1/videos/export?"+tt.query, token, nil, "")
+			if code != tt.wantCode {
+				t.Fatalf("got status %d; want %d: %s", code, tt.wantCode, body)
+			}
+			if got := header.Get("Content-Type"); got != tt.wantType {
+				t.Errorf("got Content-Type %q; want %q", got, tt.wantType)
+			}
+			if code != http.StatusOK {
+				return
+			}
+
+			if tt.wantType == "text/csv" {
+				lines := strings.Split(strings.TrimSpace(body), "\n")
+				// The first line holds the column names.
+				if len(lines) != 3 || !strings.Contains(lines[1], tt.wantFirst) {
+					t.Errorf("got %q; want a header and 2 rows starting with %s", body, tt.wantFirst)
+				}
+				return
+			}
+			type exportedVideo struct {
+				Title  string             `json:"title"`
+				Rating data.RatingSummary `json:"rating"`
+				Poster map[string]string  `json:"poster"`
+			}
+			var videos []exportedVideo
+			sc := bufio.NewScanner(strings.NewReader(body))
+			for sc.Scan() {
+				var video exportedVideo
+				if err := json.Unmarshal(sc.Bytes(), &video); err != nil {
+					t.Fatal(err)
+				}
+				videos = append(videos, video)
+			}
+			if len(videos) != 2 || videos[0].Title != tt.wantFirst {
+				t.Fatalf("got %+v; want 2 videos starting with %s", videos, tt.wantFirst)
+			}
+			// Exports carry the same read-only members as the other endpoints.
+			for _, video := range videos {
+				if video.Title != "Bravo" {
+					continue
+				}
+				if video.Rating.Count != 1 || video.Poster["original"] == "" {
+					t.Errorf("got rating %+v and poster %v; want the rating and the poster's URLs", video.Rating, video.Poster)
+				}
+			}
+		})
+	}
+}
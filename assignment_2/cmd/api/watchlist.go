@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"assignment_2.alexedwards.net/internal/data"
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// The listWatchlistsHandler() handles "GET /v1/users/me/watchlists", which summarises
+// each of the current user's lists.
+func (app *application) listWatchlistsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	lists, err := app.models.Watchlists.GetLists(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"watchlists": lists}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showWatchlistHandler() handles "GET /v1/users/me/watchlist". It returns the videos
+// on one of the current user's lists in order. The list parameter names the list, and
+// defaults to the "watchlist" list.
+func (app *application) showWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	list := app.readString(r.URL.Query(), "list", data.DefaultWatchlist)
+	if data.ValidateWatchlistName(v, list); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	items, err := app.models.Watchlists.GetItems(r.Context(), user.ID, list)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"list": list, "items": items}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The addWatchlistItemHandler() handles "POST /v1/users/me/watchlist". The video is added
+// to the named list (creating it if necessary) at the given position, or at the end of
+// the list if no position is given.
+func (app *application) addWatchlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		VideoID  int64  `json:"video_id"`
+		List     string `json:"list"`
+		Position int32  `json:"position"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	item := &data.WatchlistItem{
+		List:     input.List,
+		VideoID:  input.VideoID,
+		Position: input.Position,
+	}
+	if item.List == "" {
+		item.List = data.DefaultWatchlist
+	}
+	v := validator.New()
+	if data.ValidateWatchlistItem(v, item); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.Watchlists.Add(r.Context(), user.ID, item)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("video_id", "must refer to an existing video")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateWatchlistItem):
+			app.errorResponse(w, r, http.StatusConflict, "the video is already on this list")
+		case errors.Is(err, data.ErrWatchlistFull):
+			v.AddError("list", "must not contain more than 1000 videos")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"item": item}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateWatchlistItemHandler() handles "PATCH /v1/users/me/watchlist/:id", where :id
+// is the video ID. It marks the video as watched or unwatched, and can move it to a new
+// position on the list named by the list parameter.
+func (app *application) updateWatchlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	item, ok := app.readWatchlistItem(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Watched  *bool  `json:"watched"`
+		Position *int32 `json:"position"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Watched != nil {
+		item.Watched = *input.Watched
+	}
+	if input.Position != nil {
+		item.Position = *input.Position
+	}
+	v := validator.New()
+	if data.ValidateWatchlistItem(v, item); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.Watchlists.Update(r.Context(), user.ID, item)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	item.Watched = item.WatchedAt != nil
+	err = app.writeJSON(w, http.StatusOK, envelope{"item": item}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The removeWatchlistItemHandler() handles "DELETE /v1/users/me/watchlist/:id", which
+// takes the video off the list named by the list parameter.
+func (app *application) removeWatchlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	v := validator.New()
+	list := app.readString(r.URL.Query(), "list", data.DefaultWatchlist)
+	if data.ValidateWatchlistName(v, list); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.Watchlists.Remove(r.Context(), user.ID, list, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "video successfully removed from the list"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readWatchlistItem() helper fetches the current user's item for the video named by
+// the ":id" URL parameter, on the list named by the list query string parameter. If it
+// can't, it sends the error response itself and returns false.
+func (app *application) readWatchlistItem(w http.ResponseWriter, r *http.Request) (*data.WatchlistItem, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	v := validator.New()
+	list := app.readString(r.URL.Query(), "list", data.DefaultWatchlist)
+	if data.ValidateWatchlistName(v, list); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+	user := app.contextGetUser(r)
+	item, err := app.models.Watchlists.Get(r.Context(), user.ID, list, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return item, true
+}
+
+// The annotateWatchlist() helper sets InWatchlist on each of the videos, according to
+// whether it's on one of the current user's lists.
+func (app *application) annotateWatchlist(r *http.Request, videos []*data.Video) error {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() || len(videos) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(videos))
+	for i, video := range videos {
+		ids[i] = video.ID
+	}
+	in, err := app.models.Watchlists.InWatchlist(r.Context(), user.ID, ids)
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		inWatchlist := in[video.ID]
+		video.InWatchlist = &inWatchlist
+	}
+	return nil
+}
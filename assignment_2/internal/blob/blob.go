@@ -0,0 +1,50 @@
+// Package blob stores uploaded files, such as video posters, behind the Store interface
+// so that the API doesn't depend on where they're kept. DiskStore keeps them on the
+// local filesystem.
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned by Get when there is no blob with the given key.
+	ErrNotFound = errors.New("blob not found")
+	// ErrInvalidKey is returned for a key which isn't a clean, relative, slash-separated
+	// path.
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// A Store holds blobs identified by keys like "posters/12/original.png". Keys are
+// slash-separated paths, and a blob's content type is implied by its extension.
+type Store interface {
+	// Put saves the contents of r under key, replacing any existing blob. A reader of
+	// the key never sees a partly written blob.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the blob saved under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob saved under key. Deleting a key which doesn't exist isn't
+	// an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// ValidKey reports whether key can be used with a Store: it must be a clean, relative
+// path which doesn't climb out of the store with "..".
+func ValidKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return false
+	}
+	if path.Clean(key) != key {
+		return false
+	}
+	for _, element := range strings.Split(key, "/") {
+		if element == ".." || element == "." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// The actions which can appear in a batch passed to ExecBatch().
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// ErrBatchAborted is the outcome of every operation in an atomic batch other than the
+// one which failed: those operations were either rolled back or never run.
+var ErrBatchAborted = errors.New("batch aborted")
+
+// errBatchFailed tells withTx() to roll back an atomic batch. The real errors have
+// already been recorded against the operations.
+var errBatchFailed = errors.New("batch failed")
+
+// A VideoOperation is one step of a batch. For BatchCreate and BatchUpdate, Video holds
+// the video to save; for an update this includes the version it was read at, which is
+// checked as usual. For BatchDelete only Video.ID and Video.Version are used, and a zero
+// version deletes whatever version is stored. ExecBatch() sets Err to the outcome of the
+// operation, leaving it nil on success.
+type VideoOperation struct {
+	Action string
+	Video  *Video
+	Err    error
+}
+
+// ExecBatch runs the operations in order, with every change attributed to the user.
+// When atomic is true they share a single transaction, which is only committed if every
+// operation succeeds; if one fails, the rest are marked with ErrBatchAborted. Otherwise
+// each operation runs in its own transaction and succeeds or fails on its own. The
+// returned error is only for a failure of the batch as a whole, such as being unable to
+// commit.
+func (m VideoModel) ExecBatch(ctx context.Context, ops []*VideoOperation, atomic bool, userID int64) error {
+	// The QueryTimeout applies to each operation rather than to the whole batch, which
+	// can legitimately take much longer than a single write.
+	run := func(tx *sql.Tx, op *VideoOperation) error {
+		ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+		defer cancel()
+		switch op.Action {
+		case BatchCreate:
+			return insertVideo(ctx, tx, op.Video, userID)
+		case BatchUpdate:
+			return updateVideo(ctx, tx, op.Video, userID)
+		case BatchDelete:
+			return deleteVideo(ctx, tx, op.Video.ID, op.Video.Version, userID)
+		default:
+			panic("unknown batch action: " + op.Action)
+		}
+	}
+	if !atomic {
+		for _, op := range ops {
+			op.Err = m.withTx(ctx, func(tx *sql.Tx) error {
+				return run(tx, op)
+			})
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := m.withTx(ctx, func(tx *sql.Tx) error {
+		// A delete locks the movies table, so lock the genres table before any of the
+		// operations run, in the order that checkVideoGenres() needs.
+		if _, err := tx.ExecContext(ctx, `LOCK TABLE genres IN SHARE MODE`); err != nil {
+			return err
+		}
+		for i, op := range ops {
+			if err := run(tx, op); err != nil {
+				abortBatch(ops, i, err)
+				return errBatchFailed
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBatchFailed) {
+		return err
+	}
+	return nil
+}
+
+// abortBatch records err against the operation at index failed, and ErrBatchAborted
+// against all of the others.
+func abortBatch(ops []*VideoOperation, failed int, err error) {
+	for i, op := range ops {
+		op.Err = ErrBatchAborted
+		if i == failed {
+			op.Err = err
+		}
+	}
+}
@@ -1,26 +1,129 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"strings"
+	"time"
 
 	"assignment_2.alexedwards.net/internal/validator" // New import
+	"github.com/lib/pq"
 )
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 // Add a SortSafelist field to hold the supported sort values.
+//
+// When CursorMode is true the listing is paged by keyset instead of by page number:
+// Cursor holds the opaque value from a previous response's next_cursor or prev_cursor
+// (or is empty for the first page), Page is ignored, and the total record count is only
+// calculated if IncludeTotal is set.
 type Filters struct {
 	Page         int
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	CursorMode   bool
+	Cursor       string
+	IncludeTotal bool
+}
+
+// ErrInvalidCursor is returned by the GetAll() methods when a cursor decodes but holds a
+// value that doesn't make sense for the sort column (which only happens if the client
+// has tampered with it).
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// A cursor records the position of a row in a sorted listing: the value of the sort
+// column and the ID (which breaks ties), plus the sort it was created for. Backward
+// cursors fetch the rows *before* the position rather than after it, and are used for
+// prev_cursor. Cursors are handed to clients as base64-encoded JSON, which they should
+// treat as opaque.
+type cursor struct {
+	Sort     string `json:"s"`
+	Value    string `json:"v"`
+	ID       int64  `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+func encodeCursor(c cursor) string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		// Marshalling a struct of strings, ints and bools can't fail.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(js, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// cursor returns the decoded position to continue from. The ok result is false for the
+// first page, when there is no cursor yet. ValidateFilters() has already checked that
+// the cursor decodes, so a failure here is a programming error.
+func (f Filters) cursor() (c cursor, ok bool) {
+	if f.Cursor == "" {
+		return cursor{}, false
+	}
+	c, err := decodeCursor(f.Cursor)
+	if err != nil {
+		panic("unvalidated cursor: " + f.Cursor)
+	}
+	return c, true
+}
+
+// calculateCursorMetadata works out the next and prev cursors for a page of results
+// fetched by keyset. The first and last arguments are the sort values and IDs of the
+// first and last rows on the page, and hasMore reports whether another row existed
+// beyond the page in the direction we were paging. totalRecords is -1 when the count
+// was skipped.
+func calculateCursorMetadata(f Filters, first, last cursor, empty, hasMore bool, totalRecords int) Metadata {
+	metadata := Metadata{PageSize: f.PageSize}
+	if totalRecords > 0 {
+		metadata.TotalRecords = totalRecords
+	}
+	if empty {
+		return metadata
+	}
+	current, paged := f.cursor()
+	first.Sort, last.Sort = f.Sort, f.Sort
+	first.Backward = true
+	switch {
+	case paged && current.Backward:
+		// Paging backwards: there is always a next page (the one we came from), and
+		// there is a previous page if we found more rows before this one.
+		metadata.NextCursor = encodeCursor(last)
+		if hasMore {
+			metadata.PrevCursor = encodeCursor(first)
+		}
+	default:
+		if hasMore {
+			metadata.NextCursor = encodeCursor(last)
+		}
+		if paged {
+			metadata.PrevCursor = encodeCursor(first)
+		}
+	}
+	return metadata
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -63,11 +166,161 @@ func (f Filters) sortDirection() string {
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
-	// Check that the page and page_size parameters contain sensible values.
-	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	// Check that the page and page_size parameters contain sensible values. The page
+	// number isn't used when paging by cursor, so we don't check it in that case.
+	if !f.CursorMode {
+		v.Check(f.Page > 0, "page", "must be greater than zero")
+		v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	}
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	// A cursor is only meaningful for the sort order it was created with, so reject
+	// cursors which don't decode or which belong to a different sort.
+	if f.CursorMode && f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		v.Check(err == nil, "after", "must be a cursor returned by a previous request")
+		v.Check(err != nil || c.Sort == f.Sort, "after", "cursor does not match the sort parameter")
+	}
+}
+
+// The genre match modes supported by VideoFilter.GenresMode.
+const (
+	GenresModeAll  = "all"  // the video has every listed genre
+	GenresModeAny  = "any"  // the video has at least one of the listed genres
+	GenresModeNone = "none" // the video has none of the listed genres
+)
+
+// VideoFilter holds the search criteria for listing videos. Zero values mean "no
+// restriction", so the zero VideoFilter matches every live video. Videos in the trash
+// are only matched when Trashed is set, and then only those are.
+type VideoFilter struct {
+	Title         string
+	Genres        []string
+	GenresMode    string
+	YearMin       int32
+	YearMax       int32
+	RuntimeMin    Runtime
+	RuntimeMax    Runtime
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	ExcludeIDs    []int64
+	Trashed       bool
+	// Search is a full-text query over the title and description, in the syntax of
+	// websearch_to_tsquery(). Unlike Title, it is parsed with each video's own search
+	// language, and the matches can be ranked by relevance.
+	Search string
+	// PersonID restricts the videos to those crediting a person, in PersonRole if it's
+	// set or in any role otherwise.
+	PersonID   int64
+	PersonRole string
+}
+
+func ValidateVideoFilter(v *validator.Validator, f VideoFilter) {
+	v.Check(validator.In(f.GenresMode, GenresModeAll, GenresModeAny, GenresModeNone), "genres_mode", "must be one of all, any or none")
+
+	maxYear := int32(time.Now().Year())
+	if f.YearMin != 0 {
+		v.Check(f.YearMin >= 1888 && f.YearMin <= maxYear, "year_min", fmt.Sprintf("must be between 1888 and %d", maxYear))
+	}
+	if f.YearMax != 0 {
+		v.Check(f.YearMax >= 1888 && f.YearMax <= maxYear, "year_max", fmt.Sprintf("must be between 1888 and %d", maxYear))
+	}
+	if f.YearMin != 0 && f.YearMax != 0 {
+		v.Check(f.YearMin <= f.YearMax, "year_max", "must not be less than year_min")
+	}
+
+	v.Check(f.RuntimeMin >= 0, "runtime_min", "must not be negative")
+	v.Check(f.RuntimeMax >= 0, "runtime_max", "must not be negative")
+	if f.RuntimeMin != 0 && f.RuntimeMax != 0 {
+		v.Check(f.RuntimeMin <= f.RuntimeMax, "runtime_max", "must not be less than runtime_min")
+	}
+
+	if !f.CreatedAfter.IsZero() && !f.CreatedBefore.IsZero() {
+		v.Check(f.CreatedAfter.Before(f.CreatedBefore), "created_before", "must be later than created_after")
+	}
+
+	v.Check(len(f.Search) <= 500, "q", "must not be more than 500 bytes long")
+
+	v.Check(len(f.ExcludeIDs) <= 100, "exclude_ids", "must not contain more than 100 ids")
+	for _, id := range f.ExcludeIDs {
+		v.Check(id > 0, "exclude_ids", "must only contain positive ids")
+	}
+
+	v.Check(f.PersonID >= 0, "person_id", "must be a positive integer")
+	if f.PersonRole != "" {
+		v.Check(f.PersonID != 0, "person_role", "must only be used with person_id")
+		v.Check(validator.In(f.PersonRole, CreditRoles...), "person_role", "must be one of director, writer, producer, composer, cast or crew")
+	}
+}
+
+// sqlConditions returns the SQL conditions for the filter, joined with AND, together
+// with the arguments for their placeholders. The placeholders are numbered from
+// len(args)+1, so callers can add the returned arguments straight onto their own. Only
+// placeholders are interpolated into the SQL, never values, so this is safe to build
+// into a query with fmt.Sprintf().
+func (f VideoFilter) sqlConditions(args []interface{}) (string, []interface{}) {
+	conditions := []string{"deleted_at IS NULL"}
+	if f.Trashed {
+		conditions[0] = "deleted_at IS NOT NULL"
+	}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if f.Title != "" {
+		add("to_tsvector('simple', title) @@ plainto_tsquery('simple', $%d)", f.Title)
+	}
+	if f.Search != "" {
+		// A query has to be parsed with the same configuration as the search_vector it's
+		// matched against, so there's one branch per language. Because each branch uses a
+		// fixed configuration, PostgreSQL can still use the GIN index on search_vector.
+		// The language names come from our own safelist, so they're safe to interpolate.
+		var branches []string
+		for _, language := range SearchLanguages {
+			branches = append(branches, fmt.Sprintf("(language = '%[1]s' AND search_vector @@ websearch_to_tsquery('%[1]s', $%%[1]d))", language))
+		}
+		add("("+strings.Join(branches, " OR ")+")", f.Search)
+	}
+	if len(f.Genres) > 0 {
+		switch f.GenresMode {
+		case GenresModeAny:
+			add("genres && $%d", pq.Array(f.Genres))
+		case GenresModeNone:
+			add("NOT genres && $%d", pq.Array(f.Genres))
+		default:
+			add("genres @> $%d", pq.Array(f.Genres))
+		}
+	}
+	if f.YearMin != 0 {
+		add("year >= $%d", f.YearMin)
+	}
+	if f.YearMax != 0 {
+		add("year <= $%d", f.YearMax)
+	}
+	if f.RuntimeMin != 0 {
+		add("runtime >= $%d", f.RuntimeMin)
+	}
+	if f.RuntimeMax != 0 {
+		add("runtime <= $%d", f.RuntimeMax)
+	}
+	if !f.CreatedAfter.IsZero() {
+		add("created_at > $%d", f.CreatedAfter)
+	}
+	if !f.CreatedBefore.IsZero() {
+		add("created_at < $%d", f.CreatedBefore)
+	}
+	if len(f.ExcludeIDs) > 0 {
+		add("id <> ALL($%d)", pq.Array(f.ExcludeIDs))
+	}
+	if f.PersonID != 0 {
+		// This needs two placeholders, so it can't use add(). An empty role matches
+		// credits in any role.
+		args = append(args, f.PersonID, f.PersonRole)
+		conditions = append(conditions, fmt.Sprintf(
+			"id IN (SELECT video_id FROM video_credits WHERE person_id = $%d AND ($%[2]d = '' OR role = $%[2]d))",
+			len(args)-1, len(args)))
+	}
+	return strings.Join(conditions, "\nAND "), args
 }
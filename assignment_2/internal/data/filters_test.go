@@ -0,0 +1,51 @@
+package data
+
+import (
+	"testing"
+
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+func TestValidateFiltersCursor(t *testing.T) {
+	tests := []struct {
+		name      string
+		sort      string
+		cursor    string
+		wantValid bool
+	}{
+		{"First page", "title", "", true},
+		{"Matching sort", "title", encodeCursor(cursor{Sort: "title", Value: "Alpha", ID: 1}), true},
+		{"Backward", "-year", encodeCursor(cursor{Sort: "-year", Value: "2001", ID: 3, Backward: true}), true},
+		{"Different sort", "year", encodeCursor(cursor{Sort: "title", Value: "Alpha", ID: 1}), false},
+		{"Different direction", "-title", encodeCursor(cursor{Sort: "title", Value: "Alpha", ID: 1}), false},
+		{"Not base64", "title", "not a cursor!", false},
+		{"Not JSON", "title", "bm90IGpzb24", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateFilters(v, Filters{
+				PageSize:     20,
+				Sort:         tt.sort,
+				SortSafelist: []string{"title", "-title", "year", "-year"},
+				CursorMode:   true,
+				Cursor:       tt.cursor,
+			})
+			if v.Valid() != tt.wantValid {
+				t.Errorf("got valid %t; want %t: %v", v.Valid(), tt.wantValid, v.Errors)
+			}
+		})
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	want := cursor{Sort: "-created_at", Value: "2001-02-03T04:05:06Z", ID: 42, Backward: true}
+	got, err := decodeCursor(encodeCursor(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
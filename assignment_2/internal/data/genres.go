@@ -0,0 +1,351 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"assignment_2.alexedwards.net/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrDuplicateGenre is returned when a genre's slug or one of its aliases is
+	// already the slug or an alias of another genre.
+	ErrDuplicateGenre = errors.New("duplicate genre")
+	// ErrGenreInUse is returned when deleting a genre which is still used by a video
+	// (including one in the trash) or which is the parent of another genre.
+	ErrGenreInUse = errors.New("genre in use")
+	// ErrInvalidGenreParent is returned when a genre's parent doesn't exist, or when it
+	// would make the genre its own ancestor.
+	ErrInvalidGenreParent = errors.New("invalid genre parent")
+)
+
+// A Genre is an entry in the genre taxonomy. Videos refer to genres by their Slug, which
+// can't be changed once the genre has been created. Aliases are alternative spellings
+// (stored in slug form) which resolve to this genre, and ParentID optionally places the
+// genre under a broader one.
+type Genre struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	Aliases   []string  `json:"aliases"`
+	ParentID  *int64    `json:"parent_id"`
+	Version   int32     `json:"version"`
+}
+
+// GenreSlug normalizes a genre name into slug form: lowercase, with each run of
+// characters other than letters and digits replaced by a single hyphen. "Sci-Fi" and
+// "sci fi" both become "sci-fi". Migration 000011 uses the same rule in SQL.
+func GenreSlug(name string) string {
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(fields, "-")
+}
+
+func ValidateGenre(v *validator.Validator, genre *Genre) {
+	v.Check(genre.Slug != "", "slug", "must be provided")
+	v.Check(len(genre.Slug) <= 50, "slug", "must not be more than 50 bytes long")
+	v.Check(GenreSlug(genre.Slug) == genre.Slug, "slug", "must only contain lowercase letters, digits and single hyphens")
+
+	v.Check(strings.TrimSpace(genre.Name) != "", "name", "must be provided")
+	v.Check(len(genre.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(genre.Aliases) <= 20, "aliases", "must not contain more than 20 aliases")
+	v.Check(validator.Unique(genre.Aliases), "aliases", "must not contain duplicate values")
+	for _, alias := range genre.Aliases {
+		v.Check(alias != "", "aliases", "must not contain empty values")
+		v.Check(len(alias) <= 50, "aliases", "must not contain values more than 50 bytes long")
+		v.Check(alias != genre.Slug, "aliases", "must not contain the genre's own slug")
+	}
+
+	if genre.ParentID != nil {
+		v.Check(*genre.ParentID > 0, "parent_id", "must be a positive integer")
+		v.Check(*genre.ParentID != genre.ID, "parent_id", "must not be the genre itself")
+	}
+}
+
+// resolveGenres maps each name to the slug of the genre it resolves to, using lookup
+// to find the genre for a normalized name. It returns the canonical slugs in their
+// original order without duplicates, along with the names which didn't resolve.
+func resolveGenres(names []string, lookup map[string]string) ([]string, []string) {
+	slugs := []string{}
+	unknown := []string{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		slug, ok := lookup[GenreSlug(name)]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if !seen[slug] {
+			seen[slug] = true
+			slugs = append(slugs, slug)
+		}
+	}
+	return slugs, unknown
+}
+
+type GenreModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// lockGenres serializes changes to the taxonomy, so that the checks for clashing slugs
+// and aliases and for cycles of parents can't race with another change. Genres are
+// rarely changed, so taking a table lock is cheap.
+func lockGenres(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `LOCK TABLE genres, genre_aliases IN SHARE ROW EXCLUSIVE MODE`)
+	return err
+}
+
+// checkGenre returns ErrDuplicateGenre if the genre's slug or aliases clash with any
+// other genre, and ErrInvalidGenreParent if its parent doesn't exist or is one of its
+// descendants. It must be called with the genre tables locked.
+func checkGenre(ctx context.Context, tx *sql.Tx, genre *Genre) error {
+	keys := append([]string{genre.Slug}, genre.Aliases...)
+	query := `
+SELECT EXISTS (SELECT 1 FROM genres WHERE slug = ANY($1) AND id <> $2)
+	OR EXISTS (SELECT 1 FROM genre_aliases WHERE alias = ANY($1) AND genre_id <> $2)`
+	var duplicate bool
+	err := tx.QueryRowContext(ctx, query, pq.Array(keys), genre.ID).Scan(&duplicate)
+	if err != nil {
+		return err
+	}
+	if duplicate {
+		return ErrDuplicateGenre
+	}
+	if genre.ParentID == nil {
+		return nil
+	}
+	// Walk up from the new parent. The walk stops if it reaches the genre itself, so it
+	// terminates even though a cycle is exactly what we're looking for.
+	query = `
+WITH RECURSIVE ancestors AS (
+	SELECT id, parent_id FROM genres WHERE id = $1
+	UNION ALL
+	SELECT genres.id, genres.parent_id
+	FROM genres
+	INNER JOIN ancestors ON genres.id = ancestors.parent_id
+	WHERE ancestors.id <> $2
+)
+SELECT count(*), count(*) FILTER (WHERE id = $2) FROM ancestors`
+	var found, cycles int
+	err = tx.QueryRowContext(ctx, query, *genre.ParentID, genre.ID).Scan(&found, &cycles)
+	if err != nil {
+		return err
+	}
+	if found == 0 || cycles > 0 {
+		return ErrInvalidGenreParent
+	}
+	return nil
+}
+
+// replaceGenreAliases replaces all of a genre's aliases with genre.Aliases.
+func replaceGenreAliases(ctx context.Context, tx *sql.Tx, genre *Genre) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM genre_aliases WHERE genre_id = $1`, genre.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO genre_aliases (alias, genre_id)
+SELECT alias, $2 FROM unnest($1::text[]) AS alias`, pq.Array(genre.Aliases), genre.ID)
+	return err
+}
+
+func (m GenreModel) Insert(ctx context.Context, genre *Genre) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		if err := lockGenres(ctx, tx); err != nil {
+			return err
+		}
+		if err := checkGenre(ctx, tx, genre); err != nil {
+			return err
+		}
+		query := `
+INSERT INTO genres (slug, name, parent_id)
+VALUES ($1, $2, $3)
+RETURNING id, created_at, version`
+		err := tx.QueryRowContext(ctx, query, genre.Slug, genre.Name, genre.ParentID).Scan(&genre.ID, &genre.CreatedAt, &genre.Version)
+		if err != nil {
+			return err
+		}
+		return replaceGenreAliases(ctx, tx, genre)
+	})
+}
+
+// genreColumns selects a genre along with its aliases, in the order read by scanGenre().
+const genreColumns = `
+genres.id, genres.created_at, genres.slug, genres.name, genres.parent_id, genres.version,
+ARRAY(SELECT alias FROM genre_aliases WHERE genre_id = genres.id ORDER BY alias)`
+
+func scanGenre(row interface{ Scan(...interface{}) error }) (*Genre, error) {
+	var genre Genre
+	err := row.Scan(&genre.ID, &genre.CreatedAt, &genre.Slug, &genre.Name, &genre.ParentID, &genre.Version, pq.Array(&genre.Aliases))
+	if err != nil {
+		return nil, err
+	}
+	return &genre, nil
+}
+
+func (m GenreModel) Get(ctx context.Context, id int64) (*Genre, error) {
+	query := `SELECT ` + genreColumns + ` FROM genres WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	genre, err := scanGenre(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return genre, nil
+}
+
+// GetAll returns the whole taxonomy ordered by slug. It's small enough that there's no
+// need to page through it.
+func (m GenreModel) GetAll(ctx context.Context) ([]*Genre, error) {
+	query := `SELECT ` + genreColumns + ` FROM genres ORDER BY slug`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	genres := []*Genre{}
+	for rows.Next() {
+		genre, err := scanGenre(rows)
+		if err != nil {
+			return nil, err
+		}
+		genres = append(genres, genre)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return genres, nil
+}
+
+// Update saves the genre's name, aliases and parent. The slug is never changed, because
+// videos refer to genres by slug.
+func (m GenreModel) Update(ctx context.Context, genre *Genre) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		if err := lockGenres(ctx, tx); err != nil {
+			return err
+		}
+		if err := checkGenre(ctx, tx, genre); err != nil {
+			return err
+		}
+		query := `
+UPDATE genres
+SET name = $1, parent_id = $2, version = version + 1
+WHERE id = $3 AND version = $4
+RETURNING version`
+		err := tx.QueryRowContext(ctx, query, genre.Name, genre.ParentID, genre.ID, genre.Version).Scan(&genre.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+		return replaceGenreAliases(ctx, tx, genre)
+	})
+}
+
+// Delete removes a genre and its aliases. It returns ErrGenreInUse rather than leave a
+// video with a genre that no longer exists, or a genre with a missing parent.
+func (m GenreModel) Delete(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		if err := lockGenres(ctx, tx); err != nil {
+			return err
+		}
+		// Lock out video writes too, so that no video can start using the genre between
+		// the check and the delete.
+		if _, err := tx.ExecContext(ctx, `LOCK TABLE movies IN SHARE MODE`); err != nil {
+			return err
+		}
+		query := `
+SELECT EXISTS (SELECT 1 FROM genres WHERE parent_id = $1)
+	OR EXISTS (SELECT 1 FROM movies WHERE genres @> ARRAY[(SELECT slug FROM genres WHERE id = $1)])`
+		var inUse bool
+		if err := tx.QueryRowContext(ctx, query, id).Scan(&inUse); err != nil {
+			return err
+		}
+		if inUse {
+			return ErrGenreInUse
+		}
+		result, err := tx.ExecContext(ctx, `DELETE FROM genres WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// Resolve maps genre names, slugs and aliases (in any spelling which normalizes to the
+// same slug) to the slugs of their canonical genres. It returns the slugs in their
+// original order without duplicates, along with any names which don't match a genre.
+func (m GenreModel) Resolve(ctx context.Context, names []string) ([]string, []string, error) {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = GenreSlug(name)
+	}
+	query := `
+SELECT slug, slug FROM genres WHERE slug = ANY($1)
+UNION ALL
+SELECT genre_aliases.alias, genres.slug
+FROM genre_aliases
+INNER JOIN genres ON genres.id = genre_aliases.genre_id
+WHERE genre_aliases.alias = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(keys))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	lookup := make(map[string]string)
+	for rows.Next() {
+		var key, slug string
+		if err := rows.Scan(&key, &slug); err != nil {
+			return nil, nil, err
+		}
+		lookup[key] = slug
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	slugs, unknown := resolveGenres(names, lookup)
+	return slugs, unknown, nil
+}
@@ -0,0 +1,2213 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// memoryStore holds every table that the in-memory models need. The models share a
+// single store (and a single mutex) so that cross-table lookups like GetForToken() see
+// a consistent view of the data, in the same way that a JOIN would in PostgreSQL.
+type memoryStore struct {
+	mu sync.RWMutex
+
+	videos      map[int64]*Video
+	nextVideoID int64
+
+	// revisions holds each video's revisions in version order.
+	revisions map[int64][]*VideoRevision
+
+	genres      map[int64]*Genre
+	nextGenreID int64
+
+	people       map[int64]*Person
+	nextPersonID int64
+	// credits holds each video's credits in billing order, without the person names.
+	credits map[int64][]*Credit
+
+	// ratings holds each video's ratings, keyed by user ID.
+	ratings      map[int64]map[int64]*Rating
+	reviews      map[int64]*Review
+	nextReviewID int64
+
+	// watchlists holds each user's lists, keyed by user ID and then list name. The items
+	// are held in position order, so their Position fields aren't kept up to date.
+	watchlists map[int64]map[string][]*WatchlistItem
+
+	users      map[int64]*User
+	nextUserID int64
+
+	tokens map[string]*Token
+
+	revocations []*Revocation
+
+	// permissionCodes mirrors the rows in the permissions table. AddForUser() only
+	// grants codes which exist here, just like the INSERT ... SELECT in PermissionModel.
+	permissionCodes map[string]bool
+	userPermissions map[int64][]string
+}
+
+// NewMemoryModels returns a Models struct backed by an in-memory store. It is intended
+// for running the API locally and in tests without a PostgreSQL database. All data is
+// lost when the process exits.
+func NewMemoryModels() Models {
+	store := &memoryStore{
+		videos:     make(map[int64]*Video),
+		revisions:  make(map[int64][]*VideoRevision),
+		genres:     make(map[int64]*Genre),
+		people:     make(map[int64]*Person),
+		credits:    make(map[int64][]*Credit),
+		ratings:    make(map[int64]map[int64]*Rating),
+		reviews:    make(map[int64]*Review),
+		watchlists: make(map[int64]map[string][]*WatchlistItem),
+		users:      make(map[int64]*User),
+		tokens:     make(map[string]*Token),
+		// Seed the same permission codes as migrations 000006, 000011, 000012, 000013 and
+		// 000020.
+		permissionCodes: map[string]bool{
+			"videos:read":      true,
+			"videos:write":     true,
+			"genres:write":     true,
+			"people:write":     true,
+			"reviews:moderate": true,
+		},
+		userPermissions: make(map[int64][]string),
+	}
+	// Seed the same genres and aliases as migration 000011.
+	for _, seed := range seedGenres {
+		store.nextGenreID++
+		genre := seed
+		genre.ID, genre.Version = store.nextGenreID, 1
+		genre.CreatedAt = time.Now().Truncate(time.Second)
+		genre.Aliases = append([]string{}, seed.Aliases...)
+		store.genres[genre.ID] = &genre
+	}
+	return Models{
+		Videos:      memoryVideoModel{store: store},
+		Revisions:   memoryRevisionModel{store: store},
+		Genres:      memoryGenreModel{store: store},
+		People:      memoryPersonModel{store: store},
+		Credits:     memoryCreditModel{store: store},
+		Ratings:     memoryRatingModel{store: store},
+		Reviews:     memoryReviewModel{store: store},
+		Watchlists:  memoryWatchlistModel{store: store},
+		Permissions: memoryPermissionModel{store: store},
+		Tokens:      memoryTokenModel{store: store},
+		Revocations: memoryRevocationModel{store: store},
+		Users:       memoryUserModel{store: store},
+	}
+}
+
+// seedGenres holds the genres created by migration 000011, which are the genres that
+// videos were restricted to before the genre taxonomy existed.
+var seedGenres = []Genre{
+	{Slug: "action", Name: "Action"},
+	{Slug: "adventure", Name: "Adventure"},
+	{Slug: "animation", Name: "Animation", Aliases: []string{"animated"}},
+	{Slug: "biography", Name: "Biography", Aliases: []string{"biopic"}},
+	{Slug: "comedy", Name: "Comedy"},
+	{Slug: "crime", Name: "Crime"},
+	{Slug: "documentary", Name: "Documentary"},
+	{Slug: "drama", Name: "Drama"},
+	{Slug: "family", Name: "Family"},
+	{Slug: "fantasy", Name: "Fantasy"},
+	{Slug: "history", Name: "History"},
+	{Slug: "horror", Name: "Horror"},
+	{Slug: "music", Name: "Music"},
+	{Slug: "musical", Name: "Musical"},
+	{Slug: "mystery", Name: "Mystery"},
+	{Slug: "romance", Name: "Romance"},
+	{Slug: "sci-fi", Name: "Sci-Fi", Aliases: []string{"science-fiction", "scifi"}},
+	{Slug: "sport", Name: "Sport", Aliases: []string{"sports"}},
+	{Slug: "thriller", Name: "Thriller"},
+	{Slug: "war", Name: "War"},
+	{Slug: "western", Name: "Western"},
+}
+
+type memoryVideoModel struct {
+	store *memoryStore
+}
+
+// copyVideo returns a deep copy of a video, so that callers can never mutate the data
+// held in the store without going through Update().
+func copyVideo(video *Video) *Video {
+	dup := *video
+	if video.Genres != nil {
+		dup.Genres = append([]string(nil), video.Genres...)
+	}
+	if video.DeletedAt != nil {
+		deletedAt := *video.DeletedAt
+		dup.DeletedAt = &deletedAt
+	}
+	if video.DeletedBy != nil {
+		deletedBy := *video.DeletedBy
+		dup.DeletedBy = &deletedBy
+	}
+	if video.Rating != nil {
+		rating := *video.Rating
+		dup.Rating = &rating
+	}
+	return &dup
+}
+
+// addRevision records a revision, stamping it with the current time. The caller must
+// hold the store mutex.
+func (s *memoryStore) addRevision(rev *VideoRevision) {
+	rev.CreatedAt = time.Now().Truncate(time.Second)
+	s.revisions[rev.VideoID] = append(s.revisions[rev.VideoID], rev)
+}
+
+func (m memoryVideoModel) Insert(ctx context.Context, video *Video, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	return m.store.insertVideo(video, userID)
+}
+
+// insertVideo is the body of Insert(). The caller must hold the store mutex.
+func (s *memoryStore) insertVideo(video *Video, userID int64) error {
+	if err := s.checkVideo(video); err != nil {
+		return err
+	}
+	s.nextVideoID++
+	video.ID = s.nextVideoID
+	video.CreatedAt = time.Now().Truncate(time.Second)
+	video.Version = 1
+	video.Rating = &RatingSummary{}
+	s.videos[video.ID] = copyVideo(video)
+	s.addRevision(newVideoRevision(RevisionCreate, userID, nil, video))
+	return nil
+}
+
+func (m memoryVideoModel) InsertBatch(ctx context.Context, videos []*Video, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	// Check every video before saving any of them, so that the batch is all or nothing
+	// like the SQL transaction.
+	for i, video := range videos {
+		if err := m.store.checkVideo(video); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	now := time.Now().Truncate(time.Second)
+	for _, video := range videos {
+		m.store.nextVideoID++
+		video.ID = m.store.nextVideoID
+		video.CreatedAt = now
+		video.Version = 1
+		video.Rating = &RatingSummary{}
+		m.store.videos[video.ID] = copyVideo(video)
+		m.store.addRevision(newVideoRevision(RevisionCreate, userID, nil, video))
+	}
+	return nil
+}
+
+func (m memoryVideoModel) Get(ctx context.Context, id int64) (*Video, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	video, ok := m.store.videos[id]
+	if !ok || video.DeletedAt != nil {
+		return nil, ErrRecordNotFound
+	}
+	return copyVideo(video), nil
+}
+
+// Update() applies the same optimistic locking rule as the SQL version: the write only
+// succeeds if the stored version still matches the version the caller read.
+func (m memoryVideoModel) Update(ctx context.Context, video *Video, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	return m.store.updateVideo(video, userID)
+}
+
+// updateVideo is the body of Update(). The caller must hold the store mutex.
+func (s *memoryStore) updateVideo(video *Video, userID int64) error {
+	if err := s.checkVideo(video); err != nil {
+		return err
+	}
+	existing, ok := s.videos[video.ID]
+	if !ok || existing.Version != video.Version || existing.DeletedAt != nil {
+		return ErrEditConflict
+	}
+	video.Version++
+	stored := copyVideo(video)
+	stored.CreatedAt, stored.Rating, stored.Poster = existing.CreatedAt, existing.Rating, existing.Poster
+	s.videos[video.ID] = stored
+	s.addRevision(newVideoRevision(RevisionUpdate, userID, existing, stored))
+	return nil
+}
+
+func (m memoryVideoModel) GetAll(ctx context.Context, videoFilter VideoFilter, filters Filters) ([]*Video, Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	// Resolve the sort column first, so that an unsafe sort value panics in exactly
+	// the same way as it does for the SQL implementation.
+	column := filters.sortColumn()
+	descending := filters.sortDirection() == "DESC" || column == "relevance"
+
+	m.store.mu.RLock()
+	matches := []*Video{}
+	for _, video := range m.store.videos {
+		if !videoFilter.matches(video, m.store.credits) {
+			continue
+		}
+		dup := copyVideo(video)
+		if videoFilter.Search != "" {
+			dup.Search = memorySearchHit(dup, videoFilter.Search)
+		}
+		matches = append(matches, dup)
+	}
+	m.store.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		c := compareVideos(matches[i], matches[j], column)
+		if c != 0 {
+			if descending {
+				return c > 0
+			}
+			return c < 0
+		}
+		return matches[i].ID < matches[j].ID
+	})
+
+	if filters.CursorMode {
+		return memoryCursorPage(matches, filters)
+	}
+
+	totalRecords := len(matches)
+	start := filters.offset()
+	if start > totalRecords {
+		start = totalRecords
+	}
+	end := start + filters.limit()
+	if end > totalRecords {
+		end = totalRecords
+	}
+	// Mirror the SQL behaviour, where count(*) OVER() is only returned alongside rows,
+	// so a page past the end reports no records at all.
+	if start == end {
+		totalRecords = 0
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return matches[start:end], metadata, nil
+}
+
+func (m memoryVideoModel) Stream(ctx context.Context, videoFilter VideoFilter, filters Filters, fn func(*Video) error) error {
+	// Reuse GetAll() to take a sorted snapshot of every match, by asking for a single
+	// page which is large enough to hold them all.
+	m.store.mu.RLock()
+	filters.Page, filters.PageSize, filters.CursorMode = 1, len(m.store.videos)+1, false
+	m.store.mu.RUnlock()
+	videos, _, err := m.GetAll(ctx, videoFilter, filters)
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(video); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m memoryVideoModel) GetFacets(ctx context.Context, videoFilter VideoFilter) (*Facets, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	var total int
+	genres := make(map[string]int)
+	decades := make(map[string]int)
+	runtimes := make([]int, len(RuntimeBuckets))
+	for _, video := range m.store.videos {
+		if !videoFilter.matches(video, m.store.credits) {
+			continue
+		}
+		total++
+		for _, genre := range video.Genres {
+			genres[genre]++
+		}
+		decades[decadeLabel(video.Year)]++
+		runtimes[runtimeBucket(video.Runtime)]++
+	}
+	return newFacets(total, genres, decades, runtimes), nil
+}
+
+func (m memoryVideoModel) Suggest(ctx context.Context, query string, limit int) ([]*VideoSuggestion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(strings.TrimSpace(query))
+	m.store.mu.RLock()
+	suggestions := []*VideoSuggestion{}
+	for _, video := range m.store.videos {
+		if video.DeletedAt != nil {
+			continue
+		}
+		title := strings.ToLower(video.Title)
+		score := wordSimilarity(query, title)
+		switch {
+		case strings.HasPrefix(title, query):
+			score += 2
+		case strings.Contains(title, " "+query):
+			score += 1
+		case score < suggestSimilarityThreshold:
+			continue
+		}
+		suggestions = append(suggestions, &VideoSuggestion{ID: video.ID, Title: video.Title, Year: video.Year, Score: score})
+	}
+	m.store.mu.RUnlock()
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Title != b.Title {
+			return a.Title < b.Title
+		}
+		return a.ID < b.ID
+	})
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions, nil
+}
+
+// trigrams returns the trigrams in s, in order, in the way that pg_trgm builds them:
+// each word is padded with two spaces in front and one behind before being split up.
+func trigrams(s string) []string {
+	var list []string
+	for _, word := range searchTerms(s) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			list = append(list, string(padded[i:i+3]))
+		}
+	}
+	return list
+}
+
+// wordSimilarity approximates pg_trgm's word_similarity(query, title): the greatest
+// trigram similarity between the query and any continuous run of the title's trigrams.
+func wordSimilarity(query, title string) float64 {
+	queryTrigrams := make(map[string]bool)
+	for _, trigram := range trigrams(query) {
+		queryTrigrams[trigram] = true
+	}
+	if len(queryTrigrams) == 0 {
+		return 0
+	}
+	titleTrigrams := trigrams(title)
+	var best float64
+	for i := range titleTrigrams {
+		extent := make(map[string]bool)
+		shared := 0
+		for _, trigram := range titleTrigrams[i:] {
+			if !extent[trigram] {
+				extent[trigram] = true
+				if queryTrigrams[trigram] {
+					shared++
+				}
+			}
+			similarity := float64(shared) / float64(len(queryTrigrams)+len(extent)-shared)
+			if similarity > best {
+				best = similarity
+			}
+		}
+	}
+	return best
+}
+
+func (m memoryVideoModel) Delete(ctx context.Context, id int64, version int32, deletedBy int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	return m.store.deleteVideo(id, version, deletedBy)
+}
+
+// deleteVideo is the body of Delete(), with the same optional version check as the SQL
+// version. The caller must hold the store mutex.
+func (s *memoryStore) deleteVideo(id int64, version int32, deletedBy int64) error {
+	video, ok := s.videos[id]
+	if !ok || video.DeletedAt != nil {
+		return ErrRecordNotFound
+	}
+	if version != 0 && video.Version != version {
+		return ErrEditConflict
+	}
+	before := copyVideo(video)
+	now := time.Now().Truncate(time.Second)
+	video.DeletedAt, video.DeletedBy = &now, &deletedBy
+	video.Version++
+	s.addRevision(newVideoRevision(RevisionDelete, deletedBy, before, video))
+	return nil
+}
+
+func (m memoryVideoModel) Restore(ctx context.Context, id int64, userID int64) (*Video, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	video, ok := m.store.videos[id]
+	if !ok || video.DeletedAt == nil {
+		return nil, ErrRecordNotFound
+	}
+	before := copyVideo(video)
+	video.DeletedAt, video.DeletedBy = nil, nil
+	video.Version++
+	m.store.addRevision(newVideoRevision(RevisionRestore, userID, before, video))
+	return copyVideo(video), nil
+}
+
+func (m memoryVideoModel) Purge(ctx context.Context, deletedBefore time.Time) ([]string, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	posters := []string{}
+	var purged int64
+	for id, video := range m.store.videos {
+		if video.DeletedAt != nil && video.DeletedAt.Before(deletedBefore) {
+			if video.Poster != "" {
+				posters = append(posters, video.Poster)
+			}
+			delete(m.store.videos, id)
+			delete(m.store.revisions, id)
+			delete(m.store.credits, id)
+			delete(m.store.ratings, id)
+			for _, lists := range m.store.watchlists {
+				for name, items := range lists {
+					lists[name] = removeWatchlistItem(items, id)
+				}
+			}
+			for reviewID, review := range m.store.reviews {
+				if review.VideoID == id {
+					delete(m.store.reviews, reviewID)
+				}
+			}
+			purged++
+		}
+	}
+	return posters, purged, nil
+}
+
+func (m memoryVideoModel) SetPoster(ctx context.Context, id int64, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	video, ok := m.store.videos[id]
+	if !ok || video.DeletedAt != nil {
+		return "", ErrRecordNotFound
+	}
+	old := video.Poster
+	video.Poster = key
+	return old, nil
+}
+
+func (m memoryVideoModel) ExecBatch(ctx context.Context, ops []*VideoOperation, atomic bool, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	run := func(op *VideoOperation) error {
+		switch op.Action {
+		case BatchCreate:
+			return m.store.insertVideo(op.Video, userID)
+		case BatchUpdate:
+			return m.store.updateVideo(op.Video, userID)
+		case BatchDelete:
+			return m.store.deleteVideo(op.Video.ID, op.Video.Version, userID)
+		default:
+			panic("unknown batch action: " + op.Action)
+		}
+	}
+	if !atomic {
+		for _, op := range ops {
+			op.Err = run(op)
+		}
+		return nil
+	}
+	// Take a copy of everything a batch can change, so that a failed batch can be
+	// rolled back like the SQL transaction.
+	videos := make(map[int64]*Video, len(m.store.videos))
+	for id, video := range m.store.videos {
+		videos[id] = copyVideo(video)
+	}
+	revisions := make(map[int64][]*VideoRevision, len(m.store.revisions))
+	for id, list := range m.store.revisions {
+		revisions[id] = list[:len(list):len(list)]
+	}
+	nextVideoID := m.store.nextVideoID
+	for i, op := range ops {
+		if err := run(op); err != nil {
+			abortBatch(ops, i, err)
+			m.store.videos, m.store.revisions, m.store.nextVideoID = videos, revisions, nextVideoID
+			return nil
+		}
+	}
+	return nil
+}
+
+type memoryRevisionModel struct {
+	store *memoryStore
+}
+
+// copyRevision returns a deep copy of a revision, like copyVideo().
+func copyRevision(rev *VideoRevision) *VideoRevision {
+	dup := *rev
+	if rev.UserID != nil {
+		userID := *rev.UserID
+		dup.UserID = &userID
+	}
+	if rev.Before != nil {
+		dup.Before = copyVideo(rev.Before)
+	}
+	dup.After = copyVideo(rev.After)
+	return &dup
+}
+
+func (m memoryRevisionModel) GetAllForVideo(ctx context.Context, videoID int64, filters Filters) ([]*VideoRevision, Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	// Check the sort value in the same way as the SQL version. Version is the only sort
+	// column for revisions, so after that only the direction matters.
+	_ = filters.sortColumn()
+	descending := filters.sortDirection() == "DESC"
+
+	m.store.mu.RLock()
+	stored := m.store.revisions[videoID]
+	revisions := make([]*VideoRevision, 0, len(stored))
+	for _, rev := range stored {
+		revisions = append(revisions, copyRevision(rev))
+	}
+	m.store.mu.RUnlock()
+	if descending {
+		for i, j := 0, len(revisions)-1; i < j; i, j = i+1, j-1 {
+			revisions[i], revisions[j] = revisions[j], revisions[i]
+		}
+	}
+
+	totalRecords := len(revisions)
+	start := filters.offset()
+	if start > totalRecords {
+		start = totalRecords
+	}
+	end := start + filters.limit()
+	if end > totalRecords {
+		end = totalRecords
+	}
+	if start == end {
+		totalRecords = 0
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return revisions[start:end], metadata, nil
+}
+
+func (m memoryRevisionModel) Get(ctx context.Context, videoID int64, version int32) (*VideoRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	for _, rev := range m.store.revisions[videoID] {
+		if rev.Version == version {
+			return copyRevision(rev), nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+type memoryGenreModel struct {
+	store *memoryStore
+}
+
+func copyGenre(genre *Genre) *Genre {
+	dup := *genre
+	dup.Aliases = append([]string{}, genre.Aliases...)
+	if genre.ParentID != nil {
+		parentID := *genre.ParentID
+		dup.ParentID = &parentID
+	}
+	return &dup
+}
+
+// genreLookup maps every slug and alias to the slug of its genre. The caller must hold
+// the store mutex.
+func (s *memoryStore) genreLookup() map[string]string {
+	lookup := make(map[string]string)
+	for _, genre := range s.genres {
+		lookup[genre.Slug] = genre.Slug
+		for _, alias := range genre.Aliases {
+			lookup[alias] = genre.Slug
+		}
+	}
+	return lookup
+}
+
+// checkGenre is the in-memory equivalent of the checkGenre() function used by
+// GenreModel. The caller must hold the store mutex.
+func (s *memoryStore) checkGenre(genre *Genre) error {
+	for _, other := range s.genres {
+		if other.ID == genre.ID {
+			continue
+		}
+		keys := append([]string{other.Slug}, other.Aliases...)
+		if containsAny(keys, append([]string{genre.Slug}, genre.Aliases...)) {
+			return ErrDuplicateGenre
+		}
+	}
+	for parentID := genre.ParentID; parentID != nil; {
+		parent, ok := s.genres[*parentID]
+		if !ok || parent.ID == genre.ID {
+			return ErrInvalidGenreParent
+		}
+		parentID = parent.ParentID
+	}
+	return nil
+}
+
+func (m memoryGenreModel) Insert(ctx context.Context, genre *Genre) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if err := m.store.checkGenre(genre); err != nil {
+		return err
+	}
+	m.store.nextGenreID++
+	genre.ID = m.store.nextGenreID
+	genre.CreatedAt = time.Now().Truncate(time.Second)
+	genre.Version = 1
+	m.store.genres[genre.ID] = copyGenre(genre)
+	return nil
+}
+
+func (m memoryGenreModel) Get(ctx context.Context, id int64) (*Genre, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	genre, ok := m.store.genres[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyGenre(genre), nil
+}
+
+func (m memoryGenreModel) GetAll(ctx context.Context) ([]*Genre, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	genres := []*Genre{}
+	for _, genre := range m.store.genres {
+		genres = append(genres, copyGenre(genre))
+	}
+	m.store.mu.RUnlock()
+	sort.Slice(genres, func(i, j int) bool { return genres[i].Slug < genres[j].Slug })
+	return genres, nil
+}
+
+func (m memoryGenreModel) Update(ctx context.Context, genre *Genre) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if err := m.store.checkGenre(genre); err != nil {
+		return err
+	}
+	existing, ok := m.store.genres[genre.ID]
+	if !ok || existing.Version != genre.Version {
+		return ErrEditConflict
+	}
+	genre.Version++
+	stored := copyGenre(genre)
+	stored.Slug = existing.Slug
+	stored.CreatedAt = existing.CreatedAt
+	m.store.genres[genre.ID] = stored
+	return nil
+}
+
+func (m memoryGenreModel) Delete(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	genre, ok := m.store.genres[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	for _, other := range m.store.genres {
+		if other.ParentID != nil && *other.ParentID == id {
+			return ErrGenreInUse
+		}
+	}
+	for _, video := range m.store.videos {
+		if containsAny(video.Genres, []string{genre.Slug}) {
+			return ErrGenreInUse
+		}
+	}
+	delete(m.store.genres, id)
+	return nil
+}
+
+func (m memoryGenreModel) Resolve(ctx context.Context, names []string) ([]string, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	m.store.mu.RLock()
+	lookup := m.store.genreLookup()
+	m.store.mu.RUnlock()
+	slugs, unknown := resolveGenres(names, lookup)
+	return slugs, unknown, nil
+}
+
+type memoryPersonModel struct {
+	store *memoryStore
+}
+
+func copyPerson(person *Person) *Person {
+	dup := *person
+	if person.BirthYear != nil {
+		birthYear := *person.BirthYear
+		dup.BirthYear = &birthYear
+	}
+	return &dup
+}
+
+func (m memoryPersonModel) Insert(ctx context.Context, person *Person) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.nextPersonID++
+	person.ID = m.store.nextPersonID
+	person.CreatedAt = time.Now().Truncate(time.Second)
+	person.Version = 1
+	m.store.people[person.ID] = copyPerson(person)
+	return nil
+}
+
+func (m memoryPersonModel) Get(ctx context.Context, id int64) (*Person, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	person, ok := m.store.people[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyPerson(person), nil
+}
+
+func (m memoryPersonModel) GetAll(ctx context.Context, name string, filters Filters) ([]*Person, Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	column := filters.sortColumn()
+	descending := filters.sortDirection() == "DESC"
+
+	m.store.mu.RLock()
+	matches := []*Person{}
+	for _, person := range m.store.people {
+		if name != "" && !matchesSearch(person.Name, name) {
+			continue
+		}
+		matches = append(matches, copyPerson(person))
+	}
+	m.store.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		var c int
+		switch column {
+		case "id":
+			c = compareInt64(matches[i].ID, matches[j].ID)
+		case "name":
+			c = strings.Compare(matches[i].Name, matches[j].Name)
+		default:
+			panic("unsupported sort column: " + column)
+		}
+		if c != 0 {
+			if descending {
+				return c > 0
+			}
+			return c < 0
+		}
+		return matches[i].ID < matches[j].ID
+	})
+
+	totalRecords := len(matches)
+	start := filters.offset()
+	if start > totalRecords {
+		start = totalRecords
+	}
+	end := start + filters.limit()
+	if end > totalRecords {
+		end = totalRecords
+	}
+	if start == end {
+		totalRecords = 0
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return matches[start:end], metadata, nil
+}
+
+func (m memoryPersonModel) Update(ctx context.Context, person *Person) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	existing, ok := m.store.people[person.ID]
+	if !ok || existing.Version != person.Version {
+		return ErrEditConflict
+	}
+	person.Version++
+	stored := copyPerson(person)
+	stored.CreatedAt = existing.CreatedAt
+	m.store.people[person.ID] = stored
+	return nil
+}
+
+func (m memoryPersonModel) Delete(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if _, ok := m.store.people[id]; !ok {
+		return ErrRecordNotFound
+	}
+	// Mirror the ON DELETE RESTRICT on video_credits.person_id.
+	for _, credits := range m.store.credits {
+		for _, credit := range credits {
+			if credit.PersonID == id {
+				return ErrPersonCredited
+			}
+		}
+	}
+	delete(m.store.people, id)
+	return nil
+}
+
+type memoryCreditModel struct {
+	store *memoryStore
+}
+
+func (m memoryCreditModel) GetForVideo(ctx context.Context, videoID int64) ([]*Credit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	credits := []*Credit{}
+	for _, credit := range m.store.credits[videoID] {
+		dup := *credit
+		dup.PersonName = m.store.people[credit.PersonID].Name
+		credits = append(credits, &dup)
+	}
+	return credits, nil
+}
+
+func (m memoryCreditModel) ReplaceForVideo(ctx context.Context, videoID int64, credits []*Credit) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if video, ok := m.store.videos[videoID]; !ok || video.DeletedAt != nil {
+		return ErrRecordNotFound
+	}
+	stored := make([]*Credit, len(credits))
+	for i, credit := range credits {
+		person, ok := m.store.people[credit.PersonID]
+		if !ok {
+			return ErrUnknownPerson
+		}
+		credit.PersonName = person.Name
+		dup := *credit
+		dup.PersonName = ""
+		stored[i] = &dup
+	}
+	// Keep the same order as the ORDER BY in CreditModel.GetForVideo().
+	sort.SliceStable(stored, func(i, j int) bool {
+		a, b := stored[i], stored[j]
+		if a.BillingOrder != b.BillingOrder {
+			return a.BillingOrder < b.BillingOrder
+		}
+		if a.PersonID != b.PersonID {
+			return a.PersonID < b.PersonID
+		}
+		return a.Role < b.Role
+	})
+	m.store.credits[videoID] = stored
+	return nil
+}
+
+type memoryRatingModel struct {
+	store *memoryStore
+}
+
+func (m memoryRatingModel) Get(ctx context.Context, videoID, userID int64) (*Rating, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	rating, ok := m.store.ratings[videoID][userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	dup := *rating
+	return &dup, nil
+}
+
+func (m memoryRatingModel) Insert(ctx context.Context, rating *Rating) (*RatingSummary, error) {
+	return m.change(ctx, rating.VideoID, func(ratings map[int64]*Rating) error {
+		if _, ok := ratings[rating.UserID]; ok {
+			return ErrDuplicateRating
+		}
+		rating.CreatedAt = time.Now().Truncate(time.Second)
+		rating.UpdatedAt = rating.CreatedAt
+		dup := *rating
+		ratings[rating.UserID] = &dup
+		return nil
+	})
+}
+
+func (m memoryRatingModel) Update(ctx context.Context, rating *Rating) (*RatingSummary, error) {
+	return m.change(ctx, rating.VideoID, func(ratings map[int64]*Rating) error {
+		existing, ok := ratings[rating.UserID]
+		if !ok {
+			return ErrRecordNotFound
+		}
+		existing.Score = rating.Score
+		existing.UpdatedAt = time.Now().Truncate(time.Second)
+		rating.CreatedAt, rating.UpdatedAt = existing.CreatedAt, existing.UpdatedAt
+		return nil
+	})
+}
+
+func (m memoryRatingModel) Delete(ctx context.Context, videoID, userID int64) (*RatingSummary, error) {
+	return m.change(ctx, videoID, func(ratings map[int64]*Rating) error {
+		if _, ok := ratings[userID]; !ok {
+			return ErrRecordNotFound
+		}
+		delete(ratings, userID)
+		return nil
+	})
+}
+
+// change is the in-memory equivalent of RatingModel.change(). It calls fn with the
+// video's ratings while holding the store mutex, and then recomputes the summary held on
+// the video. fn must leave the ratings unchanged if it returns an error.
+func (m memoryRatingModel) change(ctx context.Context, videoID int64, fn func(ratings map[int64]*Rating) error) (*RatingSummary, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	video, ok := m.store.videos[videoID]
+	if !ok || video.DeletedAt != nil {
+		return nil, ErrRecordNotFound
+	}
+	ratings := m.store.ratings[videoID]
+	if ratings == nil {
+		ratings = make(map[int64]*Rating)
+		m.store.ratings[videoID] = ratings
+	}
+	if err := fn(ratings); err != nil {
+		return nil, err
+	}
+	summary := RatingSummary{Count: int32(len(ratings))}
+	if len(ratings) > 0 {
+		var total int32
+		for _, rating := range ratings {
+			total += rating.Score
+		}
+		// Round to two decimal places, like the numeric(4, 2) rating column.
+		summary.Average = math.Round(float64(total)/float64(len(ratings))*100) / 100
+	}
+	video.Rating = &summary
+	dup := summary
+	return &dup, nil
+}
+
+type memoryReviewModel struct {
+	store *memoryStore
+}
+
+// copyReview returns a copy of a review with its UserName filled in from the users
+// table. The caller must hold the store mutex.
+func (s *memoryStore) copyReview(review *Review) *Review {
+	dup := *review
+	if user, ok := s.users[review.UserID]; ok {
+		dup.UserName = user.Name
+	}
+	return &dup
+}
+
+func (m memoryReviewModel) Insert(ctx context.Context, review *Review) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if video, ok := m.store.videos[review.VideoID]; !ok || video.DeletedAt != nil {
+		return ErrRecordNotFound
+	}
+	// Mirror the UNIQUE (video_id, user_id) constraint on video_reviews.
+	for _, existing := range m.store.reviews {
+		if existing.VideoID == review.VideoID && existing.UserID == review.UserID {
+			return ErrDuplicateReview
+		}
+	}
+	m.store.nextReviewID++
+	review.ID = m.store.nextReviewID
+	review.CreatedAt = time.Now().Truncate(time.Second)
+	review.UpdatedAt = review.CreatedAt
+	review.Version = 1
+	stored := *review
+	stored.UserName = ""
+	m.store.reviews[review.ID] = &stored
+	review.UserName = m.store.copyReview(&stored).UserName
+	return nil
+}
+
+func (m memoryReviewModel) Get(ctx context.Context, videoID, id int64) (*Review, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	review, ok := m.store.reviews[id]
+	if !ok || review.VideoID != videoID {
+		return nil, ErrRecordNotFound
+	}
+	return m.store.copyReview(review), nil
+}
+
+func (m memoryReviewModel) GetAllForVideo(ctx context.Context, videoID int64, status string, filters Filters) ([]*Review, Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	column := filters.sortColumn()
+	descending := filters.sortDirection() == "DESC"
+
+	m.store.mu.RLock()
+	matches := []*Review{}
+	for _, review := range m.store.reviews {
+		if review.VideoID == videoID && review.Status == status {
+			matches = append(matches, m.store.copyReview(review))
+		}
+	}
+	m.store.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		var c int
+		switch column {
+		case "created_at":
+			c = compareInt64(matches[i].CreatedAt.Unix(), matches[j].CreatedAt.Unix())
+		default:
+			panic("unsupported sort column: " + column)
+		}
+		if c != 0 {
+			if descending {
+				return c > 0
+			}
+			return c < 0
+		}
+		return matches[i].ID < matches[j].ID
+	})
+
+	totalRecords := len(matches)
+	start := filters.offset()
+	if start > totalRecords {
+		start = totalRecords
+	}
+	end := start + filters.limit()
+	if end > totalRecords {
+		end = totalRecords
+	}
+	if start == end {
+		totalRecords = 0
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return matches[start:end], metadata, nil
+}
+
+func (m memoryReviewModel) Update(ctx context.Context, review *Review) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	existing, ok := m.store.reviews[review.ID]
+	if !ok || existing.Version != review.Version {
+		return ErrEditConflict
+	}
+	existing.Body, existing.Status = review.Body, review.Status
+	existing.UpdatedAt = time.Now().Truncate(time.Second)
+	existing.Version++
+	review.UpdatedAt, review.Version = existing.UpdatedAt, existing.Version
+	return nil
+}
+
+func (m memoryReviewModel) Delete(ctx context.Context, videoID, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	review, ok := m.store.reviews[id]
+	if !ok || review.VideoID != videoID {
+		return ErrRecordNotFound
+	}
+	delete(m.store.reviews, id)
+	return nil
+}
+
+type memoryWatchlistModel struct {
+	store *memoryStore
+}
+
+// copyWatchlistItem returns a copy of the item at index i of a list, with its Position,
+// Title and Year filled in. It returns nil if the video is in the trash, which leaves it
+// out of reads just like the join in WatchlistModel. The caller must hold the store
+// mutex.
+func (s *memoryStore) copyWatchlistItem(items []*WatchlistItem, i int) *WatchlistItem {
+	video := s.videos[items[i].VideoID]
+	if video.DeletedAt != nil {
+		return nil
+	}
+	dup := *items[i]
+	dup.Position = int32(i + 1)
+	dup.Title, dup.Year = video.Title, video.Year
+	dup.Watched = dup.WatchedAt != nil
+	if dup.WatchedAt != nil {
+		watchedAt := *dup.WatchedAt
+		dup.WatchedAt = &watchedAt
+	}
+	return &dup
+}
+
+// removeWatchlistItem returns items without the item for videoID, if there is one.
+func removeWatchlistItem(items []*WatchlistItem, videoID int64) []*WatchlistItem {
+	for i, item := range items {
+		if item.VideoID == videoID {
+			return append(items[:i:i], items[i+1:]...)
+		}
+	}
+	return items
+}
+
+// insertWatchlistItem returns items with item inserted at the 1-based position.
+func insertWatchlistItem(items []*WatchlistItem, item *WatchlistItem, position int32) []*WatchlistItem {
+	result := append([]*WatchlistItem{}, items[:position-1]...)
+	result = append(result, item)
+	return append(result, items[position-1:]...)
+}
+
+func (m memoryWatchlistModel) GetLists(ctx context.Context, userID int64) ([]*WatchlistSummary, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	lists := []*WatchlistSummary{}
+	for name, items := range m.store.watchlists[userID] {
+		list := &WatchlistSummary{Name: name}
+		for i := range items {
+			if item := m.store.copyWatchlistItem(items, i); item != nil {
+				list.Count++
+				if item.Watched {
+					list.Watched++
+				}
+			}
+		}
+		// Lists only exist through their items, as with the GROUP BY in GetLists().
+		if list.Count > 0 {
+			lists = append(lists, list)
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].Name < lists[j].Name })
+	return lists, nil
+}
+
+func (m memoryWatchlistModel) GetItems(ctx context.Context, userID int64, list string) ([]*WatchlistItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	items := m.store.watchlists[userID][list]
+	result := []*WatchlistItem{}
+	for i := range items {
+		if item := m.store.copyWatchlistItem(items, i); item != nil {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+func (m memoryWatchlistModel) Get(ctx context.Context, userID int64, list string, videoID int64) (*WatchlistItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	items := m.store.watchlists[userID][list]
+	for i, item := range items {
+		if item.VideoID == videoID {
+			if dup := m.store.copyWatchlistItem(items, i); dup != nil {
+				return dup, nil
+			}
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryWatchlistModel) Add(ctx context.Context, userID int64, item *WatchlistItem) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	video, ok := m.store.videos[item.VideoID]
+	if !ok || video.DeletedAt != nil {
+		return ErrRecordNotFound
+	}
+	lists := m.store.watchlists[userID]
+	if lists == nil {
+		lists = make(map[string][]*WatchlistItem)
+		m.store.watchlists[userID] = lists
+	}
+	items := lists[item.List]
+	for _, existing := range items {
+		if existing.VideoID == item.VideoID {
+			return ErrDuplicateWatchlistItem
+		}
+	}
+	count := int32(len(items))
+	if count >= MaxWatchlistItems {
+		return ErrWatchlistFull
+	}
+	if item.Position < 1 || item.Position > count+1 {
+		item.Position = count + 1
+	}
+	item.Title, item.Year = video.Title, video.Year
+	item.AddedAt = time.Now().Truncate(time.Second)
+	item.Watched, item.WatchedAt = false, nil
+	stored := &WatchlistItem{List: item.List, VideoID: item.VideoID, AddedAt: item.AddedAt}
+	lists[item.List] = insertWatchlistItem(items, stored, item.Position)
+	return nil
+}
+
+func (m memoryWatchlistModel) Update(ctx context.Context, userID int64, item *WatchlistItem) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	lists := m.store.watchlists[userID]
+	var stored *WatchlistItem
+	for _, existing := range lists[item.List] {
+		if existing.VideoID == item.VideoID {
+			stored = existing
+		}
+	}
+	if stored == nil {
+		return ErrRecordNotFound
+	}
+	items := removeWatchlistItem(lists[item.List], item.VideoID)
+	count := int32(len(items)) + 1
+	if item.Position < 1 || item.Position > count {
+		item.Position = count
+	}
+	lists[item.List] = insertWatchlistItem(items, stored, item.Position)
+	switch {
+	case !item.Watched:
+		stored.WatchedAt = nil
+	case stored.WatchedAt == nil:
+		now := time.Now().Truncate(time.Second)
+		stored.WatchedAt = &now
+	}
+	item.AddedAt, item.WatchedAt = stored.AddedAt, nil
+	if stored.WatchedAt != nil {
+		watchedAt := *stored.WatchedAt
+		item.WatchedAt = &watchedAt
+	}
+	return nil
+}
+
+func (m memoryWatchlistModel) Remove(ctx context.Context, userID int64, list string, videoID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	lists := m.store.watchlists[userID]
+	items := lists[list]
+	remaining := removeWatchlistItem(items, videoID)
+	if len(remaining) == len(items) {
+		return ErrRecordNotFound
+	}
+	lists[list] = remaining
+	return nil
+}
+
+func (m memoryWatchlistModel) InWatchlist(ctx context.Context, userID int64, videoIDs []int64) (map[int64]bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	wanted := make(map[int64]bool, len(videoIDs))
+	for _, id := range videoIDs {
+		wanted[id] = true
+	}
+	in := make(map[int64]bool)
+	for _, items := range m.store.watchlists[userID] {
+		for _, item := range items {
+			if wanted[item.VideoID] {
+				in[item.VideoID] = true
+			}
+		}
+	}
+	return in, nil
+}
+
+// memoryCursorPage is the in-memory equivalent of VideoModel.getAllByCursor(). The
+// matches must already be sorted by filters.Sort.
+func memoryCursorPage(matches []*Video, filters Filters) ([]*Video, Metadata, error) {
+	totalRecords := -1
+	if filters.IncludeTotal {
+		totalRecords = len(matches)
+	}
+	c, paged := filters.cursor()
+	if !paged {
+		end := filters.limit() + 1
+		if end > len(matches) {
+			end = len(matches)
+		}
+		videos, metadata := videoCursorPage(matches[:end], filters, false, totalRecords)
+		return videos, metadata, nil
+	}
+	column := filters.sortColumn()
+	probe, err := videoFromCursor(column, c)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	// Find the first row which sorts after the cursor position. Ties on the sort
+	// column are broken by ID, which is always ascending.
+	descending := filters.sortDirection() == "DESC"
+	pos := sort.Search(len(matches), func(i int) bool {
+		cmp := compareVideos(matches[i], probe, column)
+		if descending {
+			cmp = -cmp
+		}
+		return cmp > 0 || (cmp == 0 && matches[i].ID > probe.ID)
+	})
+	if !c.Backward {
+		end := pos + filters.limit() + 1
+		if end > len(matches) {
+			end = len(matches)
+		}
+		videos, metadata := videoCursorPage(matches[pos:end], filters, false, totalRecords)
+		return videos, metadata, nil
+	}
+	// For a backward cursor we want the rows strictly before the position, nearest
+	// first, to match the reversed ORDER BY used by the SQL version.
+	before := pos
+	if before > 0 && matches[before-1].ID == probe.ID && compareVideos(matches[before-1], probe, column) == 0 {
+		before--
+	}
+	var rows []*Video
+	for i := before - 1; i >= 0 && len(rows) <= filters.limit(); i-- {
+		rows = append(rows, matches[i])
+	}
+	videos, metadata := videoCursorPage(rows, filters, true, totalRecords)
+	return videos, metadata, nil
+}
+
+// checkVideo applies checkVideoConstraints(), and then checks that the video's genres
+// exist like checkVideoGenres() does. The caller must hold the store mutex.
+func (s *memoryStore) checkVideo(video *Video) error {
+	if err := checkVideoConstraints(video); err != nil {
+		return err
+	}
+	slugs := make(map[string]bool)
+	for _, genre := range s.genres {
+		slugs[genre.Slug] = true
+	}
+	for _, slug := range video.Genres {
+		if !slugs[slug] {
+			return &ConstraintError{Constraint: "movies_genres_exist", Field: "genres", Message: fmt.Sprintf("contains unknown genre %q", slug)}
+		}
+	}
+	return nil
+}
+
+// checkVideoConstraints enforces the CHECK constraints from migration 000002, returning
+// the same *ConstraintError that the SQL models return when PostgreSQL rejects a row.
+func checkVideoConstraints(video *Video) error {
+	var name string
+	switch {
+	case video.Runtime < 0:
+		name = "movies_runtime_check"
+	case video.Year < 1888 || video.Year > int32(time.Now().Year()):
+		name = "movies_year_check"
+	case len(video.Genres) < 1 || len(video.Genres) > 5:
+		name = "genres_length_check"
+	case len(video.Description) > 10000:
+		name = "movies_description_length_check"
+	default:
+		return nil
+	}
+	c := videoConstraints[name]
+	return &ConstraintError{Constraint: name, Field: c.Field, Message: c.Message}
+}
+
+// compareVideos orders two videos by one of the sortable columns, returning a negative
+// number, zero or a positive number in the style of strings.Compare().
+func compareVideos(a, b *Video, column string) int {
+	switch column {
+	case "id":
+		return compareInt64(a.ID, b.ID)
+	case "title":
+		return strings.Compare(a.Title, b.Title)
+	case "year":
+		return compareInt64(int64(a.Year), int64(b.Year))
+	case "runtime":
+		return compareInt64(int64(a.Runtime), int64(b.Runtime))
+	case "deleted_at":
+		return compareInt64(unixOrZero(a.DeletedAt), unixOrZero(b.DeletedAt))
+	case "rating":
+		switch {
+		case a.Rating.Average < b.Rating.Average:
+			return -1
+		case a.Rating.Average > b.Rating.Average:
+			return 1
+		default:
+			return 0
+		}
+	case "rating_count":
+		return compareInt64(int64(a.Rating.Count), int64(b.Rating.Count))
+	case "relevance":
+		var rankA, rankB float64
+		if a.Search != nil {
+			rankA = a.Search.Rank
+		}
+		if b.Search != nil {
+			rankB = b.Search.Rank
+		}
+		switch {
+		case rankA < rankB:
+			return -1
+		case rankA > rankB:
+			return 1
+		default:
+			return 0
+		}
+	default:
+		panic("unsupported sort column: " + column)
+	}
+}
+
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// searchTerms splits a string into lowercased words, which is roughly what the 'simple'
+// text search configuration does in PostgreSQL.
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// matchesSearch approximates to_tsvector('simple', title) @@ plainto_tsquery('simple',
+// query): every word in the query must appear as a word in the title.
+func matchesSearch(title, query string) bool {
+	queryTerms := searchTerms(query)
+	if len(queryTerms) == 0 {
+		return false
+	}
+	titleTerms := make(map[string]bool)
+	for _, term := range searchTerms(title) {
+		titleTerms[term] = true
+	}
+	for _, term := range queryTerms {
+		if !titleTerms[term] {
+			return false
+		}
+	}
+	return true
+}
+
+// memorySearchHit approximates ts_rank() and ts_headline() for a video which matches a
+// search query. Title matches are weighted more heavily than description matches, like
+// the 'A' and 'B' weights on search_vector, and every matching word is wrapped in <b>
+// tags. Unlike ts_headline() the description is never cut down to fragments.
+func memorySearchHit(video *Video, query string) *SearchHit {
+	terms := make(map[string]bool)
+	for _, term := range searchTerms(query) {
+		terms[term] = true
+	}
+	hit := &SearchHit{}
+	hit.Title, hit.Rank = highlightTerms(video.Title, terms, 1.0)
+	description, rank := highlightTerms(video.Description, terms, 0.4)
+	hit.Description = description
+	hit.Rank += rank
+	return hit
+}
+
+// highlightTerms wraps each word of s which is in terms with <b> tags, returning the
+// highlighted string and the number of matching words multiplied by weight.
+func highlightTerms(s string, terms map[string]bool, weight float64) (string, float64) {
+	var b strings.Builder
+	var rank float64
+	isWordRune := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && isWordRune(runes[j]) {
+			j++
+		}
+		word := string(runes[i:j])
+		if terms[strings.ToLower(word)] {
+			b.WriteString("<b>" + word + "</b>")
+			rank += weight
+		} else {
+			b.WriteString(word)
+		}
+		i = j
+	}
+	return b.String(), rank
+}
+
+// matches is the in-memory equivalent of VideoFilter.sqlConditions(). credits holds the
+// credits for every video, keyed by video ID.
+func (f VideoFilter) matches(video *Video, credits map[int64][]*Credit) bool {
+	if (video.DeletedAt != nil) != f.Trashed {
+		return false
+	}
+	if f.Title != "" && !matchesSearch(video.Title, f.Title) {
+		return false
+	}
+	// The search query is matched against the title and description together. This
+	// ignores the websearch_to_tsquery() operators and stemming, but is close enough for
+	// running without a database.
+	if f.Search != "" && !matchesSearch(video.Title+" "+video.Description, f.Search) {
+		return false
+	}
+	if len(f.Genres) > 0 {
+		switch f.GenresMode {
+		case GenresModeAny:
+			if !containsAny(video.Genres, f.Genres) {
+				return false
+			}
+		case GenresModeNone:
+			if containsAny(video.Genres, f.Genres) {
+				return false
+			}
+		default:
+			if !containsAll(video.Genres, f.Genres) {
+				return false
+			}
+		}
+	}
+	switch {
+	case f.YearMin != 0 && video.Year < f.YearMin,
+		f.YearMax != 0 && video.Year > f.YearMax,
+		f.RuntimeMin != 0 && video.Runtime < f.RuntimeMin,
+		f.RuntimeMax != 0 && video.Runtime > f.RuntimeMax,
+		!f.CreatedAfter.IsZero() && !video.CreatedAt.After(f.CreatedAfter),
+		!f.CreatedBefore.IsZero() && !video.CreatedAt.Before(f.CreatedBefore):
+		return false
+	}
+	for _, id := range f.ExcludeIDs {
+		if video.ID == id {
+			return false
+		}
+	}
+	if f.PersonID != 0 {
+		credited := false
+		for _, credit := range credits[video.ID] {
+			if credit.PersonID == f.PersonID && (f.PersonRole == "" || credit.Role == f.PersonRole) {
+				credited = true
+				break
+			}
+		}
+		if !credited {
+			return false
+		}
+	}
+	return true
+}
+
+// containsAny reports whether values and other have at least one element in common,
+// like the && array operator.
+func containsAny(values, other []string) bool {
+	for _, s := range other {
+		for _, v := range values {
+			if v == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsAll reports whether values contains every element of subset, like the @>
+// array operator.
+func containsAll(values, subset []string) bool {
+	for _, s := range subset {
+		found := false
+		for _, v := range values {
+			if v == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type memoryUserModel struct {
+	store *memoryStore
+}
+
+func copyUser(user *User) *User {
+	dup := *user
+	dup.Password.plaintext = nil
+	return &dup
+}
+
+// findUserByEmail looks up a user with a case-insensitive match, matching the citext
+// email column. The caller must hold the store mutex.
+func (s *memoryStore) findUserByEmail(email string) *User {
+	for _, user := range s.users {
+		if strings.EqualFold(user.Email, email) {
+			return user
+		}
+	}
+	return nil
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if m.store.findUserByEmail(user.Email) != nil {
+		return ErrDuplicateEmail
+	}
+	m.store.nextUserID++
+	user.ID = m.store.nextUserID
+	user.CreatedAt = time.Now().Truncate(time.Second)
+	user.Version = 1
+	m.store.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (m memoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	user, ok := m.store.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	user := m.store.findUserByEmail(email)
+	if user == nil {
+		return nil, ErrRecordNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	return m.store.updateUser(user)
+}
+
+// updateUser is the body of Update(). The caller must hold the store mutex.
+func (s *memoryStore) updateUser(user *User) error {
+	if other := s.findUserByEmail(user.Email); other != nil && other.ID != user.ID {
+		return ErrDuplicateEmail
+	}
+	existing, ok := s.users[user.ID]
+	if !ok || existing.Version != user.Version {
+		return ErrEditConflict
+	}
+	user.Version++
+	stored := copyUser(user)
+	stored.CreatedAt = existing.CreatedAt
+	s.users[user.ID] = stored
+	return nil
+}
+
+func (m memoryUserModel) ResetPassword(ctx context.Context, user *User, revocation *Revocation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if err := m.store.updateUser(user); err != nil {
+		return err
+	}
+	for key, token := range m.store.tokens {
+		if token.UserID == user.ID && (token.Scope == ScopePasswordReset || token.Scope == ScopeRefresh || token.Scope == ScopeAuthentication) {
+			delete(m.store.tokens, key)
+		}
+	}
+	if revocation != nil {
+		m.store.insertRevocation(revocation)
+	}
+	return nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	token, ok := m.store.tokens[string(tokenHash[:])]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	user, ok := m.store.users[token.UserID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyUser(user), nil
+}
+
+type memoryTokenModel struct {
+	store *memoryStore
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	token, err := GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) Insert(ctx context.Context, tokens ...*Token) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	// Enforce the same constraints as the tokens table: the hash is the primary key
+	// and user_id references the users table. Every token is checked before any of them
+	// is saved, so that they're all or nothing like the SQL transaction.
+	hashes := make(map[string]bool)
+	for _, token := range tokens {
+		if _, ok := m.store.users[token.UserID]; !ok {
+			return fmt.Errorf("data: token references unknown user %d", token.UserID)
+		}
+		key := string(token.Hash)
+		if _, exists := m.store.tokens[key]; exists || hashes[key] {
+			return fmt.Errorf("data: duplicate token hash")
+		}
+		hashes[key] = true
+	}
+	for _, token := range tokens {
+		stored := *token
+		stored.Plaintext = ""
+		stored.Expiry = token.Expiry.Truncate(time.Second)
+		stored.UserAgent = truncateUserAgent(token.UserAgent)
+		m.store.tokens[string(token.Hash)] = &stored
+	}
+	return nil
+}
+
+func (m memoryTokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	token, ok := m.store.tokens[string(tokenHash[:])]
+	if !ok || token.Scope != scope {
+		return nil
+	}
+	delete(m.store.tokens, string(tokenHash[:]))
+	if token.Family != "" {
+		m.store.deleteTokenFamily(token.Family)
+	}
+	return nil
+}
+
+// deleteTokenFamily deletes every token in the family. The caller must hold the store
+// mutex.
+func (s *memoryStore) deleteTokenFamily(family string) {
+	for key, token := range s.tokens {
+		if token.Family == family {
+			delete(s.tokens, key)
+		}
+	}
+}
+
+func (m memoryTokenModel) DeleteFamily(ctx context.Context, family string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if family == "" {
+		return nil
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.deleteTokenFamily(family)
+	return nil
+}
+
+func (m memoryTokenModel) Refresh(ctx context.Context, tokenPlaintext string, reuse *Revocation, tokens ...*Token) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	refresh, ok := m.store.tokens[string(tokenHash[:])]
+	if !ok || refresh.Scope != ScopeRefresh || !refresh.Expiry.After(time.Now()) {
+		return ErrRecordNotFound
+	}
+	if refresh.UsedAt != nil {
+		m.store.deleteTokenFamily(refresh.Family)
+		if reuse != nil {
+			reuse.UserID, reuse.Family = refresh.UserID, refresh.Family
+			m.store.insertRevocation(reuse)
+		}
+		return ErrRefreshTokenReused
+	}
+	for _, token := range tokens {
+		if _, exists := m.store.tokens[string(token.Hash)]; exists {
+			return fmt.Errorf("data: duplicate token hash")
+		}
+	}
+	now := time.Now().Truncate(time.Second)
+	refresh.UsedAt = &now
+	for _, token := range tokens {
+		token.UserID, token.Family = refresh.UserID, refresh.Family
+		stored := *token
+		stored.Plaintext = ""
+		stored.Expiry = token.Expiry.Truncate(time.Second)
+		stored.UserAgent = truncateUserAgent(token.UserAgent)
+		m.store.tokens[string(token.Hash)] = &stored
+	}
+	return nil
+}
+
+func (m memoryTokenModel) Touch(ctx context.Context, tokenPlaintext, clientIP, userAgent string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	token, ok := m.store.tokens[string(tokenHash[:])]
+	if !ok {
+		return nil
+	}
+	now := time.Now().Truncate(time.Second)
+	token.LastUsedAt = &now
+	token.ClientIP, token.UserAgent = clientIP, truncateUserAgent(userAgent)
+	return nil
+}
+
+func (m memoryTokenModel) GetSessions(ctx context.Context, userID int64) ([]*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	sessions := []*Session{}
+	now := time.Now()
+	for _, token := range m.store.tokens {
+		if token.UserID != userID || token.Scope != ScopeAuthentication || !token.Expiry.After(now) {
+			continue
+		}
+		session := &Session{
+			Hash:      token.Hash,
+			CreatedAt: token.CreatedAt,
+			Expiry:    token.Expiry,
+			ClientIP:  token.ClientIP,
+			UserAgent: token.UserAgent,
+		}
+		if token.LastUsedAt != nil {
+			lastUsedAt := *token.LastUsedAt
+			session.LastUsedAt = &lastUsedAt
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+		}
+		return bytes.Compare(sessions[i].Hash, sessions[j].Hash) < 0
+	})
+	return sessions, nil
+}
+
+func (m memoryTokenModel) GetRefreshSessions(ctx context.Context, userID int64) ([]*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	// Find when each family started and was last exchanged, then describe it by its
+	// current refresh token.
+	started := make(map[string]time.Time)
+	used := make(map[string]time.Time)
+	for _, token := range m.store.tokens {
+		if token.UserID != userID || token.Scope != ScopeRefresh {
+			continue
+		}
+		if first, ok := started[token.Family]; !ok || token.CreatedAt.Before(first) {
+			started[token.Family] = token.CreatedAt
+		}
+		if token.UsedAt != nil && token.UsedAt.After(used[token.Family]) {
+			used[token.Family] = *token.UsedAt
+		}
+	}
+	sessions := []*Session{}
+	now := time.Now()
+	for _, token := range m.store.tokens {
+		if token.UserID != userID || token.Scope != ScopeRefresh || token.UsedAt != nil || !token.Expiry.After(now) {
+			continue
+		}
+		session := &Session{
+			Hash:      token.Hash,
+			Family:    token.Family,
+			CreatedAt: started[token.Family],
+			Expiry:    token.Expiry,
+			ClientIP:  token.ClientIP,
+			UserAgent: token.UserAgent,
+		}
+		if lastUsedAt, ok := used[token.Family]; ok {
+			session.LastUsedAt = &lastUsedAt
+		}
+		sessions = append(sessions, session)
+	}
+	// Sort by when the sessions were last used, most recent first, like the SQL.
+	refreshed := func(s *Session) time.Time {
+		if s.LastUsedAt != nil {
+			return *s.LastUsedAt
+		}
+		return s.CreatedAt
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if a, b := refreshed(sessions[i]), refreshed(sessions[j]); !a.Equal(b) {
+			return a.After(b)
+		}
+		return bytes.Compare(sessions[i].Hash, sessions[j].Hash) < 0
+	})
+	return sessions, nil
+}
+
+func (m memoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	for key, token := range m.store.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			delete(m.store.tokens, key)
+		}
+	}
+	return nil
+}
+
+type memoryPermissionModel struct {
+	store *memoryStore
+}
+
+func (m memoryPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	var permissions Permissions
+	permissions = append(permissions, m.store.userPermissions[userID]...)
+	return permissions, nil
+}
+
+func (m memoryPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	if _, ok := m.store.users[userID]; !ok {
+		return fmt.Errorf("data: permissions reference unknown user %d", userID)
+	}
+	granted := Permissions(m.store.userPermissions[userID])
+	for _, code := range codes {
+		// Unknown codes are silently skipped, because the SQL version selects from the
+		// permissions table and so simply inserts nothing for them.
+		if !m.store.permissionCodes[code] {
+			continue
+		}
+		if granted.Include(code) {
+			return fmt.Errorf("data: user %d already has permission %q", userID, code)
+		}
+		granted = append(granted, code)
+	}
+	m.store.userPermissions[userID] = granted
+	return nil
+}
+
+type memoryRevocationModel struct {
+	store *memoryStore
+}
+
+func (m memoryRevocationModel) Insert(ctx context.Context, revocation *Revocation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	m.store.insertRevocation(revocation)
+	return nil
+}
+
+// insertRevocation is the body of Insert(). The caller must hold the store mutex.
+func (s *memoryStore) insertRevocation(revocation *Revocation) {
+	if revocation.RevokedAt.IsZero() {
+		revocation.RevokedAt = time.Now()
+	}
+	stored := *revocation
+	s.revocations = append(s.revocations, &stored)
+}
+
+func (m memoryRevocationModel) GetActive(ctx context.Context) ([]*Revocation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.store.mu.RLock()
+	defer m.store.mu.RUnlock()
+	now := time.Now()
+	revocations := []*Revocation{}
+	for _, revocation := range m.store.revocations {
+		if revocation.Expiry.After(now) {
+			r := *revocation
+			revocations = append(revocations, &r)
+		}
+	}
+	return revocations, nil
+}
+
+func (m memoryRevocationModel) DeleteExpired(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+	now := time.Now()
+	active := m.store.revocations[:0]
+	for _, revocation := range m.store.revocations {
+		if revocation.Expiry.After(now) {
+			active = append(active, revocation)
+		}
+	}
+	m.store.revocations = active
+	return nil
+}
@@ -0,0 +1,860 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newMemoryVideo(t *testing.T, models Models, title string, year int32) *Video {
+	t.Helper()
+	video := &Video{Title: title, Language: "english", Year: year, Runtime: 100, Genres: []string{"drama"}}
+	if err := models.Videos.Insert(context.Background(), video, 1); err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+func TestMemoryVideoWrites(t *testing.T) {
+	tests := []struct {
+		name string
+		// write changes the video, which is at version 1 beforehand.
+		write       func(ctx context.Context, models Models, video *Video) error
+		wantErr     error
+		wantVersion int32
+		wantDeleted bool
+	}{
+		{
+			name: "Update",
+			write: func(ctx context.Context, models Models, video *Video) error {
+				video.Title = "Updated"
+				return models.Videos.Update(ctx, video, 1)
+			},
+			wantVersion: 2,
+		},
+		{
+			name: "Update stale version",
+			write: func(ctx context.Context, models Models, video *Video) error {
+				video.Version = 7
+				return models.Videos.Update(ctx, video, 1)
+			},
+			wantErr:     ErrEditConflict,
+			wantVersion: 1,
+		},
+		{
+			name: "Update breaking a constraint",
+			write: func(ctx context.Context, models Models, video *Video) error {
+				video.Genres = nil
+				return models.Videos.Update(ctx, video, 1)
+			},
+			wantErr:     &ConstraintError{},
+			wantVersion: 1,
+		},
+		{
+			// The genre was resolved before it was deleted, so the write has to catch it.
+			name: "Update with a deleted genre",
+			write: func(ctx context.Context, models Models, video *Video) error {
+				genre := &Genre{Slug: "cult", Name: "Cult", Aliases: []string{}}
+				if err := models.Genres.Insert(ctx, genre); err != nil {
+					return err
+				}
+				if err := models.Genres.Delete(ctx, genre.ID); err != nil {
+					return err
+				}
+				video.Genres = append(video.Genres, genre.Slug)
+				return models.Videos.Update(ctx, video, 1)
+			},
+			wantErr:     &ConstraintError{},
+			wantVersion: 1,
+		},
+		{
+			name: "Delete",
+			write: func(ctx context.Context, models Models, video *Video) error {
+				return models.Videos.Delete(ctx, video.ID, video.Version, 1)
+			},
+			wantVersion: 2,
+			wantDeleted: true,
+		},
+		{
+			name: "Delete without version",
+			write: func(ctx context.Context, models Models, video *Video) error {
+				return models.Videos.Delete(ctx, video.ID, 0, 1)
+			},
+			wantVersion: 2,
+			wantDeleted: true,
+		},
+		{
+			name: "Delete stale version",
+			write: func(ctx context.Context, models Models, video *Video) error {
+				return models.Videos.Delete(ctx, video.ID, 7, 1)
+			},
+			wantErr:     ErrEditConflict,
+			wantVersion: 1,
+		},
+		{
+			name: "Delete missing",
+			write: func(ctx context.Context, models Models, video *Video) error {
+				return models.Videos.Delete(ctx, video.ID+1, 0, 1)
+			},
+			wantErr:     ErrRecordNotFound,
+			wantVersion: 1,
+		},
+		{
+			name: "Delete then restore",
+			write: func(ctx context.Context, models Models, video *Video) error {
+				if err := models.Videos.Delete(ctx, video.ID, 1, 1); err != nil {
+					return err
+				}
+				_, err := models.Videos.Restore(ctx, video.ID, 1)
+				return err
+			},
+			wantVersion: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			models := NewMemoryModels()
+			video := newMemoryVideo(t, models, "Original", 2001)
+
+			err := tt.write(ctx, models, video)
+			var constraintErr *ConstraintError
+			switch {
+			case errors.As(tt.wantErr, &constraintErr):
+				if !errors.As(err, &constraintErr) {
+					t.Fatalf("got error %v; want a constraint error", err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+
+			stored, err := models.Videos.Get(ctx, video.ID)
+			if tt.wantDeleted {
+				if !errors.Is(err, ErrRecordNotFound) {
+					t.Fatalf("got error %v for the deleted video; want %v", err, ErrRecordNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Version != tt.wantVersion {
+				t.Errorf("got version %d; want %d", stored.Version, tt.wantVersion)
+			}
+			revisions, _, err := models.Revisions.GetAllForVideo(ctx, video.ID, Filters{Page: 1, PageSize: 20, Sort: "version", SortSafelist: []string{"version"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(revisions) != int(tt.wantVersion) {
+				t.Errorf("got %d revisions; want %d", len(revisions), tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestMemoryVideoPurge(t *testing.T) {
+	tests := []struct {
+		name string
+		// cutoff is the deletedBefore time, relative to when the video was deleted.
+		cutoff      time.Duration
+		wantPurged  int64
+		wantPosters []string
+	}{
+		{"Deleted after the cutoff", -time.Hour, 0, []string{}},
+		{"Deleted before the cutoff", time.Hour, 1, []string{"posters/1/original.png"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			models := NewMemoryModels()
+			trashed := newMemoryVideo(t, models, "Trashed", 2001)
+			live := newMemoryVideo(t, models, "Live", 2001)
+			if _, err := models.Videos.SetPoster(ctx, trashed.ID, "posters/1/original.png"); err != nil {
+				t.Fatal(err)
+			}
+			if err := models.Videos.Delete(ctx, trashed.ID, 0, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			posters, purged, err := models.Videos.Purge(ctx, time.Now().Add(tt.cutoff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != tt.wantPurged || !reflect.DeepEqual(posters, tt.wantPosters) {
+				t.Errorf("got %d purged with posters %v; want %d with %v", purged, posters, tt.wantPurged, tt.wantPosters)
+			}
+			// A purged video can't be restored, and live videos are never purged.
+			_, err = models.Videos.Restore(ctx, trashed.ID, 1)
+			if restored := err == nil; restored == (tt.wantPurged == 1) {
+				t.Errorf("got restore error %v after purging %d", err, purged)
+			}
+			if _, err := models.Videos.Get(ctx, live.ID); err != nil {
+				t.Errorf("got error %v for the live video", err)
+			}
+		})
+	}
+}
+
+func TestMemoryVideoGetAllSort(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels()
+	newMemoryVideo(t, models, "Bravo", 2001)
+	newMemoryVideo(t, models, "Alpha", 2010)
+	newMemoryVideo(t, models, "Charlie", 2001)
+
+	tests := []struct {
+		sort string
+		want []string
+	}{
+		{"id", []string{"Bravo", "Alpha", "Charlie"}},
+		{"-id", []string{"Charlie", "Alpha", "Bravo"}},
+		{"title", []string{"Alpha", "Bravo", "Charlie"}},
+		{"-title", []string{"Charlie", "Bravo", "Alpha"}},
+		// Ties are broken by ID, in ascending order whichever way the sort goes.
+		{"year", []string{"Bravo", "Charlie", "Alpha"}},
+		{"-year", []string{"Alpha", "Bravo", "Charlie"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			filters := Filters{Page: 1, PageSize: 20, Sort: tt.sort, SortSafelist: []string{tt.sort}}
+			videos, metadata, err := models.Videos.GetAll(ctx, VideoFilter{}, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metadata.TotalRecords != len(tt.want) {
+				t.Errorf("got %d total records; want %d", metadata.TotalRecords, len(tt.want))
+			}
+			var got []string
+			for _, video := range videos {
+				got = append(got, video.Title)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v; want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v; want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// Paging forwards by next_cursor and then backwards by prev_cursor must visit every
+// video exactly once, in the same order as a single page, even when sort values tie.
+func TestMemoryVideoGetAllCursor(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels()
+	newMemoryVideo(t, models, "Echo", 2001)
+	newMemoryVideo(t, models, "Alpha", 2010)
+	newMemoryVideo(t, models, "Delta", 2001)
+	newMemoryVideo(t, models, "Charlie", 1999)
+	newMemoryVideo(t, models, "Bravo", 2001)
+
+	tests := []struct {
+		sort string
+		want []string
+	}{
+		{"title", []string{"Alpha", "Bravo", "Charlie", "Delta", "Echo"}},
+		{"-title", []string{"Echo", "Delta", "Charlie", "Bravo", "Alpha"}},
+		// Ties are broken by ID.
+		{"year", []string{"Charlie", "Echo", "Delta", "Bravo", "Alpha"}},
+		{"-year", []string{"Alpha", "Echo", "Delta", "Bravo", "Charlie"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			getPage := func(after string) ([]string, Metadata) {
+				t.Helper()
+				filters := Filters{PageSize: 2, Sort: tt.sort, SortSafelist: []string{tt.sort}, CursorMode: true, Cursor: after}
+				videos, metadata, err := models.Videos.GetAll(ctx, VideoFilter{}, filters)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var titles []string
+				for _, video := range videos {
+					titles = append(titles, video.Title)
+				}
+				return titles, metadata
+			}
+
+			var pages [][]string
+			var got []string
+			after := ""
+			for {
+				titles, metadata := getPage(after)
+				if (after == "") != (metadata.PrevCursor == "") {
+					t.Errorf("got prev_cursor %q after %q", metadata.PrevCursor, after)
+				}
+				pages = append(pages, titles)
+				got = append(got, titles...)
+				if metadata.NextCursor == "" {
+					break
+				}
+				after = metadata.NextCursor
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("got %v paging forwards; want %v", got, tt.want)
+			}
+
+			// Go back from the last page to the first.
+			_, metadata := getPage(after)
+			for i := len(pages) - 2; i >= 0; i-- {
+				if metadata.PrevCursor == "" {
+					t.Fatalf("got no prev_cursor before page %d", i+1)
+				}
+				var titles []string
+				titles, metadata = getPage(metadata.PrevCursor)
+				if strings.Join(titles, ",") != strings.Join(pages[i], ",") {
+					t.Errorf("got %v paging backwards to page %d; want %v", titles, i, pages[i])
+				}
+				if metadata.NextCursor == "" {
+					t.Errorf("got no next_cursor paging backwards to page %d", i)
+				}
+			}
+			if metadata.PrevCursor != "" {
+				t.Errorf("got prev_cursor %q on the first page", metadata.PrevCursor)
+			}
+		})
+	}
+
+	t.Run("Tampered value", func(t *testing.T) {
+		after := encodeCursor(cursor{Sort: "year", Value: "not a year", ID: 1})
+		filters := Filters{PageSize: 2, Sort: "year", SortSafelist: []string{"year"}, CursorMode: true, Cursor: after}
+		_, _, err := models.Videos.GetAll(ctx, VideoFilter{}, filters)
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("got error %v; want %v", err, ErrInvalidCursor)
+		}
+	})
+}
+
+func TestMemoryVideoGetFacets(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels()
+	for _, video := range []*Video{
+		{Title: "Alpha", Year: 1994, Runtime: 85, Genres: []string{"drama", "crime"}},
+		{Title: "Bravo", Year: 1999, Runtime: 136, Genres: []string{"sci-fi", "action"}},
+		{Title: "Charlie", Year: 2003, Runtime: 201, Genres: []string{"fantasy", "drama"}},
+		{Title: "Delta", Year: 2010, Runtime: 90, Genres: []string{"drama"}},
+		{Title: "Echo", Year: 2015, Runtime: 119, Genres: []string{"comedy"}},
+	} {
+		video.Language = "english"
+		if err := models.Videos.Insert(ctx, video, 1); err != nil {
+			t.Fatal(err)
+		}
+		// Videos in the trash aren't counted.
+		if video.Title == "Echo" {
+			if err := models.Videos.Delete(ctx, video.ID, 0, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name        string
+		filter      VideoFilter
+		wantTotal   int
+		wantGenres  []FacetCount
+		wantDecades []FacetCount
+		// wantRuntimes holds the count for each of RuntimeBuckets.
+		wantRuntimes []int
+	}{
+		{
+			name:      "Everything",
+			wantTotal: 4,
+			// Ties are ordered by name.
+			wantGenres:   []FacetCount{{"drama", 3}, {"action", 1}, {"crime", 1}, {"fantasy", 1}, {"sci-fi", 1}},
+			wantDecades:  []FacetCount{{"1990s", 2}, {"2000s", 1}, {"2010s", 1}},
+			wantRuntimes: []int{1, 1, 1, 1},
+		},
+		{
+			name:         "Filtered by genre",
+			filter:       VideoFilter{Genres: []string{"drama"}, GenresMode: GenresModeAll},
+			wantTotal:    3,
+			wantGenres:   []FacetCount{{"drama", 3}, {"crime", 1}, {"fantasy", 1}},
+			wantDecades:  []FacetCount{{"1990s", 1}, {"2000s", 1}, {"2010s", 1}},
+			wantRuntimes: []int{1, 1, 0, 1},
+		},
+		{
+			name:         "Filtered by year",
+			filter:       VideoFilter{YearMin: 2000},
+			wantTotal:    2,
+			wantGenres:   []FacetCount{{"drama", 2}, {"fantasy", 1}},
+			wantDecades:  []FacetCount{{"2000s", 1}, {"2010s", 1}},
+			wantRuntimes: []int{0, 1, 0, 1},
+		},
+		{
+			name:         "No matches",
+			filter:       VideoFilter{YearMax: 1900},
+			wantGenres:   []FacetCount{},
+			wantDecades:  []FacetCount{},
+			wantRuntimes: []int{0, 0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			facets, err := models.Videos.GetFacets(ctx, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if facets.TotalRecords != tt.wantTotal {
+				t.Errorf("got total %d; want %d", facets.TotalRecords, tt.wantTotal)
+			}
+			if !reflect.DeepEqual(facets.Genres, tt.wantGenres) {
+				t.Errorf("got genres %v; want %v", facets.Genres, tt.wantGenres)
+			}
+			if !reflect.DeepEqual(facets.Decades, tt.wantDecades) {
+				t.Errorf("got decades %v; want %v", facets.Decades, tt.wantDecades)
+			}
+			var runtimes []int
+			for i, bucket := range facets.Runtimes {
+				if bucket.Value != RuntimeBuckets[i].Label {
+					t.Errorf("got runtime bucket %q at %d; want %q", bucket.Value, i, RuntimeBuckets[i].Label)
+				}
+				runtimes = append(runtimes, bucket.Count)
+			}
+			if !reflect.DeepEqual(runtimes, tt.wantRuntimes) {
+				t.Errorf("got runtime counts %v; want %v", runtimes, tt.wantRuntimes)
+			}
+		})
+	}
+}
+
+func TestMemoryCredits(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels()
+	alpha := newMemoryVideo(t, models, "Alpha", 2001)
+	bravo := newMemoryVideo(t, models, "Bravo", 2002)
+	newMemoryVideo(t, models, "Charlie", 2003)
+	var people []*Person
+	for _, name := range []string{"Ann Director", "Bob Actor", "Uncredited"} {
+		person := &Person{Name: name}
+		if err := models.People.Insert(ctx, person); err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, person)
+	}
+	director, actor, uncredited := people[0], people[1], people[2]
+
+	credits := map[int64][]*Credit{
+		// Listed out of order, to check that they're sorted by billing order.
+		alpha.ID: {
+			{PersonID: actor.ID, Role: RoleCast, Character: "Hero", BillingOrder: 2},
+			{PersonID: director.ID, Role: RoleDirector, BillingOrder: 1},
+		},
+		bravo.ID: {
+			{PersonID: director.ID, Role: RoleCast, Character: "Cameo", BillingOrder: 1},
+		},
+	}
+	for videoID, list := range credits {
+		if err := models.Credits.ReplaceForVideo(ctx, videoID, list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := models.Credits.GetForVideo(ctx, alpha.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].PersonName != "Ann Director" || got[1].PersonName != "Bob Actor" {
+		t.Errorf("got credits %+v; want Ann Director then Bob Actor", got)
+	}
+
+	t.Run("Filter", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			filter VideoFilter
+			want   []string
+		}{
+			{"Any role", VideoFilter{PersonID: director.ID}, []string{"Alpha", "Bravo"}},
+			{"Director", VideoFilter{PersonID: director.ID, PersonRole: RoleDirector}, []string{"Alpha"}},
+			{"Cast", VideoFilter{PersonID: director.ID, PersonRole: RoleCast}, []string{"Bravo"}},
+			{"Role not played", VideoFilter{PersonID: actor.ID, PersonRole: RoleWriter}, nil},
+			{"Uncredited", VideoFilter{PersonID: uncredited.ID}, nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: []string{"id"}}
+				videos, _, err := models.Videos.GetAll(ctx, tt.filter, filters)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var titles []string
+				for _, video := range videos {
+					titles = append(titles, video.Title)
+				}
+				if strings.Join(titles, ",") != strings.Join(tt.want, ",") {
+					t.Errorf("got %v; want %v", titles, tt.want)
+				}
+			})
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			write   func() error
+			wantErr error
+		}{
+			{
+				name: "Unknown person",
+				write: func() error {
+					return models.Credits.ReplaceForVideo(ctx, alpha.ID, []*Credit{{PersonID: 99, Role: RoleCrew}})
+				},
+				wantErr: ErrUnknownPerson,
+			},
+			{
+				name: "Unknown video",
+				write: func() error {
+					return models.Credits.ReplaceForVideo(ctx, 99, []*Credit{{PersonID: actor.ID, Role: RoleCrew}})
+				},
+				wantErr: ErrRecordNotFound,
+			},
+			{
+				name:    "Deleting a credited person",
+				write:   func() error { return models.People.Delete(ctx, actor.ID) },
+				wantErr: ErrPersonCredited,
+			},
+			{
+				name:  "Deleting an uncredited person",
+				write: func() error { return models.People.Delete(ctx, uncredited.ID) },
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if err := tt.write(); !errors.Is(err, tt.wantErr) {
+					t.Errorf("got error %v; want %v", err, tt.wantErr)
+				}
+			})
+		}
+		// A failed replacement leaves the old credits in place.
+		if got, err := models.Credits.GetForVideo(ctx, alpha.ID); err != nil || len(got) != 2 {
+			t.Errorf("got %d credits and error %v after the failed writes; want 2", len(got), err)
+		}
+	})
+}
+
+func TestMemoryWatchlistPurge(t *testing.T) {
+	tests := []struct {
+		name string
+		// trashed is the index of the video moved to the trash, of the four on the list.
+		trashed       int
+		purge         bool
+		wantPositions []int32
+		wantAdded     int32
+	}{
+		// A trashed video keeps its place, in case it's restored.
+		{"Trashed", 1, false, []int32{1, 3, 4}, 5},
+		{"Purged first", 0, true, []int32{1, 2, 3}, 4},
+		{"Purged from the middle", 1, true, []int32{1, 2, 3}, 4},
+		{"Purged last", 3, true, []int32{1, 2, 3}, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			models := NewMemoryModels()
+			var videos []*Video
+			for _, title := range []string{"Alpha", "Bravo", "Charlie", "Delta"} {
+				video := newMemoryVideo(t, models, title, 2001)
+				if err := models.Watchlists.Add(ctx, 1, &WatchlistItem{List: DefaultWatchlist, VideoID: video.ID}); err != nil {
+					t.Fatal(err)
+				}
+				videos = append(videos, video)
+			}
+			if err := models.Videos.Delete(ctx, videos[tt.trashed].ID, 0, 1); err != nil {
+				t.Fatal(err)
+			}
+			if tt.purge {
+				if _, _, err := models.Videos.Purge(ctx, time.Now().Add(time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			items, err := models.Watchlists.GetItems(ctx, 1, DefaultWatchlist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var positions []int32
+			for _, item := range items {
+				positions = append(positions, item.Position)
+			}
+			if !reflect.DeepEqual(positions, tt.wantPositions) {
+				t.Errorf("got positions %v; want %v", positions, tt.wantPositions)
+			}
+			added := newMemoryVideo(t, models, "Echo", 2001)
+			item := &WatchlistItem{List: DefaultWatchlist, VideoID: added.ID}
+			if err := models.Watchlists.Add(ctx, 1, item); err != nil {
+				t.Fatal(err)
+			}
+			if item.Position != tt.wantAdded {
+				t.Errorf("got position %d for the added video; want %d", item.Position, tt.wantAdded)
+			}
+		})
+	}
+}
+
+func TestMemoryTokenRefresh(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup stores the refresh token with the given TTL, and returns the plaintext
+		// to exchange.
+		ttl         time.Duration
+		setup       func(t *testing.T, models Models, refresh *Token) string
+		wantErr     error
+		wantRevoked bool
+	}{
+		{
+			name:  "Valid",
+			ttl:   time.Hour,
+			setup: func(t *testing.T, models Models, refresh *Token) string { return refresh.Plaintext },
+		},
+		{
+			name: "Reused",
+			ttl:  time.Hour,
+			setup: func(t *testing.T, models Models, refresh *Token) string {
+				if err := models.Tokens.Refresh(context.Background(), refresh.Plaintext, nil); err != nil {
+					t.Fatal(err)
+				}
+				return refresh.Plaintext
+			},
+			wantErr:     ErrRefreshTokenReused,
+			wantRevoked: true,
+		},
+		{
+			name:    "Unknown",
+			ttl:     time.Hour,
+			setup:   func(t *testing.T, models Models, refresh *Token) string { return "ABCDEFGHIJKLMNOPQRSTUVWXYZ" },
+			wantErr: ErrRecordNotFound,
+		},
+		{
+			name:    "Expired",
+			ttl:     -time.Minute,
+			setup:   func(t *testing.T, models Models, refresh *Token) string { return refresh.Plaintext },
+			wantErr: ErrRecordNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			models := NewMemoryModels()
+			user := &User{Name: "Alice", Email: "alice@example.com"}
+			if err := models.Users.Insert(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			refresh, err := GenerateToken(user.ID, tt.ttl, ScopeRefresh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refresh.Family = "family"
+			if err := models.Tokens.Insert(ctx, refresh); err != nil {
+				t.Fatal(err)
+			}
+			plaintext := tt.setup(t, models, refresh)
+
+			next, err := GenerateToken(0, time.Hour, ScopeRefresh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reuse := &Revocation{Expiry: time.Now().Add(time.Hour)}
+			err = models.Tokens.Refresh(ctx, plaintext, reuse, next)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+
+			// A successful refresh stores the new token in the same family; reuse
+			// deletes the whole family.
+			_, err = models.Users.GetForToken(ctx, ScopeRefresh, next.Plaintext)
+			if stored := err == nil; stored != (tt.wantErr == nil) {
+				t.Errorf("got new token stored %t; want %t", stored, tt.wantErr == nil)
+			}
+			if tt.wantErr == nil && (next.UserID != user.ID || next.Family != "family") {
+				t.Errorf("got user %d and family %q for the new token; want %d and %q", next.UserID, next.Family, user.ID, "family")
+			}
+			_, err = models.Users.GetForToken(ctx, ScopeRefresh, refresh.Plaintext)
+			if kept := err == nil; kept != (tt.ttl > 0 && !tt.wantRevoked) {
+				t.Errorf("got old token kept %t; want %t", kept, tt.ttl > 0 && !tt.wantRevoked)
+			}
+			revocations, err := models.Revocations.GetActive(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotRevoked := len(revocations) == 1 && revocations[0].Family == "family" && revocations[0].UserID == user.ID
+			if gotRevoked != tt.wantRevoked || (!tt.wantRevoked && len(revocations) != 0) {
+				t.Errorf("got revocations %+v; want the family revoked %t", revocations, tt.wantRevoked)
+			}
+		})
+	}
+}
+
+// Tokens inserted together are all or nothing, so a refresh token is never saved without
+// the authentication token issued with it.
+func TestMemoryTokenInsert(t *testing.T) {
+	tests := []struct {
+		name string
+		// second returns the token inserted along with a new refresh token.
+		second     func(t *testing.T, existing *Token) *Token
+		wantStored bool
+	}{
+		{
+			name: "New token",
+			second: func(t *testing.T, existing *Token) *Token {
+				token, err := GenerateToken(existing.UserID, time.Hour, ScopeAuthentication)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token
+			},
+			wantStored: true,
+		},
+		{
+			name:       "Duplicate hash",
+			second:     func(t *testing.T, existing *Token) *Token { return existing },
+			wantStored: false,
+		},
+		{
+			name: "Unknown user",
+			second: func(t *testing.T, existing *Token) *Token {
+				token, err := GenerateToken(existing.UserID+1, time.Hour, ScopeAuthentication)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token
+			},
+			wantStored: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			models := NewMemoryModels()
+			user := &User{Name: "Alice", Email: "alice@example.com"}
+			if err := models.Users.Insert(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			existing, err := models.Tokens.New(ctx, user.ID, time.Hour, ScopeAuthentication)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refresh, err := GenerateToken(user.ID, time.Hour, ScopeRefresh)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = models.Tokens.Insert(ctx, refresh, tt.second(t, existing))
+			if (err == nil) != tt.wantStored {
+				t.Fatalf("got error %v; want an error %t", err, !tt.wantStored)
+			}
+			_, err = models.Users.GetForToken(ctx, ScopeRefresh, refresh.Plaintext)
+			if stored := err == nil; stored != tt.wantStored {
+				t.Errorf("got refresh token stored %t; want %t", stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestMemoryUserResetPassword(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     int
+		revocation  bool
+		wantErr     error
+		wantDeleted bool
+	}{
+		{"Valid", 1, true, nil, true},
+		{"Without revocation", 1, false, nil, true},
+		{"Stale version", 7, true, ErrEditConflict, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			models := NewMemoryModels()
+			user := &User{Name: "Alice", Email: "alice@example.com", Activated: true}
+			if err := models.Users.Insert(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			plaintexts := map[string]string{}
+			for _, scope := range []string{ScopeAuthentication, ScopeRefresh, ScopePasswordReset, ScopeActivation} {
+				token, err := models.Tokens.New(ctx, user.ID, time.Hour, scope)
+				if err != nil {
+					t.Fatal(err)
+				}
+				plaintexts[scope] = token.Plaintext
+			}
+
+			user.Version = tt.version
+			var revocation *Revocation
+			if tt.revocation {
+				revocation = &Revocation{UserID: user.ID, Expiry: time.Now().Add(time.Hour)}
+			}
+			err := models.Users.ResetPassword(ctx, user, revocation)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+
+			// Every token which logs the user in, or could reset the password again, is
+			// deleted along with the change; other tokens are left alone.
+			for scope, plaintext := range plaintexts {
+				_, err := models.Users.GetForToken(ctx, scope, plaintext)
+				wantDeleted := tt.wantDeleted && scope != ScopeActivation
+				if deleted := errors.Is(err, ErrRecordNotFound); deleted != wantDeleted {
+					t.Errorf("got %s token deleted %t; want %t", scope, deleted, wantDeleted)
+				}
+			}
+			revocations, err := models.Revocations.GetActive(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.revocation && tt.wantErr == nil; (len(revocations) == 1) != want {
+				t.Errorf("got %d revocations; want a revocation %t", len(revocations), want)
+			}
+		})
+	}
+}
+
+func TestMemoryRevocations(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels()
+	now := time.Now()
+	for _, revocation := range []*Revocation{
+		{TokenID: "expired", UserID: 1, Expiry: now.Add(-time.Minute)},
+		{TokenID: "active", UserID: 1, Expiry: now.Add(time.Hour)},
+		{Family: "family", UserID: 1, Expiry: now.Add(time.Hour)},
+		{UserID: 2, RevokedAt: now.Add(-time.Second), Expiry: now.Add(time.Hour)},
+	} {
+		if err := models.Revocations.Insert(ctx, revocation); err != nil {
+			t.Fatal(err)
+		}
+		if revocation.RevokedAt.IsZero() {
+			t.Errorf("got zero RevokedAt for %+v", revocation)
+		}
+	}
+	if err := models.Revocations.DeleteExpired(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	revocations, err := models.Revocations.GetActive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 3 {
+		t.Fatalf("got %d active revocations; want 3", len(revocations))
+	}
+	for _, revocation := range revocations {
+		if revocation.TokenID == "expired" {
+			t.Errorf("got expired revocation %+v", revocation)
+		}
+		if revocation.UserID == 2 && !revocation.RevokedAt.Equal(now.Add(-time.Second)) {
+			t.Errorf("got RevokedAt %v; want %v", revocation.RevokedAt, now.Add(-time.Second))
+		}
+	}
+}
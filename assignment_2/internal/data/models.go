@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -12,22 +14,156 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
-// Create a Models struct which wraps the MovieModel. We'll add other models to this,
-// like a UserModel and PermissionModel, as our build progresses.
+// The repository interfaces describe the behaviour that the handlers in cmd/api rely on,
+// independent of where the data is actually stored. VideoModel, UserModel, TokenModel
+// and PermissionModel satisfy them using PostgreSQL, and the memory* types in memory.go
+// satisfy them using plain Go maps.
+type VideoRepository interface {
+	Insert(ctx context.Context, video *Video, userID int64) error
+	InsertBatch(ctx context.Context, videos []*Video, userID int64) error
+	Get(ctx context.Context, id int64) (*Video, error)
+	Update(ctx context.Context, video *Video, userID int64) error
+	GetAll(ctx context.Context, videoFilter VideoFilter, filters Filters) ([]*Video, Metadata, error)
+	GetFacets(ctx context.Context, videoFilter VideoFilter) (*Facets, error)
+	Suggest(ctx context.Context, query string, limit int) ([]*VideoSuggestion, error)
+	Stream(ctx context.Context, videoFilter VideoFilter, filters Filters, fn func(*Video) error) error
+	Delete(ctx context.Context, id int64, version int32, deletedBy int64) error
+	Restore(ctx context.Context, id int64, userID int64) (*Video, error)
+	Purge(ctx context.Context, deletedBefore time.Time) ([]string, int64, error)
+	ExecBatch(ctx context.Context, ops []*VideoOperation, atomic bool, userID int64) error
+	SetPoster(ctx context.Context, id int64, key string) (string, error)
+}
+
+// The video methods which change a video also record a VideoRevision, attributed to the
+// given user, and RevisionRepository reads those revisions back.
+type RevisionRepository interface {
+	GetAllForVideo(ctx context.Context, videoID int64, filters Filters) ([]*VideoRevision, Metadata, error)
+	Get(ctx context.Context, videoID int64, version int32) (*VideoRevision, error)
+}
+
+// GenreRepository manages the genre taxonomy. Resolve() maps the genre names given for
+// a video to the slugs of canonical genres, so that videos only ever store slugs.
+type GenreRepository interface {
+	Insert(ctx context.Context, genre *Genre) error
+	Get(ctx context.Context, id int64) (*Genre, error)
+	GetAll(ctx context.Context) ([]*Genre, error)
+	Update(ctx context.Context, genre *Genre) error
+	Delete(ctx context.Context, id int64) error
+	Resolve(ctx context.Context, names []string) ([]string, []string, error)
+}
+
+type PersonRepository interface {
+	Insert(ctx context.Context, person *Person) error
+	Get(ctx context.Context, id int64) (*Person, error)
+	GetAll(ctx context.Context, name string, filters Filters) ([]*Person, Metadata, error)
+	Update(ctx context.Context, person *Person) error
+	Delete(ctx context.Context, id int64) error
+}
+
+// CreditRepository manages the people credited on each video. A video's credits are
+// always replaced as a whole.
+type CreditRepository interface {
+	GetForVideo(ctx context.Context, videoID int64) ([]*Credit, error)
+	ReplaceForVideo(ctx context.Context, videoID int64, credits []*Credit) error
+}
+
+// RatingRepository manages users' ratings of videos. The methods which change a rating
+// return the video's new rating summary, which they keep up to date.
+type RatingRepository interface {
+	Get(ctx context.Context, videoID, userID int64) (*Rating, error)
+	Insert(ctx context.Context, rating *Rating) (*RatingSummary, error)
+	Update(ctx context.Context, rating *Rating) (*RatingSummary, error)
+	Delete(ctx context.Context, videoID, userID int64) (*RatingSummary, error)
+}
+
+type ReviewRepository interface {
+	Insert(ctx context.Context, review *Review) error
+	Get(ctx context.Context, videoID, id int64) (*Review, error)
+	GetAllForVideo(ctx context.Context, videoID int64, status string, filters Filters) ([]*Review, Metadata, error)
+	Update(ctx context.Context, review *Review) error
+	Delete(ctx context.Context, videoID, id int64) error
+}
+
+// WatchlistRepository manages the videos users have saved to their named lists. Every
+// method is scoped to a single user.
+type WatchlistRepository interface {
+	GetLists(ctx context.Context, userID int64) ([]*WatchlistSummary, error)
+	GetItems(ctx context.Context, userID int64, list string) ([]*WatchlistItem, error)
+	Get(ctx context.Context, userID int64, list string, videoID int64) (*WatchlistItem, error)
+	Add(ctx context.Context, userID int64, item *WatchlistItem) error
+	Update(ctx context.Context, userID int64, item *WatchlistItem) error
+	Remove(ctx context.Context, userID int64, list string, videoID int64) error
+	InWatchlist(ctx context.Context, userID int64, videoIDs []int64) (map[int64]bool, error)
+}
+
+type UserRepository interface {
+	Insert(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int64) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	ResetPassword(ctx context.Context, user *User, revocation *Revocation) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+}
+
+type TokenRepository interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, tokens ...*Token) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+	Delete(ctx context.Context, scope, tokenPlaintext string) error
+	Touch(ctx context.Context, tokenPlaintext, clientIP, userAgent string) error
+	GetSessions(ctx context.Context, userID int64) ([]*Session, error)
+	GetRefreshSessions(ctx context.Context, userID int64) ([]*Session, error)
+	Refresh(ctx context.Context, tokenPlaintext string, reuse *Revocation, tokens ...*Token) error
+	DeleteFamily(ctx context.Context, family string) error
+}
+
+// RevocationRepository records the revocation of signed tokens, which can't be deleted
+// like the tokens in TokenRepository because they aren't stored anywhere.
+type RevocationRepository interface {
+	Insert(ctx context.Context, revocation *Revocation) error
+	GetActive(ctx context.Context) ([]*Revocation, error)
+	DeleteExpired(ctx context.Context) error
+}
+
+type PermissionRepository interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+}
+
+// Create a Models struct which wraps the repositories. Each field holds an interface
+// value, so the same handlers work whether the data lives in PostgreSQL or in memory.
 type Models struct {
-	Videos      VideoModel
-	Tokens      TokenModel
-	Permissions PermissionModel
-	Users       UserModel
+	Videos      VideoRepository
+	Revisions   RevisionRepository
+	Genres      GenreRepository
+	People      PersonRepository
+	Credits     CreditRepository
+	Ratings     RatingRepository
+	Reviews     ReviewRepository
+	Watchlists  WatchlistRepository
+	Tokens      TokenRepository
+	Revocations RevocationRepository
+	Permissions PermissionRepository
+	Users       UserRepository
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
-// the initialized MovieModel.
-func NewModels(db *sql.DB) Models {
+// the PostgreSQL-backed models. The queryTimeout is applied on top of the context that
+// the caller passes to each method, so a query is abandoned when either the request is
+// cancelled or the timeout elapses, whichever happens first.
+func NewModels(db *sql.DB, queryTimeout time.Duration) Models {
 	return Models{
-		Videos:      VideoModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db}, // Initialize a new TokenModel instance.
-		Users:       UserModel{DB: db},
+		Videos:      VideoModel{DB: db, QueryTimeout: queryTimeout},
+		Revisions:   RevisionModel{DB: db, QueryTimeout: queryTimeout},
+		Genres:      GenreModel{DB: db, QueryTimeout: queryTimeout},
+		People:      PersonModel{DB: db, QueryTimeout: queryTimeout},
+		Credits:     CreditModel{DB: db, QueryTimeout: queryTimeout},
+		Ratings:     RatingModel{DB: db, QueryTimeout: queryTimeout},
+		Reviews:     ReviewModel{DB: db, QueryTimeout: queryTimeout},
+		Watchlists:  WatchlistModel{DB: db, QueryTimeout: queryTimeout},
+		Permissions: PermissionModel{DB: db, QueryTimeout: queryTimeout},
+		Tokens:      TokenModel{DB: db, QueryTimeout: queryTimeout}, // Initialize a new TokenModel instance.
+		Revocations: RevocationModel{DB: db, QueryTimeout: queryTimeout},
+		Users:       UserModel{DB: db, QueryTimeout: queryTimeout},
 	}
 }
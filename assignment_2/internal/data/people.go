@@ -0,0 +1,281 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrPersonCredited is returned when deleting a person who still has credits.
+	ErrPersonCredited = errors.New("person has credits")
+	// ErrUnknownPerson is returned when a credit refers to a person who doesn't exist.
+	ErrUnknownPerson = errors.New("unknown person")
+)
+
+// A Person is someone who can be credited on a video. BirthYear is optional.
+type Person struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"name"`
+	BirthYear *int32    `json:"birth_year,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+func ValidatePerson(v *validator.Validator, person *Person) {
+	v.Check(person.Name != "", "name", "must be provided")
+	v.Check(len(person.Name) <= 200, "name", "must not be more than 200 bytes long")
+	if person.BirthYear != nil {
+		v.Check(*person.BirthYear >= 1800, "birth_year", "must be greater than 1800")
+		v.Check(*person.BirthYear <= int32(time.Now().Year()), "birth_year", "must not be in the future")
+	}
+}
+
+// The roles that a person can be credited with.
+const (
+	RoleDirector = "director"
+	RoleWriter   = "writer"
+	RoleProducer = "producer"
+	RoleComposer = "composer"
+	RoleCast     = "cast"
+	RoleCrew     = "crew"
+)
+
+var CreditRoles = []string{RoleDirector, RoleWriter, RoleProducer, RoleComposer, RoleCast, RoleCrew}
+
+// A Credit links a person to a video in a role. Character is only used for the cast.
+// Credits are listed in BillingOrder, lowest first. PersonName is filled in when credits
+// are read, and is ignored when they're saved.
+type Credit struct {
+	PersonID     int64  `json:"person_id"`
+	PersonName   string `json:"name"`
+	Role         string `json:"role"`
+	Character    string `json:"character,omitempty"`
+	BillingOrder int32  `json:"billing_order"`
+}
+
+// MaxCredits is the largest number of credits a single video can have.
+const MaxCredits = 500
+
+// ValidateCredits checks the complete list of credits for a video.
+func ValidateCredits(v *validator.Validator, credits []*Credit) {
+	v.Check(len(credits) <= MaxCredits, "credits", fmt.Sprintf("must not contain more than %d credits", MaxCredits))
+	seen := make(map[string]bool)
+	for i, credit := range credits {
+		key := fmt.Sprintf("credits[%d]", i)
+		v.Check(credit.PersonID > 0, key+".person_id", "must be a positive integer")
+		v.Check(validator.In(credit.Role, CreditRoles...), key+".role", "must be one of director, writer, producer, composer, cast or crew")
+		v.Check(credit.Character == "" || credit.Role == RoleCast, key+".character", "must only be given for the cast")
+		v.Check(len(credit.Character) <= 200, key+".character", "must not be more than 200 bytes long")
+		v.Check(credit.BillingOrder > 0, key+".billing_order", "must be a positive integer")
+		// Mirror the primary key on video_credits.
+		unique := fmt.Sprintf("%d/%s", credit.PersonID, credit.Role)
+		v.Check(!seen[unique], key, "must not repeat a person in the same role")
+		seen[unique] = true
+	}
+}
+
+type PersonModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+func (m PersonModel) Insert(ctx context.Context, person *Person) error {
+	query := `
+INSERT INTO people (name, birth_year)
+VALUES ($1, $2)
+RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, person.Name, person.BirthYear).Scan(&person.ID, &person.CreatedAt, &person.Version)
+}
+
+func (m PersonModel) Get(ctx context.Context, id int64) (*Person, error) {
+	query := `
+SELECT id, created_at, name, birth_year, version
+FROM people
+WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var person Person
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&person.ID, &person.CreatedAt, &person.Name, &person.BirthYear, &person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &person, nil
+}
+
+// GetAll returns a page of people, optionally only those whose name contains all of
+// the words in name. It works in the same way as VideoModel.GetAll().
+func (m PersonModel) GetAll(ctx context.Context, name string, filters Filters) ([]*Person, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, name, birth_year, version
+FROM people
+WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
+ORDER BY %s %s, id ASC
+LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, name, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	people := []*Person{}
+	for rows.Next() {
+		var person Person
+		err := rows.Scan(&totalRecords, &person.ID, &person.CreatedAt, &person.Name, &person.BirthYear, &person.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		people = append(people, &person)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return people, metadata, nil
+}
+
+func (m PersonModel) Update(ctx context.Context, person *Person) error {
+	query := `
+UPDATE people
+SET name = $1, birth_year = $2, version = version + 1
+WHERE id = $3 AND version = $4
+RETURNING version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, person.Name, person.BirthYear, person.ID, person.Version).Scan(&person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes a person. People who are credited on a video can't be deleted until
+// those credits have been removed, in which case ErrPersonCredited is returned.
+func (m PersonModel) Delete(ctx context.Context, id int64) error {
+	query := `DELETE FROM people WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Name() == "foreign_key_violation" {
+			return ErrPersonCredited
+		}
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+type CreditModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// GetForVideo returns the credits for a video in billing order. Credits for a video in
+// the trash are still returned, so that they're intact if it's restored.
+func (m CreditModel) GetForVideo(ctx context.Context, videoID int64) ([]*Credit, error) {
+	query := `
+SELECT video_credits.person_id, people.name, video_credits.role, video_credits.character, video_credits.billing_order
+FROM video_credits
+INNER JOIN people ON people.id = video_credits.person_id
+WHERE video_credits.video_id = $1
+ORDER BY video_credits.billing_order, video_credits.person_id, video_credits.role`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	credits := []*Credit{}
+	for rows.Next() {
+		var credit Credit
+		err := rows.Scan(&credit.PersonID, &credit.PersonName, &credit.Role, &credit.Character, &credit.BillingOrder)
+		if err != nil {
+			return nil, err
+		}
+		credits = append(credits, &credit)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return credits, nil
+}
+
+// ReplaceForVideo replaces all of a video's credits with credits, filling in each
+// credit's PersonName. It returns ErrRecordNotFound if the video doesn't exist or is in
+// the trash, and ErrUnknownPerson if a credit refers to a person who doesn't exist.
+func (m CreditModel) ReplaceForVideo(ctx context.Context, videoID int64, credits []*Credit) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		// Lock the video, so that it can't be deleted while its credits are replaced.
+		_, err := lockVideo(ctx, tx, videoID, "deleted_at IS NULL")
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM video_credits WHERE video_id = $1`, videoID)
+		if err != nil {
+			return err
+		}
+		query := `
+INSERT INTO video_credits (video_id, person_id, role, character, billing_order)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING (SELECT name FROM people WHERE id = $2)`
+		for _, credit := range credits {
+			err := tx.QueryRowContext(ctx, query, videoID, credit.PersonID, credit.Role, credit.Character, credit.BillingOrder).Scan(&credit.PersonName)
+			if err != nil {
+				var pqErr *pq.Error
+				if errors.As(err, &pqErr) && pqErr.Code.Name() == "foreign_key_violation" {
+					return ErrUnknownPerson
+				}
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path"
+)
+
+// A PosterSize is one of the thumbnails generated for an uploaded poster. Width is the
+// thumbnail's width in pixels, and its height keeps the poster's aspect ratio.
+type PosterSize struct {
+	Name  string
+	Width int
+}
+
+// PosterSizes lists the thumbnails generated for each poster, smallest first.
+var PosterSizes = []PosterSize{
+	{Name: "small", Width: 160},
+	{Name: "medium", Width: 320},
+	{Name: "large", Width: 640},
+}
+
+// PosterThumbnailKey returns the blob key of the named thumbnail of the poster whose
+// original is stored under key. The thumbnails are JPEGs kept alongside the original.
+func PosterThumbnailKey(key, size string) string {
+	return path.Join(path.Dir(key), size+".jpg")
+}
+
+// PosterKeys returns the blob keys of the poster stored under key: the original followed
+// by each of its thumbnails.
+func PosterKeys(key string) []string {
+	keys := []string{key}
+	for _, size := range PosterSizes {
+		keys = append(keys, PosterThumbnailKey(key, size.Name))
+	}
+	return keys
+}
+
+// posterURLs returns the URLs of a video's poster and its thumbnails, keyed by "original"
+// and the thumbnail size names, or nil if the video has no poster. The URLs are paths on
+// the API's own media endpoint, so they don't depend on how the blobs are stored.
+func (video *Video) posterURLs() map[string]string {
+	if video.Poster == "" {
+		return nil
+	}
+	urls := map[string]string{"original": "/v1/media/" + video.Poster}
+	for _, size := range PosterSizes {
+		urls[size.Name] = "/v1/media/" + PosterThumbnailKey(video.Poster, size.Name)
+	}
+	return urls
+}
+
+// SetPoster sets the blob key of a video's poster, returning the key it replaces (which
+// is "" if the video had no poster). A key of "" removes the poster. Changing the poster
+// doesn't change the video's version or record a revision. Deleting the blobs is left to
+// the caller.
+func (m VideoModel) SetPoster(ctx context.Context, id int64, key string) (string, error) {
+	if id < 1 {
+		return "", ErrRecordNotFound
+	}
+	// The subquery locks the row and reads the old key, which the UPDATE's RETURNING
+	// clause can't see on its own.
+	query := `
+UPDATE movies
+SET poster = $2
+FROM (SELECT id, poster FROM movies WHERE id = $1 AND deleted_at IS NULL FOR UPDATE) AS old
+WHERE movies.id = old.id
+RETURNING old.poster`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var old string
+	err := m.DB.QueryRowContext(ctx, query, id, key).Scan(&old)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return old, nil
+}
@@ -0,0 +1,169 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/validator"
+	"github.com/lib/pq"
+)
+
+// ErrDuplicateRating is returned when a user rates a video that they've already rated.
+var ErrDuplicateRating = errors.New("duplicate rating")
+
+// A Rating is one user's score for a video, from 1 to 10.
+type Rating struct {
+	VideoID   int64     `json:"video_id"`
+	UserID    int64     `json:"user_id"`
+	Score     int32     `json:"score"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// A RatingSummary is the aggregate of all the ratings for a video. Average is rounded to
+// two decimal places, and is zero for a video which hasn't been rated.
+type RatingSummary struct {
+	Average float64 `json:"average"`
+	Count   int32   `json:"count"`
+}
+
+func ValidateRating(v *validator.Validator, rating *Rating) {
+	v.Check(rating.Score >= 1, "score", "must be at least 1")
+	v.Check(rating.Score <= 10, "score", "must not be more than 10")
+}
+
+type RatingModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+func (m RatingModel) Get(ctx context.Context, videoID, userID int64) (*Rating, error) {
+	query := `
+SELECT video_id, user_id, score, created_at, updated_at
+FROM video_ratings
+WHERE video_id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var rating Rating
+	err := m.DB.QueryRowContext(ctx, query, videoID, userID).Scan(
+		&rating.VideoID, &rating.UserID, &rating.Score, &rating.CreatedAt, &rating.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &rating, nil
+}
+
+// Insert adds a user's rating for a video and returns the video's new rating summary.
+// It returns ErrRecordNotFound if the video doesn't exist or is in the trash, and
+// ErrDuplicateRating if the user has already rated it.
+func (m RatingModel) Insert(ctx context.Context, rating *Rating) (*RatingSummary, error) {
+	query := `
+INSERT INTO video_ratings (video_id, user_id, score)
+VALUES ($1, $2, $3)
+RETURNING created_at, updated_at`
+
+	return m.change(ctx, rating.VideoID, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, rating.VideoID, rating.UserID, rating.Score).Scan(&rating.CreatedAt, &rating.UpdatedAt)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+				return ErrDuplicateRating
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// Update changes the score of a user's existing rating and returns the video's new
+// rating summary. It returns ErrRecordNotFound if the video or the rating doesn't exist.
+func (m RatingModel) Update(ctx context.Context, rating *Rating) (*RatingSummary, error) {
+	query := `
+UPDATE video_ratings
+SET score = $1, updated_at = NOW()
+WHERE video_id = $2 AND user_id = $3
+RETURNING created_at, updated_at`
+
+	return m.change(ctx, rating.VideoID, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, rating.Score, rating.VideoID, rating.UserID).Scan(&rating.CreatedAt, &rating.UpdatedAt)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes a user's rating and returns the video's new rating summary. It returns
+// ErrRecordNotFound if the video or the rating doesn't exist.
+func (m RatingModel) Delete(ctx context.Context, videoID, userID int64) (*RatingSummary, error) {
+	query := `DELETE FROM video_ratings WHERE video_id = $1 AND user_id = $2`
+
+	return m.change(ctx, videoID, func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, videoID, userID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// change runs fn, which changes one of a video's ratings, and then recomputes the
+// video's rating summary, all in one transaction. The video row is locked first, so
+// concurrent changes to the same video's ratings can't leave the summary out of date.
+func (m RatingModel) change(ctx context.Context, videoID int64, fn func(ctx context.Context, tx *sql.Tx) error) (*RatingSummary, error) {
+	query := `
+UPDATE movies
+SET rating = summary.average, rating_count = summary.count
+FROM (
+	SELECT coalesce(round(avg(score), 2), 0) AS average, count(*) AS count
+	FROM video_ratings
+	WHERE video_id = $1
+) AS summary
+WHERE movies.id = $1
+RETURNING movies.rating, movies.rating_count`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	var summary RatingSummary
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		_, err := lockVideo(ctx, tx, videoID, "deleted_at IS NULL")
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		if err := fn(ctx, tx); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, query, videoID).Scan(&summary.Average, &summary.Count)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/validator"
+	"github.com/lib/pq"
+)
+
+// ErrDuplicateReview is returned when a user reviews a video that they've already
+// reviewed.
+var ErrDuplicateReview = errors.New("duplicate review")
+
+// The moderation statuses of a review. Only approved reviews are shown to everyone.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+var ReviewStatuses = []string{ReviewPending, ReviewApproved, ReviewRejected}
+
+// A Review is one user's written opinion of a video. UserName is filled in when reviews
+// are read, and is ignored when they're saved.
+type Review struct {
+	ID        int64     `json:"id"`
+	VideoID   int64     `json:"video_id"`
+	UserID    int64     `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	Body      string    `json:"body"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Body != "", "body", "must be provided")
+	v.Check(len(review.Body) <= 5000, "body", "must not be more than 5000 bytes long")
+	v.Check(validator.In(review.Status, ReviewStatuses...), "status", "must be one of pending, approved or rejected")
+}
+
+type ReviewModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// Insert adds a review, setting its ID, timestamps and Version. It returns
+// ErrRecordNotFound if the video doesn't exist or is in the trash, and
+// ErrDuplicateReview if the user has already reviewed it.
+func (m ReviewModel) Insert(ctx context.Context, review *Review) error {
+	query := `
+INSERT INTO video_reviews (video_id, user_id, body, status)
+SELECT id, $2, $3, $4
+FROM movies
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING id, created_at, updated_at, version, (SELECT name FROM users WHERE id = $2)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	args := []interface{}{review.VideoID, review.UserID, review.Body, review.Status}
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt, &review.Version, &review.UserName)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		case errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation":
+			return ErrDuplicateReview
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// reviewColumns selects a review from video_reviews joined to users, in the order read
+// by scanReview().
+const reviewColumns = `video_reviews.id, video_reviews.video_id, video_reviews.user_id, users.name,
+	video_reviews.body, video_reviews.status, video_reviews.created_at, video_reviews.updated_at, video_reviews.version`
+
+func scanReview(row interface{ Scan(...interface{}) error }) (*Review, error) {
+	var review Review
+	err := row.Scan(
+		&review.ID,
+		&review.VideoID,
+		&review.UserID,
+		&review.UserName,
+		&review.Body,
+		&review.Status,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+		&review.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
+
+// Get returns one of a video's reviews, whatever its status.
+func (m ReviewModel) Get(ctx context.Context, videoID, id int64) (*Review, error) {
+	query := fmt.Sprintf(`
+SELECT %s
+FROM video_reviews
+INNER JOIN users ON users.id = video_reviews.user_id
+WHERE video_reviews.video_id = $1 AND video_reviews.id = $2`, reviewColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	review, err := scanReview(m.DB.QueryRowContext(ctx, query, videoID, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return review, nil
+}
+
+// GetAllForVideo returns a page of a video's reviews which have the given status.
+func (m ReviewModel) GetAllForVideo(ctx context.Context, videoID int64, status string, filters Filters) ([]*Review, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), %s
+FROM video_reviews
+INNER JOIN users ON users.id = video_reviews.user_id
+WHERE video_reviews.video_id = $1 AND video_reviews.status = $2
+ORDER BY video_reviews.%s %s, video_reviews.id ASC
+LIMIT $3 OFFSET $4`, reviewColumns, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, videoID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	reviews := []*Review{}
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(
+			&totalRecords,
+			&review.ID,
+			&review.VideoID,
+			&review.UserID,
+			&review.UserName,
+			&review.Body,
+			&review.Status,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		reviews = append(reviews, &review)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return reviews, metadata, nil
+}
+
+// Update saves a review's body and status, using the version for optimistic locking in
+// the same way as VideoModel.Update().
+func (m ReviewModel) Update(ctx context.Context, review *Review) error {
+	query := `
+UPDATE video_reviews
+SET body = $1, status = $2, updated_at = NOW(), version = version + 1
+WHERE id = $3 AND version = $4
+RETURNING updated_at, version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	args := []interface{}{review.Body, review.Status, review.ID, review.Version}
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&review.UpdatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m ReviewModel) Delete(ctx context.Context, videoID, id int64) error {
+	query := `DELETE FROM video_reviews WHERE video_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, videoID, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The actions recorded in a VideoRevision. RevisionBaseline is only written by migration
+// 000008, and records the state each video was in when revision history was introduced.
+const (
+	RevisionCreate   = "create"
+	RevisionUpdate   = "update"
+	RevisionDelete   = "delete"
+	RevisionRestore  = "restore"
+	RevisionBaseline = "baseline"
+)
+
+// A VideoRevision is an immutable record of a single change to a video, holding complete
+// snapshots of the video before and after the change. Version is the video's version
+// after the change, so every version of a video has exactly one revision. Before is nil
+// for the revision which created the video, and UserID is nil if the user who made the
+// change has since been deleted.
+type VideoRevision struct {
+	VideoID   int64     `json:"video_id"`
+	Version   int32     `json:"version"`
+	Action    string    `json:"action"`
+	UserID    *int64    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Before    *Video    `json:"before"`
+	After     *Video    `json:"after"`
+}
+
+// newVideoRevision returns the revision for a change made by a user. The snapshots are
+// copies, so later changes to before and after don't leak into the revision.
+func newVideoRevision(action string, userID int64, before, after *Video) *VideoRevision {
+	rev := &VideoRevision{
+		VideoID: after.ID,
+		Version: after.Version,
+		Action:  action,
+		UserID:  &userID,
+		After:   copyVideo(after),
+	}
+	// The rating summary and the poster aren't part of a video's history, because they
+	// change without creating a revision.
+	rev.After.CreatedAt, rev.After.Rating, rev.After.Poster = time.Time{}, nil, ""
+	if before != nil {
+		rev.Before = copyVideo(before)
+		rev.Before.CreatedAt, rev.Before.Rating, rev.Before.Poster = time.Time{}, nil, ""
+	}
+	return rev
+}
+
+// A FieldChange is one field which differs between the two snapshots in a revision.
+// Before and After hold the field's values as they appear in the video's JSON, with nil
+// for a field which wasn't set.
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// revisionFields lists the fields of a video which are compared by Changes(), in the
+// order that they're reported.
+var revisionFields = []struct {
+	name  string
+	value func(video *Video) interface{}
+}{
+	{"title", func(video *Video) interface{} { return video.Title }},
+	{"description", func(video *Video) interface{} { return video.Description }},
+	{"language", func(video *Video) interface{} { return video.Language }},
+	{"year", func(video *Video) interface{} { return video.Year }},
+	{"runtime", func(video *Video) interface{} { return video.Runtime }},
+	{"genres", func(video *Video) interface{} { return video.Genres }},
+	{"deleted_at", func(video *Video) interface{} { return video.DeletedAt }},
+	{"deleted_by", func(video *Video) interface{} { return video.DeletedBy }},
+}
+
+// Changes returns a field-level diff between the Before and After snapshots. Values are
+// compared by their JSON encoding, which is how the client sees them.
+func (rev *VideoRevision) Changes() ([]FieldChange, error) {
+	changes := []FieldChange{}
+	for _, field := range revisionFields {
+		var before, after interface{}
+		if rev.Before != nil {
+			before = field.value(rev.Before)
+		}
+		if rev.After != nil {
+			after = field.value(rev.After)
+		}
+		beforeJS, err := json.Marshal(before)
+		if err != nil {
+			return nil, err
+		}
+		afterJS, err := json.Marshal(after)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(beforeJS, afterJS) {
+			continue
+		}
+		changes = append(changes, FieldChange{
+			Field:  field.name,
+			Before: json.RawMessage(beforeJS),
+			After:  json.RawMessage(afterJS),
+		})
+	}
+	return changes, nil
+}
+
+// insertVideoRevision writes a revision as part of the transaction which made the
+// change, so a video is never changed without its history being recorded.
+func insertVideoRevision(ctx context.Context, tx *sql.Tx, rev *VideoRevision) error {
+	var before interface{}
+	if rev.Before != nil {
+		js, err := json.Marshal(rev.Before)
+		if err != nil {
+			return err
+		}
+		// The jsonb columns need the snapshot as text; a []byte would be sent as bytea.
+		before = string(js)
+	}
+	after, err := json.Marshal(rev.After)
+	if err != nil {
+		return err
+	}
+	query := `
+INSERT INTO video_revisions (video_id, version, action, user_id, before, after)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING created_at`
+	args := []interface{}{rev.VideoID, rev.Version, rev.Action, rev.UserID, before, string(after)}
+	return tx.QueryRowContext(ctx, query, args...).Scan(&rev.CreatedAt)
+}
+
+type RevisionModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// GetAllForVideo returns a page of the revisions for a video, sorted by version. It
+// returns an empty slice if the video doesn't exist (or has been purged).
+func (m RevisionModel) GetAllForVideo(ctx context.Context, videoID int64, filters Filters) ([]*VideoRevision, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), video_id, version, action, user_id, created_at, before, after
+FROM video_revisions
+WHERE video_id = $1
+ORDER BY %s %s
+LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, videoID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	revisions := []*VideoRevision{}
+	for rows.Next() {
+		rev, err := scanVideoRevision(rows, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return revisions, metadata, nil
+}
+
+// Get returns a single revision of a video, or ErrRecordNotFound if there is no such
+// version.
+func (m RevisionModel) Get(ctx context.Context, videoID int64, version int32) (*VideoRevision, error) {
+	query := `
+SELECT video_id, version, action, user_id, created_at, before, after
+FROM video_revisions
+WHERE video_id = $1 AND version = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rev, err := scanVideoRevision(m.DB.QueryRowContext(ctx, query, videoID, version))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return rev, nil
+}
+
+// scanVideoRevision scans a row from video_revisions, decoding the snapshots. Any
+// leading destinations (such as a window count) are scanned first.
+func scanVideoRevision(row interface{ Scan(...interface{}) error }, leading ...interface{}) (*VideoRevision, error) {
+	var rev VideoRevision
+	var before, after []byte
+	dest := append(leading, &rev.VideoID, &rev.Version, &rev.Action, &rev.UserID, &rev.CreatedAt, &before, &after)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if before != nil {
+		rev.Before = &Video{}
+		if err := json.Unmarshal(before, rev.Before); err != nil {
+			return nil, err
+		}
+	}
+	rev.After = &Video{}
+	if err := json.Unmarshal(after, rev.After); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestVideoRevisionChanges(t *testing.T) {
+	deletedAt := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	deletedBy := int64(3)
+	original := &Video{ID: 1, Title: "Original", Language: "english", Year: 2001, Runtime: 102, Genres: []string{"drama"}, Version: 1}
+
+	tests := []struct {
+		name string
+		// change returns the "after" snapshot, given a copy of original.
+		change func(video *Video) *Video
+		// want maps each changed field to its before and after values in JSON.
+		want [][3]string
+	}{
+		{
+			name:   "Nothing",
+			change: func(video *Video) *Video { return video },
+		},
+		{
+			name: "Title and year",
+			change: func(video *Video) *Video {
+				video.Title, video.Year = "Updated", 2002
+				return video
+			},
+			want: [][3]string{{"title", `"Original"`, `"Updated"`}, {"year", "2001", "2002"}},
+		},
+		{
+			name: "Runtime and genres",
+			change: func(video *Video) *Video {
+				video.Runtime, video.Genres = 95, []string{"drama", "crime"}
+				return video
+			},
+			want: [][3]string{{"runtime", `"102 mins"`, `"95 mins"`}, {"genres", `["drama"]`, `["drama","crime"]`}},
+		},
+		{
+			name: "Deleted",
+			change: func(video *Video) *Video {
+				video.DeletedAt, video.DeletedBy = &deletedAt, &deletedBy
+				return video
+			},
+			want: [][3]string{{"deleted_at", "null", `"2024-05-06T07:08:09Z"`}, {"deleted_by", "null", "3"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after := tt.change(copyVideo(original))
+			after.Version++
+			changes, err := newVideoRevision(RevisionUpdate, 1, original, after).Changes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) != len(tt.want) {
+				t.Fatalf("got %d changes; want %d: %+v", len(changes), len(tt.want), changes)
+			}
+			for i, change := range changes {
+				before, _ := json.Marshal(change.Before)
+				after, _ := json.Marshal(change.After)
+				if got := [3]string{change.Field, string(before), string(after)}; got != tt.want[i] {
+					t.Errorf("got change %v; want %v", got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		// A video's first revision has no "before", so every field is reported.
+		changes, err := newVideoRevision(RevisionCreate, 1, nil, original).Changes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, change := range changes {
+			if js, _ := json.Marshal(change.Before); string(js) != "null" {
+				t.Errorf("got %s before %s; want null", change.Field, js)
+			}
+		}
+		if len(changes) != 6 {
+			t.Errorf("got %d changes; want the 6 fields which are set", len(changes))
+		}
+	})
+}
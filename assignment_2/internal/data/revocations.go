@@ -0,0 +1,86 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// A Revocation revokes signed access tokens before they expire. If TokenID is set it
+// revokes that token, and if Family is set it revokes the tokens issued from that refresh
+// token family. Otherwise it revokes every token issued to the user up to RevokedAt.
+// Expiry is when the last token it could apply to expires, after which the revocation
+// can be forgotten.
+type Revocation struct {
+	TokenID   string
+	Family    string
+	UserID    int64
+	RevokedAt time.Time
+	Expiry    time.Time
+}
+
+type RevocationModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// Insert() records a revocation. A zero RevokedAt is set to the current time.
+func (m RevocationModel) Insert(ctx context.Context, revocation *Revocation) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	return insertRevocation(ctx, m.DB, revocation)
+}
+
+// insertRevocation is the body of Insert(), using db, which may be a transaction.
+func insertRevocation(ctx context.Context, db interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}, revocation *Revocation) error {
+	if revocation.RevokedAt.IsZero() {
+		revocation.RevokedAt = time.Now()
+	}
+	query := `
+INSERT INTO token_revocations (token_id, family, user_id, revoked_at, expiry)
+VALUES ($1, $2, $3, $4, $5)`
+	args := []interface{}{revocation.TokenID, revocation.Family, revocation.UserID, revocation.RevokedAt, revocation.Expiry}
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetActive() returns the revocations which haven't expired.
+func (m RevocationModel) GetActive(ctx context.Context) ([]*Revocation, error) {
+	query := `
+SELECT token_id, family, user_id, revoked_at, expiry
+FROM token_revocations
+WHERE expiry > NOW()`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revocations := []*Revocation{}
+	for rows.Next() {
+		var revocation Revocation
+		err := rows.Scan(&revocation.TokenID, &revocation.Family, &revocation.UserID, &revocation.RevokedAt, &revocation.Expiry)
+		if err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, &revocation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// DeleteExpired() deletes the revocations which have expired.
+func (m RevocationModel) DeleteExpired(ctx context.Context) error {
+	query := `
+DELETE FROM token_revocations
+WHERE expiry <= NOW()`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"context"
+	"strings"
+
+	"assignment_2.alexedwards.net/internal/validator"
+)
+
+// A VideoSuggestion is one title completion returned by Suggest(). Score is higher for
+// better matches: titles which start with the query beat titles with a word starting
+// with it, and both beat titles which only match by trigram similarity, which is what
+// lets a mistyped query still find something.
+type VideoSuggestion struct {
+	ID    int64   `json:"id"`
+	Title string  `json:"title"`
+	Year  int32   `json:"year"`
+	Score float64 `json:"score"`
+}
+
+// MaxSuggestions is the largest number of suggestions a client can ask for at once.
+const MaxSuggestions = 20
+
+// suggestSimilarityThreshold is the pg_trgm.word_similarity_threshold which migration
+// 000021 sets for the database in place of the default of 0.6. The in-memory Suggest()
+// uses it directly.
+const suggestSimilarityThreshold = 0.4
+
+func ValidateSuggestQuery(v *validator.Validator, query string, limit int) {
+	v.Check(strings.TrimSpace(query) != "", "q", "must be provided")
+	v.Check(len(query) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= MaxSuggestions, "limit", "must be a maximum of 20")
+}
+
+// likePrefix escapes the LIKE wildcards in s and adds a trailing %, so that the pattern
+// matches strings which start with s.
+func likePrefix(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s) + "%"
+}
+
+// Suggest returns up to limit title completions for query, best first. The candidates
+// are titles which start with the query, titles containing a word which starts with it,
+// and titles similar enough to it by pg_trgm's word_similarity(). All three conditions
+// can use the trigram index on title from migration 000010, so the query stays fast
+// enough to be called on every keystroke. The <% operator compares against the
+// pg_trgm.word_similarity_threshold setting, which migration 000021 lowers to
+// suggestSimilarityThreshold.
+func (m VideoModel) Suggest(ctx context.Context, query string, limit int) ([]*VideoSuggestion, error) {
+	query = strings.TrimSpace(query)
+	stmt := `
+SELECT id, title, year, score
+FROM (
+	SELECT id, title, year,
+		CASE WHEN title ILIKE $2 THEN 2 WHEN title ILIKE '% ' || $2 THEN 1 ELSE 0 END
+			+ word_similarity($1, title) AS score
+	FROM movies
+	WHERE deleted_at IS NULL AND (title ILIKE $2 OR title ILIKE '% ' || $2 OR $1 <% title)
+) AS candidates
+ORDER BY score DESC, title ASC, id ASC
+LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, query, likePrefix(query), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	suggestions := []*VideoSuggestion{}
+	for rows.Next() {
+		var s VideoSuggestion
+		if err := rows.Scan(&s.ID, &s.Title, &s.Year, &s.Score); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return suggestions, nil
+}
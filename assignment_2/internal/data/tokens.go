@@ -6,7 +6,10 @@ import (
 	"crypto/sha256"
 	"database/sql" // New import
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"time"
+	"unicode/utf8"
 
 	"assignment_2.alexedwards.net/internal/validator"
 )
@@ -16,17 +19,56 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication" // Include a new authentication scope.
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
 )
 
-// Add struct tags to control how the struct appears when encoded to JSON.
+var (
+	// ErrRefreshTokenReused is returned by Refresh() when a refresh token which has
+	// already been exchanged is presented again. That means the token has leaked, so its
+	// whole family has been revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// Add struct tags to control how the struct appears when encoded to JSON. CreatedAt,
+// LastUsedAt, ClientIP and UserAgent describe the session an authentication token
+// belongs to: ClientIP and UserAgent are those of the client which created the token,
+// until it's used, and then of the client which used it last.
+//
+// Family is shared by a refresh token, the tokens it's exchanged for, and so on down the
+// chain, so that they can all be revoked together. It's "" for tokens issued on their own.
+// UsedAt is set once a refresh token has been exchanged.
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Plaintext  string     `json:"token"`
+	Hash       []byte     `json:"-"`
+	UserID     int64      `json:"-"`
+	Expiry     time.Time  `json:"expiry"`
+	Scope      string     `json:"-"`
+	CreatedAt  time.Time  `json:"-"`
+	LastUsedAt *time.Time `json:"-"`
+	ClientIP   string     `json:"-"`
+	UserAgent  string     `json:"-"`
+	Family     string     `json:"-"`
+	UsedAt     *time.Time `json:"-"`
 }
 
+// A Session describes one of a user's unexpired authentication tokens, without the
+// token itself. Current is set on the session whose token made the request.
+type Session struct {
+	Hash       []byte     `json:"-"`
+	Family     string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	ClientIP   string     `json:"client_ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+}
+
+// maxUserAgentLength limits how much of a client's User-Agent header is kept with a
+// token.
+const maxUserAgentLength = 512
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
@@ -34,50 +76,289 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the TokenModel type.
 type TokenModel struct {
-	DB *sql.DB
+	DB           *sql.DB
+	QueryTimeout time.Duration
 }
 
 // The New() method is a shortcut which creates a new Token struct and then inserts the
 // data in the tokens table.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	token, err := generateToken(userID, ttl, scope)
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := GenerateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
-	query := `
-INSERT INTO tokens (hash, user_id, expiry, scope)
-VALUES ($1, $2, $3, $4)`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Insert() inserts one or more tokens. Several tokens are inserted in a single
+// transaction, so that either all of them are saved or none are.
+func (m TokenModel) Insert(ctx context.Context, tokens ...*Token) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	if len(tokens) == 1 {
+		return insertToken(ctx, m.DB, tokens[0])
+	}
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		for _, token := range tokens {
+			err := insertToken(ctx, tx, token)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// insertToken inserts a token using db, which may be a transaction.
+func insertToken(ctx context.Context, db interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}, token *Token) error {
+	query := `
+INSERT INTO tokens (hash, user_id, expiry, scope, created_at, client_ip, user_agent, family)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.CreatedAt, token.ClientIP, truncateUserAgent(token.UserAgent), token.Family}
+	_, err := db.ExecContext(ctx, query, args...)
 	return err
 }
 
+// Refresh() exchanges a refresh token for the given new tokens, which it inserts after
+// setting their user ID and family from the refresh token. The refresh token is marked as
+// used rather than deleted, so that if it's ever presented again Refresh() can tell that
+// it has leaked: it then revokes every token in the family and returns
+// ErrRefreshTokenReused. A refresh token which doesn't exist or has expired gives
+// ErrRecordNotFound.
+//
+// The family's signed tokens aren't stored, so deleting the family doesn't revoke them.
+// If reuse isn't nil, it's recorded in the same transaction when reuse is detected, after
+// setting its user ID and family from the refresh token.
+func (m TokenModel) Refresh(ctx context.Context, tokenPlaintext string, reuse *Revocation, tokens ...*Token) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	reused := false
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		query := `
+SELECT user_id, family, used_at IS NOT NULL
+FROM tokens
+WHERE hash = $1 AND scope = $2 AND expiry > NOW()
+FOR UPDATE`
+		var userID int64
+		var family string
+		err := tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&userID, &family, &reused)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+		// The revocation has to be committed, so reuse is reported once the
+		// transaction has ended.
+		if reused {
+			_, err = tx.ExecContext(ctx, "DELETE FROM tokens WHERE family = $1", family)
+			if err != nil || reuse == nil {
+				return err
+			}
+			reuse.UserID, reuse.Family = userID, family
+			return insertRevocation(ctx, tx, reuse)
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE tokens SET used_at = NOW() WHERE hash = $1", tokenHash[:])
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			token.UserID, token.Family = userID, family
+			if err := insertToken(ctx, tx, token); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if reused {
+		return ErrRefreshTokenReused
+	}
+	return nil
+}
+
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
 DELETE FROM tokens
 WHERE scope = $1 AND user_id = $2`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
 
-func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+// NewTokenFamily() returns a random identifier for a new family of tokens.
+func NewTokenFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// Delete() deletes the token with the given scope and plaintext, if there is one. If the
+// token belongs to a family, the rest of the family is deleted too, so that logging out
+// also revokes the refresh token which the session could be renewed with.
+func (m TokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+DELETE FROM tokens
+WHERE (hash = $1 AND scope = $2)
+OR family IN (SELECT family FROM tokens WHERE hash = $1 AND scope = $2 AND family <> '')`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope)
+	return err
+}
+
+// DeleteFamily() deletes every token in the family.
+func (m TokenModel) DeleteFamily(ctx context.Context, family string) error {
+	if family == "" {
+		return nil
+	}
+	query := `
+DELETE FROM tokens
+WHERE family = $1`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, family)
+	return err
+}
+
+// Touch() records that a token has just been used by the given client. So that this
+// doesn't write to the database on every request, the row is only updated if the client
+// has changed or the last-used time is more than a minute old.
+func (m TokenModel) Touch(ctx context.Context, tokenPlaintext, clientIP, userAgent string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	userAgent = truncateUserAgent(userAgent)
+	query := `
+UPDATE tokens
+SET last_used_at = NOW(), client_ip = $2, user_agent = $3
+WHERE hash = $1
+AND (last_used_at IS NULL OR last_used_at < NOW() - interval '1 minute' OR client_ip <> $2 OR user_agent <> $3)`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], clientIP, userAgent)
+	return err
+}
+
+// GetSessions() returns the user's unexpired authentication tokens as sessions, most
+// recently created first.
+func (m TokenModel) GetSessions(ctx context.Context, userID int64) ([]*Session, error) {
+	query := `
+SELECT hash, created_at, last_used_at, expiry, client_ip, user_agent
+FROM tokens
+WHERE user_id = $1 AND scope = $2 AND expiry > NOW()
+ORDER BY created_at DESC, hash`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.Hash,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.ClientIP,
+			&session.UserAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// GetRefreshSessions() returns a session for each of the user's refresh token families,
+// most recently used first. It's used when authentication tokens are signed rather than
+// stored. Each session is described by the family's current (unused, unexpired) refresh
+// token, except that it was created when the first token in the family was, and was last
+// used when a token in the family was last exchanged.
+func (m TokenModel) GetRefreshSessions(ctx context.Context, userID int64) ([]*Session, error) {
+	query := `
+SELECT t.hash, t.family, f.created_at, f.last_used_at, t.expiry, t.client_ip, t.user_agent
+FROM tokens t
+INNER JOIN (
+	SELECT family, MIN(created_at) AS created_at, MAX(used_at) AS last_used_at
+	FROM tokens
+	WHERE user_id = $1 AND scope = $2
+	GROUP BY family
+) f ON f.family = t.family
+WHERE t.user_id = $1 AND t.scope = $2 AND t.used_at IS NULL AND t.expiry > NOW()
+ORDER BY COALESCE(f.last_used_at, f.created_at) DESC, t.hash`
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.Hash,
+			&session.Family,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.ClientIP,
+			&session.UserAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) <= maxUserAgentLength {
+		return userAgent
+	}
+	// Cut at a rune boundary, so that the stored value is still valid UTF-8.
+	userAgent = userAgent[:maxUserAgentLength]
+	for len(userAgent) > 0 && !utf8.ValidString(userAgent) {
+		userAgent = userAgent[:len(userAgent)-1]
+	}
+	return userAgent
+}
+
+// GenerateToken() creates a new token without saving it, so that the caller can fill in
+// the session details before passing it to Insert() or Refresh().
+func GenerateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	// Create a Token instance containing the user ID, expiry, and scope information.
 	// Notice that we add the provided ttl (time-to-live) duration parameter to the
 	// current time to get the expiry time?
+	now := time.Now()
 	token := &Token{
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		UserID:    userID,
+		Expiry:    now.Add(ttl),
+		Scope:     scope,
+		CreatedAt: now.Truncate(time.Second),
 	}
 	// Initialize a zero-valued byte slice with a length of 16 bytes.
 	randomBytes := make([]byte, 16)
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"assignment_2.alexedwards.net/internal/validator"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -16,7 +17,8 @@ var (
 )
 
 type UserModel struct {
-	DB *sql.DB
+	DB           *sql.DB
+	QueryTimeout time.Duration
 }
 
 // Define a User struct to represent an individual user. Importantly, notice how we are
@@ -61,13 +63,13 @@ func (p *password) Set(plaintextPassword string) error {
 	return nil
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
 INSERT INTO users (name, email, password_hash, activated)
 VALUES ($1, $2, $3, $4)
 RETURNING id, created_at, version`
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 	// If the table already contains a record with this email address, then when we try
 	// to perform the insert there will be a violation of the UNIQUE "users_email_key"
@@ -85,13 +87,42 @@ RETURNING id, created_at, version`
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+// Get() returns the user with the given ID.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	query := `
+SELECT id, created_at, name, email, password_hash, activated, version
+FROM users
+WHERE id = $1`
+	var user User
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
 SELECT id, created_at, name, email, password_hash, activated, version
 FROM users
 WHERE email = $1`
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
@@ -113,7 +144,42 @@ WHERE email = $1`
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	return updateUser(ctx, m.DB, user)
+}
+
+// ResetPassword() saves a user whose password has been changed and, in the same
+// transaction, deletes their password reset, refresh and authentication tokens, so that
+// the reset token can't be used again and every existing session is logged out. If
+// revocation isn't nil it's recorded too, to revoke the user's signed tokens. Like
+// Update(), it returns ErrEditConflict if the user has changed since it was read.
+func (m UserModel) ResetPassword(ctx context.Context, user *User, revocation *Revocation) error {
+	query := `
+DELETE FROM tokens
+WHERE user_id = $1 AND scope = ANY($2)`
+	scopes := []string{ScopePasswordReset, ScopeRefresh, ScopeAuthentication}
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		if err := updateUser(ctx, tx, user); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, user.ID, pq.Array(scopes)); err != nil {
+			return err
+		}
+		if revocation != nil {
+			return insertRevocation(ctx, tx, revocation)
+		}
+		return nil
+	})
+}
+
+// updateUser is the body of Update(), using db, which may be a transaction.
+func updateUser(ctx context.Context, db interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, user *User) error {
 	query := `
 UPDATE users
 SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
@@ -127,9 +193,7 @@ RETURNING version`
 		user.ID,
 		user.Version,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := db.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -189,7 +253,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	// Remember that this returns a byte *array* with length 32, not a slice.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
@@ -208,7 +272,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	// value to check against the token expiry.
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 	// Execute the query, scanning the return values into a User struct. If no matching
 	// record is found we return an ErrRecordNotFound error.
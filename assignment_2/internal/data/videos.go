@@ -6,52 +6,264 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"assignment_2.alexedwards.net/internal/validator"
 	"github.com/lib/pq"
 )
 
+// Language is the text search configuration used to index the title and description
+// (one of SearchLanguages). DeletedAt and DeletedBy are only set for a video which is in
+// the trash. DeletedBy is the ID of the user who deleted it, and is nil if that user no
+// longer exists. Search is only set on the videos returned by a search, and Credits only
+// when they've been read separately from the CreditRepository. Rating is the summary of
+// the users' ratings, which is read with the video but is never written by VideoModel.
+// InWatchlist is only set on listings, to show whether the video is on one of the
+// requesting user's lists. Poster is the blob key of the uploaded poster image, or "" if
+// there isn't one, and is only changed by SetPoster().
 type Video struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	ID          int64          `json:"id"`
+	CreatedAt   time.Time      `json:"-"`
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Language    string         `json:"language,omitempty"`
+	Year        int32          `json:"year,omitempty"`
+	Runtime     Runtime        `json:"runtime,omitempty"`
+	Genres      []string       `json:"genres,omitempty"`
+	Version     int32          `json:"version"`
+	DeletedAt   *time.Time     `json:"deleted_at,omitempty"`
+	DeletedBy   *int64         `json:"deleted_by,omitempty"`
+	Search      *SearchHit     `json:"-"`
+	Credits     []*Credit      `json:"-"`
+	Rating      *RatingSummary `json:"-"`
+	InWatchlist *bool          `json:"-"`
+	Poster      string         `json:"-"`
 }
 
-func (m VideoModel) Insert(video *Video) error {
+// A SearchHit describes how a video matched a search query. Rank is the value of
+// ts_rank(), where higher is more relevant, and Title and Description are ts_headline()
+// snippets with the matching words wrapped in <b></b> tags.
+type SearchHit struct {
+	Rank        float64 `json:"rank"`
+	Title       string  `json:"title"`
+	Description string  `json:"description,omitempty"`
+}
+
+// Insert adds a new video, setting its ID, CreatedAt and Version fields, and records a
+// "create" revision for the user who added it.
+func (m VideoModel) Insert(ctx context.Context, video *Video, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return m.withTx(ctx, func(tx *sql.Tx) error {
+		return insertVideo(ctx, tx, video, userID)
+	})
+}
+
+// withTx runs fn inside a transaction, committing it if fn returns nil and rolling it
+// back otherwise.
+func (m VideoModel) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return withTx(ctx, m.DB, fn)
+}
+
+// withTx does the work of VideoModel.withTx(), and is shared with the other models which
+// need transactions.
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback() is a no-op once the transaction has been committed, so it's safe to
+	// defer it unconditionally.
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertVideo is the body of Insert(), run inside the transaction tx.
+func insertVideo(ctx context.Context, tx *sql.Tx, video *Video, userID int64) error {
+	if err := checkVideoGenres(ctx, tx, video.Genres); err != nil {
+		return err
+	}
 	// Define the SQL query for inserting a new record in the videos table and returning
 	// the system-generated data.
 	query := `
-INSERT INTO movies (title, year, runtime, genres)
-VALUES ($1, $2, $3, $4)
+INSERT INTO movies (title, description, language, year, runtime, genres)
+VALUES ($1, $2, $3, $4, $5, $6)
 RETURNING id, created_at, version`
 	// Create an args slice containing the values for the placeholder parameters from
 	// the video struct. Declaring this slice immediately next to our SQL query helps to
 	// make it nice and clear *what values are being used where* in the query.
-	args := []interface{}{video.Title, video.Year, video.Runtime, pq.Array(video.Genres)}
+	args := []interface{}{video.Title, video.Description, video.Language, video.Year, video.Runtime, pq.Array(video.Genres)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&video.ID, &video.CreatedAt, &video.Version)
+	if err != nil {
+		return translateVideoError(err)
+	}
+	video.Rating = &RatingSummary{}
+	return insertVideoRevision(ctx, tx, newVideoRevision(RevisionCreate, userID, nil, video))
+}
+
+// A BatchError is returned by InsertBatch() when one of the videos couldn't be inserted.
+// Index is the position of that video in the batch, and Err is the underlying error
+// (which may be a *ConstraintError). The whole batch is rolled back, so none of the
+// videos in it were saved.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch item %d: %s", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// InsertBatch inserts several videos in a single transaction, setting the ID, CreatedAt
+// and Version fields on each of them and recording a "create" revision for each. Either
+// all of the videos are saved or none are.
+func (m VideoModel) InsertBatch(ctx context.Context, videos []*Video, userID int64) error {
+	query := `
+INSERT INTO movies (title, description, language, year, runtime, genres)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&video.ID, &video.CreatedAt, &video.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback() is a no-op once the transaction has been committed, so it's safe to
+	// defer it unconditionally.
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, video := range videos {
+		if err := checkVideoGenres(ctx, tx, video.Genres); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+		args := []interface{}{video.Title, video.Description, video.Language, video.Year, video.Runtime, pq.Array(video.Genres)}
+		err := stmt.QueryRowContext(ctx, args...).Scan(&video.ID, &video.CreatedAt, &video.Version)
+		if err != nil {
+			return &BatchError{Index: i, Err: translateVideoError(err)}
+		}
+		video.Rating = &RatingSummary{}
+		err = insertVideoRevision(ctx, tx, newVideoRevision(RevisionCreate, userID, nil, video))
+		if err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return tx.Commit()
+}
+
+// SearchLanguages holds the PostgreSQL text search configurations that a video's title
+// and description can be indexed with. Each one stems words for its language, apart from
+// "simple", which only lowercases them.
+var SearchLanguages = []string{
+	"simple", "dutch", "english", "french", "german", "italian", "portuguese", "spanish",
 }
 
-// func ValidateVideo(v *validator.Validator, video *Video) {
-// 	v.Check(video.Title != "", "title", "must be provided")
-// 	v.Check(len(video.Title) <= 500, "title", "must not be more than 500 bytes long")
-// 	v.Check(video.Year != 0, "year", "must be provided")
-// 	v.Check(video.Year >= 1888, "year", "must be greater than 1888")
-// 	v.Check(video.Year <= int32(time.Now().Year()), "year", "must not be in the future")
-// 	v.Check(video.Runtime != 0, "runtime", "must be provided")
-// 	v.Check(video.Runtime > 0, "runtime", "must be a positive integer")
-// 	v.Check(video.Genres != nil, "genres", "must be provided")
-// 	v.Check(len(video.Genres) >= 1, "genres", "must contain at least 1 genre")
-// 	v.Check(len(video.Genres) <= 5, "genres", "must not contain more than 5 genres")
-// 	v.Check(validator.Unique(video.Genres), "genres", "must not contain duplicate values")
-// }
+// DefaultLanguage is the search language for a video created without one.
+const DefaultLanguage = "english"
+
+// ValidateVideo runs the checks for a video record. It is used for both creating and
+// updating a video, and mirrors the CHECK constraints on the movies table so that bad
+// input is reported as a 422 rather than surfacing as a database error. Whether the
+// genres exist is checked separately, when GenreRepository.Resolve() maps them to the
+// genre taxonomy.
+func ValidateVideo(v *validator.Validator, video *Video) {
+	v.Check(video.Title != "", "title", "must be provided")
+	v.Check(len(video.Title) <= 500, "title", "must not be more than 500 bytes long")
+
+	v.Check(len(video.Description) <= 10000, "description", "must not be more than 10000 bytes long")
+	v.Check(validator.In(video.Language, SearchLanguages...), "language", "must be one of "+strings.Join(SearchLanguages, ", "))
+
+	v.Check(video.Year != 0, "year", "must be provided")
+	v.Check(video.Year >= 1888, "year", "must be greater than 1888")
+	v.Check(video.Year <= int32(time.Now().Year()), "year", "must not be in the future")
+
+	v.Check(video.Runtime != 0, "runtime", "must be provided")
+	v.Check(video.Runtime > 0, "runtime", "must be a positive integer")
+
+	v.Check(video.Genres != nil, "genres", "must be provided")
+	v.Check(len(video.Genres) >= 1, "genres", "must contain at least 1 genre")
+	v.Check(len(video.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	v.Check(validator.Unique(video.Genres), "genres", "must not contain duplicate values")
+}
+
+// A ConstraintError is returned by Insert() and Update() when the database rejects a
+// video because of one of the CHECK constraints on the movies table, or because one of
+// its genres doesn't exist (with the constraint name "movies_genres_exist"). Field and
+// Message use the same keys as ValidateVideo(), so handlers can add them straight to the
+// validator's error map.
+type ConstraintError struct {
+	Constraint string
+	Field      string
+	Message    string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("violates check constraint %q", e.Constraint)
+}
+
+// videoConstraints maps the names of the movies table CHECK constraints (see migration
+// 000002) to the field and message reported to the client.
+var videoConstraints = map[string]ConstraintError{
+	"movies_runtime_check": {Field: "runtime", Message: "must be a positive integer"},
+	"movies_year_check":    {Field: "year", Message: "must be between 1888 and the current year"},
+	"genres_length_check":  {Field: "genres", Message: "must contain between 1 and 5 genres"},
+	// Added by migration 000009.
+	"movies_description_length_check": {Field: "description", Message: "must not be more than 10000 bytes long"},
+}
+
+// translateVideoError converts a CHECK constraint violation reported by PostgreSQL
+// into a *ConstraintError. Any other error is returned unchanged.
+func translateVideoError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "check_violation" {
+		if c, ok := videoConstraints[pqErr.Constraint]; ok {
+			return &ConstraintError{Constraint: pqErr.Constraint, Field: c.Field, Message: c.Message}
+		}
+	}
+	return err
+}
+
+// checkVideoGenres returns a *ConstraintError if any of the genres isn't the slug of a
+// genre. Handlers resolve genres with GenreRepository.Resolve() before a write, so this
+// only fails if a genre was deleted in between. It locks the genres table against writes
+// until the transaction ends, so that GenreModel.Delete() can't remove a genre the video
+// is about to use. The lock has to come before any lock on the movies table, which is
+// the order GenreModel.Delete() takes them in, or the two could deadlock.
+func checkVideoGenres(ctx context.Context, tx *sql.Tx, genres []string) error {
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE genres IN SHARE MODE`); err != nil {
+		return err
+	}
+	query := `
+SELECT slug FROM unnest($1::text[]) AS slug
+WHERE slug NOT IN (SELECT slug FROM genres)
+LIMIT 1`
+	var slug string
+	err := tx.QueryRowContext(ctx, query, pq.Array(genres)).Scan(&slug)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return err
+	}
+	return &ConstraintError{Constraint: "movies_genres_exist", Field: "genres", Message: fmt.Sprintf("contains unknown genre %q", slug)}
+}
 
 // Implement a MarshalJSON() method on the Video struct, so that it satisfies the
 // json.Marshaler interface.
@@ -70,45 +282,66 @@ func (m Video) MarshalJSON() ([]byte, error) {
 	// a CreatedAt field at all (there's no point including one, because we don't want
 	// it to appear in the JSON output).
 	aux := struct {
-		ID      int64    `json:"id"`
-		Title   string   `json:"title"`
-		Year    int32    `json:"year,omitempty"`
-		Runtime string   `json:"runtime,omitempty"` // This is a string.
-		Genres  []string `json:"genres,omitempty"`
-		Version int32    `json:"version"`
+		ID          int64    `json:"id"`
+		Title       string   `json:"title"`
+		Description string   `json:"description,omitempty"`
+		Language    string   `json:"language,omitempty"`
+		Year        int32    `json:"year,omitempty"`
+		Runtime     string   `json:"runtime,omitempty"` // This is a string.
+		Genres      []string `json:"genres,omitempty"`
+		Version     int32    `json:"version"`
+		// The trash fields are left out of the JSON for live videos.
+		DeletedAt   *time.Time        `json:"deleted_at,omitempty"`
+		DeletedBy   *int64            `json:"deleted_by,omitempty"`
+		Search      *SearchHit        `json:"search,omitempty"`
+		Credits     []*Credit         `json:"credits,omitempty"`
+		Rating      *RatingSummary    `json:"rating,omitempty"`
+		InWatchlist *bool             `json:"in_watchlist,omitempty"`
+		Poster      map[string]string `json:"poster,omitempty"`
 	}{
 		// Set the values for the anonymous struct.
-		ID:      m.ID,
-		Title:   m.Title,
-		Year:    m.Year,
-		Runtime: runtime, // Note that we assign the value from the runtime variable here.
-		Genres:  m.Genres,
-		Version: m.Version,
+		ID:          m.ID,
+		Title:       m.Title,
+		Description: m.Description,
+		Language:    m.Language,
+		Year:        m.Year,
+		Runtime:     runtime, // Note that we assign the value from the runtime variable here.
+		Genres:      m.Genres,
+		Version:     m.Version,
+		DeletedAt:   m.DeletedAt,
+		DeletedBy:   m.DeletedBy,
+		Search:      m.Search,
+		Credits:     m.Credits,
+		Rating:      m.Rating,
+		InWatchlist: m.InWatchlist,
+		Poster:      m.posterURLs(),
 	}
 	// Encode the anonymous struct to JSON, and return it.
 	return json.Marshal(aux)
 }
 
 type VideoModel struct {
-	DB *sql.DB
+	DB           *sql.DB
+	QueryTimeout time.Duration
 }
 
 // Add a placeholder method for inserting a new record in the Videos table.
 
 // Add a placeholder method for fetching a specific record from the Videos table.
-func (m VideoModel) Get(id int64) (*Video, error) {
+func (m VideoModel) Get(ctx context.Context, id int64) (*Video, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	// Define the SQL query for retrieving the video data.
 	query := `
-SELECT id, created_at, title, year, runtime, genres, version
+SELECT id, created_at, title, description, language, year, runtime, genres, version, rating, rating_count, poster
 FROM movies
-WHERE id = $1`
+WHERE id = $1 AND deleted_at IS NULL`
 	// Declare a video struct to hold the data returned by the query.
 	var video Video
+	video.Rating = &RatingSummary{}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 
 	defer cancel()
 
@@ -120,10 +353,15 @@ WHERE id = $1`
 		&video.ID,
 		&video.CreatedAt,
 		&video.Title,
+		&video.Description,
+		&video.Language,
 		&video.Year,
 		&video.Runtime,
 		pq.Array(&video.Genres),
 		&video.Version,
+		&video.Rating.Average,
+		&video.Rating.Count,
+		&video.Poster,
 	)
 	// Handle any errors. If there was no matching video found, Scan() will return
 	// a sql.ErrNoRows error. We check for this and return our custom ErrRecordNotFound
@@ -141,28 +379,42 @@ WHERE id = $1`
 
 }
 
-// Add a placeholder method for updating a specific record in the Videos table.
-func (m VideoModel) Update(Video *Video) error {
+// Update saves the changes to a video and records an "update" revision for the user who
+// made them. The write only succeeds if the stored version still matches video.Version;
+// otherwise ErrEditConflict is returned and nothing is changed.
+func (m VideoModel) Update(ctx context.Context, video *Video, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return m.withTx(ctx, func(tx *sql.Tx) error {
+		return updateVideo(ctx, tx, video, userID)
+	})
+}
+
+// updateVideo is the body of Update(), run inside the transaction tx.
+func updateVideo(ctx context.Context, tx *sql.Tx, video *Video, userID int64) error {
+	if err := checkVideoGenres(ctx, tx, video.Genres); err != nil {
+		return err
+	}
 	query := `
 UPDATE movies
-SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-WHERE id = $5 AND version = $6
+SET title = $1, description = $2, language = $3, year = $4, runtime = $5, genres = $6, version = version + 1
+WHERE id = $7 AND version = $8 AND deleted_at IS NULL
 RETURNING version`
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []interface{}{
-		Video.Title,
-		Video.Year,
-		Video.Runtime,
-		pq.Array(Video.Genres),
-		Video.ID,
-		Video.Version,
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	// Use the QueryRow() method to execute the query, passing in the args slice as a
-	// variadic parameter and scanning the new version value into the Video struct.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&Video.Version)
+		video.Title,
+		video.Description,
+		video.Language,
+		video.Year,
+		video.Runtime,
+		pq.Array(video.Genres),
+		video.ID,
+		video.Version,
+	}
+	// Read the stored video for the revision's "before" snapshot. This applies the same
+	// version check as the UPDATE, and locks the row so it can't change in between.
+	before, err := lockVideo(ctx, tx, video.ID, "version = $2 AND deleted_at IS NULL", video.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -171,24 +423,81 @@ RETURNING version`
 			return err
 		}
 	}
-	return nil
-
+	// Use the QueryRow() method to execute the query, passing in the args slice as a
+	// variadic parameter and scanning the new version value into the video struct.
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&video.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return translateVideoError(err)
+		}
+	}
+	return insertVideoRevision(ctx, tx, newVideoRevision(RevisionUpdate, userID, before, video))
 }
-func (m VideoModel) GetAll(title string, genres []string, filters Filters) ([]*Video, Metadata, error) {
-	// Construct the SQL query to retrieve all movie records.
+
+// lockVideo fetches a video inside a transaction with SELECT ... FOR UPDATE, so that no
+// other transaction can change it until tx ends. The condition is added to the WHERE
+// clause, with the video ID as $1 and args following on from $2. If no row matches,
+// sql.ErrNoRows is returned.
+func lockVideo(ctx context.Context, tx *sql.Tx, id int64, condition string, args ...interface{}) (*Video, error) {
 	query := fmt.Sprintf(`
-SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+SELECT id, created_at, title, description, language, year, runtime, genres, version, deleted_at, deleted_by, rating, rating_count, poster
 FROM movies
-WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-AND (genres @> $2 OR $2 = '{}')
-ORDER BY %s %s, id ASC
-LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+WHERE id = $1 AND %s
+FOR UPDATE`, condition)
+	video := Video{Rating: &RatingSummary{}}
+	err := tx.QueryRowContext(ctx, query, append([]interface{}{id}, args...)...).Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.Title,
+		&video.Description,
+		&video.Language,
+		&video.Year,
+		&video.Runtime,
+		pq.Array(&video.Genres),
+		&video.Version,
+		&video.DeletedAt,
+		&video.DeletedBy,
+		&video.Rating.Average,
+		&video.Rating.Count,
+		&video.Poster,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &video, nil
+}
+
+func (m VideoModel) GetAll(ctx context.Context, videoFilter VideoFilter, filters Filters) ([]*Video, Metadata, error) {
+	if filters.CursorMode {
+		return m.getAllByCursor(ctx, videoFilter, filters)
+	}
+	// Construct the SQL query to retrieve all movie records. The WHERE conditions are
+	// built from the filter, and the LIMIT and OFFSET placeholders follow on from the
+	// filter's arguments. The inner query selects the page of rows, and the outer one
+	// adds the search highlights, so that ts_headline() (which is slow) only runs on the
+	// rows that are actually returned.
+	conditions, args := videoFilter.sqlConditions(nil)
+	rank, headlines, args := videoFilter.searchColumns(args)
+	args = append(args, filters.limit(), filters.offset())
+	orderBy := videoOrderBy(filters)
+	query := fmt.Sprintf(`
+SELECT total, id, created_at, title, description, language, year, runtime, genres, version, deleted_at, deleted_by, rating, rating_count, poster, rank, %s
+FROM (
+	SELECT count(*) OVER() AS total, id, created_at, title, description, language, year, runtime, genres, version, deleted_at, deleted_by, rating, rating_count, poster, %s AS rank
+	FROM movies
+	WHERE %s
+	ORDER BY %s
+	LIMIT $%d OFFSET $%d
+) AS page
+ORDER BY %s`, headlines, rank, conditions, orderBy, len(args)-1, len(args), orderBy)
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Derive a context with the configured query timeout from the caller's context.
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
 	rows, err := m.DB.QueryContext(ctx, query, args...)
@@ -206,7 +515,8 @@ LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 	// Use rows.Next to iterate through the rows in the resultset.
 	for rows.Next() {
 		// Initialize an empty Movie struct to hold the data for an individual movie.
-		var video Video
+		video := Video{Rating: &RatingSummary{}}
+		var hit SearchHit
 		// Scan the values from the row into the Movie struct. Again, note that we're
 		// using the pq.Array() adapter on the genres field here.
 		err := rows.Scan(
@@ -214,14 +524,27 @@ LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 			&video.ID,
 			&video.CreatedAt,
 			&video.Title,
+			&video.Description,
+			&video.Language,
 			&video.Year,
 			&video.Runtime,
 			pq.Array(&video.Genres),
 			&video.Version,
+			&video.DeletedAt,
+			&video.DeletedBy,
+			&video.Rating.Average,
+			&video.Rating.Count,
+			&video.Poster,
+			&hit.Rank,
+			&hit.Title,
+			&hit.Description,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		if videoFilter.Search != "" {
+			video.Search = &hit
+		}
 
 		// Add the Movie struct to the slice.
 		videos = append(videos, &video)
@@ -237,38 +560,555 @@ LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 	return videos, metadata, nil
 }
 
-// Add a placeholder method for deleting a specific record from the Videos table.
-func (m VideoModel) Delete(id int64) error {
+// getAllByCursor is the keyset pagination version of GetAll(). Rather than counting and
+// skipping the rows on earlier pages with OFFSET, it asks for the rows which sort after
+// (or, for a backward cursor, before) the last row the client saw. That lets PostgreSQL
+// start reading from the right place however deep into the listing the client is.
+func (m VideoModel) getAllByCursor(ctx context.Context, videoFilter VideoFilter, filters Filters) ([]*Video, Metadata, error) {
+	column, direction := filters.sortColumn(), filters.sortDirection()
+
+	filterClause, args := videoFilter.sqlConditions(nil)
+	filterArgs := len(args)
+	whereClause := filterClause
+
+	// Rows are ordered by the sort column and then by id, so the keyset condition has to
+	// compare the pair. When paging backwards we flip both comparisons and the ordering,
+	// then reverse the rows afterwards so the client always gets them in sort order.
+	c, paged := filters.cursor()
+	backward := paged && c.Backward
+	orderClause := fmt.Sprintf("%s %s, id ASC", column, direction)
+	if backward {
+		orderClause = fmt.Sprintf("%s %s, id DESC", column, reverseDirection(direction))
+	}
+	if paged {
+		if _, err := videoFromCursor(column, c); err != nil {
+			return nil, Metadata{}, err
+		}
+		columnOp, idOp := ">", ">"
+		if direction == "DESC" {
+			columnOp = "<"
+		}
+		if backward {
+			columnOp, idOp = reverseOperator(columnOp), "<"
+		}
+		args = append(args, c.Value, c.ID)
+		whereClause += fmt.Sprintf("\nAND (%[1]s %[2]s $%[4]d OR (%[1]s = $%[4]d AND id %[3]s $%[5]d))",
+			column, columnOp, idOp, len(args)-1, len(args))
+	}
+	// Fetch one row more than we need, so we know whether there's another page. As in
+	// GetAll(), the search highlights are added by an outer query.
+	rank, headlines, args := videoFilter.searchColumns(args)
+	args = append(args, filters.limit()+1)
+	query := fmt.Sprintf(`
+SELECT id, created_at, title, description, language, year, runtime, genres, version, deleted_at, deleted_by, rating, rating_count, poster, rank, %s
+FROM (
+	SELECT id, created_at, title, description, language, year, runtime, genres, version, deleted_at, deleted_by, rating, rating_count, poster, %s AS rank
+	FROM movies
+	WHERE %s
+	ORDER BY %s
+	LIMIT $%d
+) AS page
+ORDER BY %s`, headlines, rank, whereClause, orderClause, len(args), orderClause)
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	videos := []*Video{}
+	for rows.Next() {
+		video := Video{Rating: &RatingSummary{}}
+		var hit SearchHit
+		err := rows.Scan(
+			&video.ID,
+			&video.CreatedAt,
+			&video.Title,
+			&video.Description,
+			&video.Language,
+			&video.Year,
+			&video.Runtime,
+			pq.Array(&video.Genres),
+			&video.Version,
+			&video.DeletedAt,
+			&video.DeletedBy,
+			&video.Rating.Average,
+			&video.Rating.Count,
+			&video.Poster,
+			&hit.Rank,
+			&hit.Title,
+			&hit.Description,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		if videoFilter.Search != "" {
+			video.Search = &hit
+		}
+		videos = append(videos, &video)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// Counting every matching row is exactly the cost that keyset pagination avoids, so
+	// only do it when the client asked for the total.
+	totalRecords := -1
+	if filters.IncludeTotal {
+		query := fmt.Sprintf("SELECT count(*) FROM movies WHERE %s", filterClause)
+		err = m.DB.QueryRowContext(ctx, query, args[:filterArgs]...).Scan(&totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+	videos, metadata := videoCursorPage(videos, filters, backward, totalRecords)
+	return videos, metadata, nil
+}
+
+// searchColumns returns the SQL for a video's search rank and for its title and
+// description headlines, adding the query to args. When the filter has no search query
+// the rank is zero and the headlines are empty, so listing queries can select the same
+// columns either way. The headline expressions refer to the language, title and
+// description columns by name.
+func (f VideoFilter) searchColumns(args []interface{}) (string, string, []interface{}) {
+	if f.Search == "" {
+		return "0::real", "'', ''", args
+	}
+	args = append(args, f.Search)
+	query := fmt.Sprintf("websearch_to_tsquery(language, $%d)", len(args))
+	rank := fmt.Sprintf("ts_rank(search_vector, %s)", query)
+	headlines := fmt.Sprintf("ts_headline(language, title, %[1]s, 'HighlightAll=true'), "+
+		"ts_headline(language, description, %[1]s, 'MaxFragments=2, MinWords=5, MaxWords=20')", query)
+	return rank, headlines, args
+}
+
+// videoOrderBy returns the ORDER BY clause for a video listing. Sorting by relevance
+// puts the best matches first; every other sort follows the direction in filters.Sort.
+// Ties are broken by ID.
+func videoOrderBy(filters Filters) string {
+	column := filters.sortColumn()
+	if column == "relevance" {
+		return "rank DESC, id ASC"
+	}
+	return fmt.Sprintf("%s %s, id ASC", column, filters.sortDirection())
+}
+
+// videoCursorPage trims the extra row fetched by a keyset query, puts the rows back in
+// sort order and works out the cursors for the neighbouring pages.
+func videoCursorPage(videos []*Video, filters Filters, backward bool, totalRecords int) ([]*Video, Metadata) {
+	hasMore := len(videos) > filters.limit()
+	if hasMore {
+		videos = videos[:filters.limit()]
+	}
+	if backward {
+		for i, j := 0, len(videos)-1; i < j; i, j = i+1, j-1 {
+			videos[i], videos[j] = videos[j], videos[i]
+		}
+	}
+	if len(videos) == 0 {
+		return videos, calculateCursorMetadata(filters, cursor{}, cursor{}, true, false, totalRecords)
+	}
+	column := filters.sortColumn()
+	first, last := videos[0], videos[len(videos)-1]
+	return videos, calculateCursorMetadata(filters,
+		cursor{Value: first.sortValue(column), ID: first.ID},
+		cursor{Value: last.sortValue(column), ID: last.ID},
+		false, hasMore, totalRecords)
+}
+
+// sortValue returns the value of one of the sortable columns as a string, for storing in
+// a pagination cursor.
+func (video *Video) sortValue(column string) string {
+	switch column {
+	case "id":
+		return strconv.FormatInt(video.ID, 10)
+	case "title":
+		return video.Title
+	case "year":
+		return strconv.FormatInt(int64(video.Year), 10)
+	case "runtime":
+		return strconv.FormatInt(int64(video.Runtime), 10)
+	case "rating":
+		return strconv.FormatFloat(video.Rating.Average, 'f', -1, 64)
+	case "rating_count":
+		return strconv.FormatInt(int64(video.Rating.Count), 10)
+	default:
+		panic("unsupported sort column: " + column)
+	}
+}
+
+// videoFromCursor does the reverse of sortValue(), returning a Video which holds the
+// cursor's ID and sort value. It returns ErrInvalidCursor if the value can't be parsed
+// for the column.
+func videoFromCursor(column string, c cursor) (*Video, error) {
+	video := &Video{ID: c.ID, Rating: &RatingSummary{}}
+	switch column {
+	case "title":
+		video.Title = c.Value
+		return video, nil
+	case "rating":
+		average, err := strconv.ParseFloat(c.Value, 64)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		video.Rating.Average = average
+		return video, nil
+	}
+	n, err := strconv.ParseInt(c.Value, 10, 32)
+	if column == "id" {
+		n, err = strconv.ParseInt(c.Value, 10, 64)
+	}
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	switch column {
+	case "id":
+		video.ID = n
+	case "year":
+		video.Year = int32(n)
+	case "runtime":
+		video.Runtime = Runtime(n)
+	case "rating_count":
+		video.Rating.Count = int32(n)
+	default:
+		panic("unsupported sort column: " + column)
+	}
+	return video, nil
+}
+
+func reverseDirection(direction string) string {
+	if direction == "DESC" {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+func reverseOperator(op string) string {
+	if op == "<" {
+		return ">"
+	}
+	return "<"
+}
+
+// Stream calls fn for every video matching the filter, in the order given by
+// filters.Sort (the paging fields of filters are ignored). The rows are read from a
+// single query, so fn sees a consistent snapshot of the table even if other requests
+// change it part way through, and only one row is held in memory at a time. If fn
+// returns an error, Stream stops and returns it.
+//
+// Streaming a large catalogue can take much longer than a normal query, so the
+// configured QueryTimeout isn't applied here; the caller's context controls how long
+// the query may run.
+func (m VideoModel) Stream(ctx context.Context, videoFilter VideoFilter, filters Filters, fn func(*Video) error) error {
+	conditions, args := videoFilter.sqlConditions(nil)
+	query := fmt.Sprintf(`
+SELECT id, created_at, title, description, language, year, runtime, genres, version, rating, rating_count, poster
+FROM movies
+WHERE %s
+ORDER BY %s %s, id ASC`, conditions, filters.sortColumn(), filters.sortDirection())
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		video := Video{Rating: &RatingSummary{}}
+		err := rows.Scan(
+			&video.ID,
+			&video.CreatedAt,
+			&video.Title,
+			&video.Description,
+			&video.Language,
+			&video.Year,
+			&video.Runtime,
+			pq.Array(&video.Genres),
+			&video.Version,
+			&video.Rating.Average,
+			&video.Rating.Count,
+			&video.Poster,
+		)
+		if err != nil {
+			return err
+		}
+		if err := fn(&video); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// A FacetCount is the number of matching videos which share a value, such as a genre.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets summarises the videos matching a VideoFilter. Genres are ordered by count
+// (most common first), decades chronologically, and runtime buckets in the order of
+// RuntimeBuckets, including any empty ones.
+type Facets struct {
+	TotalRecords int          `json:"total_records"`
+	Genres       []FacetCount `json:"genres"`
+	Decades      []FacetCount `json:"decades"`
+	Runtimes     []FacetCount `json:"runtimes"`
+}
+
+// RuntimeBuckets defines the runtime ranges reported by GetFacets(). Each bucket runs
+// from its Min up to the next bucket's Min; the last one is open-ended.
+var RuntimeBuckets = []struct {
+	Label string
+	Min   Runtime
+}{
+	{"under 90 mins", 0},
+	{"90-119 mins", 90},
+	{"120-149 mins", 120},
+	{"150 mins and over", 150},
+}
+
+// runtimeBucket returns the index in RuntimeBuckets for a runtime.
+func runtimeBucket(runtime Runtime) int {
+	bucket := 0
+	for i, b := range RuntimeBuckets {
+		if runtime >= b.Min {
+			bucket = i
+		}
+	}
+	return bucket
+}
+
+// newFacets assembles a Facets value from raw counts, putting each list in its
+// documented order.
+func newFacets(total int, genres, decades map[string]int, runtimes []int) *Facets {
+	facets := &Facets{
+		TotalRecords: total,
+		Genres:       []FacetCount{},
+		Decades:      []FacetCount{},
+		Runtimes:     []FacetCount{},
+	}
+	for genre, count := range genres {
+		facets.Genres = append(facets.Genres, FacetCount{Value: genre, Count: count})
+	}
+	sort.Slice(facets.Genres, func(i, j int) bool {
+		if facets.Genres[i].Count != facets.Genres[j].Count {
+			return facets.Genres[i].Count > facets.Genres[j].Count
+		}
+		return facets.Genres[i].Value < facets.Genres[j].Value
+	})
+	for decade, count := range decades {
+		facets.Decades = append(facets.Decades, FacetCount{Value: decade, Count: count})
+	}
+	sort.Slice(facets.Decades, func(i, j int) bool {
+		return facets.Decades[i].Value < facets.Decades[j].Value
+	})
+	for i, b := range RuntimeBuckets {
+		facets.Runtimes = append(facets.Runtimes, FacetCount{Value: b.Label, Count: runtimes[i]})
+	}
+	return facets
+}
+
+// decadeLabel returns the label for the decade containing a year, such as "1990s".
+func decadeLabel(year int32) string {
+	return fmt.Sprintf("%ds", year/10*10)
+}
+
+// GetFacets counts the videos matching the filter by genre, by decade and by runtime
+// bucket. All of the counts come from a single query: the CTE applies the filter once
+// (using the same GIN indexes as GetAll()), and each branch of the UNION groups the
+// matching rows in a different way.
+func (m VideoModel) GetFacets(ctx context.Context, videoFilter VideoFilter) (*Facets, error) {
+	conditions, args := videoFilter.sqlConditions(nil)
+	// Build a CASE expression which maps a runtime to its index in RuntimeBuckets. The
+	// bucket boundaries are integers from our own code, so it's safe to interpolate them.
+	bucketCase := "CASE"
+	for i := len(RuntimeBuckets) - 1; i > 0; i-- {
+		bucketCase += fmt.Sprintf(" WHEN runtime >= %d THEN %d", RuntimeBuckets[i].Min, i)
+	}
+	bucketCase += " ELSE 0 END"
+	query := fmt.Sprintf(`
+WITH matches AS (
+	SELECT year, runtime, genres
+	FROM movies
+	WHERE %s
+)
+SELECT 'total', '', count(*) FROM matches
+UNION ALL
+SELECT 'genre', genre, count(*) FROM matches, unnest(genres) AS genre GROUP BY 2
+UNION ALL
+SELECT 'decade', (year / 10 * 10)::text, count(*) FROM matches GROUP BY 2
+UNION ALL
+SELECT 'runtime', (%s)::text, count(*) FROM matches GROUP BY 2`, conditions, bucketCase)
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var total int
+	genres := make(map[string]int)
+	decades := make(map[string]int)
+	runtimes := make([]int, len(RuntimeBuckets))
+	for rows.Next() {
+		var kind, value string
+		var count int
+		if err := rows.Scan(&kind, &value, &count); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "total":
+			total = count
+		case "genre":
+			genres[value] = count
+		case "decade":
+			decades[value+"s"] = count
+		case "runtime":
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			runtimes[i] = count
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return newFacets(total, genres, decades, runtimes), nil
+}
+
+// Delete moves a video to the trash by setting its deleted_at and deleted_by columns, and
+// records a "delete" revision. Trashed videos are hidden from Get(), GetAll() and the
+// other read methods (unless the filter asks for the trash), can be brought back with
+// Restore(), and are removed for good by Purge(). Deleting a video which is already in
+// the trash returns ErrRecordNotFound. If version is not zero, the video is only deleted
+// if it's still at that version, and ErrEditConflict is returned if it isn't.
+func (m VideoModel) Delete(ctx context.Context, id int64, version int32, deletedBy int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
-	// Construct the SQL query to delete the record.
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return m.withTx(ctx, func(tx *sql.Tx) error {
+		return deleteVideo(ctx, tx, id, version, deletedBy)
+	})
+}
+
+// deleteVideo is the body of Delete(), run inside the transaction tx. If version is not
+// zero, the video is only deleted if its stored version matches, and ErrEditConflict is
+// returned if it doesn't.
+func deleteVideo(ctx context.Context, tx *sql.Tx, id int64, version int32, deletedBy int64) error {
+	// The version is bumped so that any ETag a client holds for the live video no longer
+	// matches once it has been deleted (and later restored).
 	query := `
-DELETE FROM movies
-WHERE id = $1`
-	// Execute the SQL query using the Exec() method, passing in the id variable as
-	// the value for the placeholder parameter. The Exec() method returns a sql.Result
-	// object.
+UPDATE movies
+SET deleted_at = NOW(), deleted_by = $2, version = version + 1
+WHERE id = $1
+RETURNING deleted_at, deleted_by, version`
+
+	// If there's no live video with this ID, it either never existed or is already in
+	// the trash. In both cases we return an ErrRecordNotFound error.
+	before, err := lockVideo(ctx, tx, id, "deleted_at IS NULL")
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if version != 0 && before.Version != version {
+		return ErrEditConflict
+	}
+	after := copyVideo(before)
+	err = tx.QueryRowContext(ctx, query, id, deletedBy).Scan(&after.DeletedAt, &after.DeletedBy, &after.Version)
+	if err != nil {
+		return err
+	}
+	return insertVideoRevision(ctx, tx, newVideoRevision(RevisionDelete, deletedBy, before, after))
+}
+
+// Restore takes a video out of the trash, records a "restore" revision for the user who
+// restored it, and returns the video. It returns ErrRecordNotFound if there is no video
+// in the trash with the given ID.
+func (m VideoModel) Restore(ctx context.Context, id int64, userID int64) (*Video, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+UPDATE movies
+SET deleted_at = NULL, deleted_by = NULL, version = version + 1
+WHERE id = $1
+RETURNING version`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Call the RowsAffected() method on the sql.Result object to get the number of rows
-	// affected by the query.
-	rowsAffected, err := result.RowsAffected()
+	defer tx.Rollback()
+	before, err := lockVideo(ctx, tx, id, "deleted_at IS NOT NULL")
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
 	}
-	// If no rows were affected, we know that the Videos table didn't contain a record
-	// with the provided ID at the moment we tried to delete it. In that case we
-	// return an ErrRecordNotFound error.
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	video := copyVideo(before)
+	video.DeletedAt, video.DeletedBy = nil, nil
+	err = tx.QueryRowContext(ctx, query, id).Scan(&video.Version)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	err = insertVideoRevision(ctx, tx, newVideoRevision(RevisionRestore, userID, before, video))
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return video, nil
+}
+
+// Purge permanently deletes every video which was moved to the trash before the given
+// time, along with its revisions, and returns the poster keys of the videos removed
+// (which the caller must delete from blob storage) and the number of videos removed.
+func (m VideoModel) Purge(ctx context.Context, deletedBefore time.Time) ([]string, int64, error) {
+	query := `
+DELETE FROM movies
+WHERE deleted_at < $1
+RETURNING poster`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
 
+	rows, err := m.DB.QueryContext(ctx, query, deletedBefore)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	posters := []string{}
+	var purged int64
+	for rows.Next() {
+		var poster string
+		if err := rows.Scan(&poster); err != nil {
+			return nil, 0, err
+		}
+		if poster != "" {
+			posters = append(posters, poster)
+		}
+		purged++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return posters, purged, nil
 }
@@ -0,0 +1,365 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"assignment_2.alexedwards.net/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrDuplicateWatchlistItem is returned when a video is added to a list it's
+	// already on.
+	ErrDuplicateWatchlistItem = errors.New("duplicate watchlist item")
+	// ErrWatchlistFull is returned when a video is added to a list which already holds
+	// MaxWatchlistItems videos.
+	ErrWatchlistFull = errors.New("watchlist full")
+)
+
+// DefaultWatchlist is the name of the list used when a request doesn't name one.
+const DefaultWatchlist = "watchlist"
+
+// MaxWatchlistItems is the largest number of videos a single list can hold.
+const MaxWatchlistItems = 1000
+
+// A WatchlistItem is a video on one of a user's lists. Position orders the list from 1.
+// Title and Year are copied from the video when items are read. Watched is true if the
+// user has marked the video as watched, at WatchedAt.
+type WatchlistItem struct {
+	List      string     `json:"list"`
+	VideoID   int64      `json:"video_id"`
+	Title     string     `json:"title"`
+	Year      int32      `json:"year,omitempty"`
+	Position  int32      `json:"position"`
+	AddedAt   time.Time  `json:"added_at"`
+	Watched   bool       `json:"watched"`
+	WatchedAt *time.Time `json:"watched_at,omitempty"`
+}
+
+// A WatchlistSummary describes one of a user's lists.
+type WatchlistSummary struct {
+	Name    string `json:"name"`
+	Count   int    `json:"count"`
+	Watched int    `json:"watched"`
+}
+
+func ValidateWatchlistName(v *validator.Validator, name string) {
+	v.Check(name != "", "list", "must be provided")
+	v.Check(len(name) <= 50, "list", "must not be more than 50 bytes long")
+}
+
+// ValidateWatchlistItem checks an item before it's saved. A Position of 0 means the end
+// of the list.
+func ValidateWatchlistItem(v *validator.Validator, item *WatchlistItem) {
+	ValidateWatchlistName(v, item.List)
+	v.Check(item.VideoID > 0, "video_id", "must be a positive integer")
+	v.Check(item.Position >= 0, "position", "must not be negative")
+}
+
+type WatchlistModel struct {
+	DB           *sql.DB
+	QueryTimeout time.Duration
+}
+
+// GetLists returns a summary of each of the user's lists, in name order. Videos in the
+// trash aren't counted.
+func (m WatchlistModel) GetLists(ctx context.Context, userID int64) ([]*WatchlistSummary, error) {
+	query := `
+SELECT watchlist_items.list, count(*), count(watchlist_items.watched_at)
+FROM watchlist_items
+INNER JOIN movies ON movies.id = watchlist_items.video_id
+WHERE watchlist_items.user_id = $1 AND movies.deleted_at IS NULL
+GROUP BY watchlist_items.list
+ORDER BY watchlist_items.list`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lists := []*WatchlistSummary{}
+	for rows.Next() {
+		var list WatchlistSummary
+		if err := rows.Scan(&list.Name, &list.Count, &list.Watched); err != nil {
+			return nil, err
+		}
+		lists = append(lists, &list)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+// watchlistItemColumns selects an item from watchlist_items joined to movies, in the
+// order read by scanWatchlistItem().
+const watchlistItemColumns = `watchlist_items.list, watchlist_items.video_id, movies.title, movies.year,
+	watchlist_items.position, watchlist_items.added_at, watchlist_items.watched_at`
+
+func scanWatchlistItem(row interface{ Scan(...interface{}) error }) (*WatchlistItem, error) {
+	var item WatchlistItem
+	err := row.Scan(&item.List, &item.VideoID, &item.Title, &item.Year, &item.Position, &item.AddedAt, &item.WatchedAt)
+	if err != nil {
+		return nil, err
+	}
+	item.Watched = item.WatchedAt != nil
+	return &item, nil
+}
+
+// GetItems returns the items on one of the user's lists in position order, leaving out
+// videos which are in the trash (which keep their positions, in case they're restored).
+// A list with no items is returned as an empty slice.
+func (m WatchlistModel) GetItems(ctx context.Context, userID int64, list string) ([]*WatchlistItem, error) {
+	query := fmt.Sprintf(`
+SELECT %s
+FROM watchlist_items
+INNER JOIN movies ON movies.id = watchlist_items.video_id
+WHERE watchlist_items.user_id = $1 AND watchlist_items.list = $2 AND movies.deleted_at IS NULL
+ORDER BY watchlist_items.position`, watchlistItemColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, list)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []*WatchlistItem{}
+	for rows.Next() {
+		item, err := scanWatchlistItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (m WatchlistModel) Get(ctx context.Context, userID int64, list string, videoID int64) (*WatchlistItem, error) {
+	query := fmt.Sprintf(`
+SELECT %s
+FROM watchlist_items
+INNER JOIN movies ON movies.id = watchlist_items.video_id
+WHERE watchlist_items.user_id = $1 AND watchlist_items.list = $2 AND watchlist_items.video_id = $3
+AND movies.deleted_at IS NULL`, watchlistItemColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	item, err := scanWatchlistItem(m.DB.QueryRowContext(ctx, query, userID, list, videoID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return item, nil
+}
+
+// Add puts a video on one of the user's lists at item.Position, moving the items from
+// that position onwards down by one. A Position of 0, or one past the end of the list,
+// adds the video at the end. The item's Position, Title, Year and AddedAt are set from
+// the saved row. It returns ErrRecordNotFound if the video doesn't exist or is in the
+// trash, ErrDuplicateWatchlistItem if it's already on the list and ErrWatchlistFull if
+// the list is full.
+func (m WatchlistModel) Add(ctx context.Context, userID int64, item *WatchlistItem) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		count, err := lockWatchlist(ctx, tx, userID, item.List)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, `SELECT title, year FROM movies WHERE id = $1 AND deleted_at IS NULL`,
+			item.VideoID).Scan(&item.Title, &item.Year)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		if count >= MaxWatchlistItems {
+			return ErrWatchlistFull
+		}
+		if item.Position < 1 || item.Position > count+1 {
+			item.Position = count + 1
+		}
+		_, err = tx.ExecContext(ctx, `
+UPDATE watchlist_items SET position = position + 1
+WHERE user_id = $1 AND list = $2 AND position >= $3`, userID, item.List, item.Position)
+		if err != nil {
+			return err
+		}
+		query := `
+INSERT INTO watchlist_items (user_id, list, video_id, position)
+VALUES ($1, $2, $3, $4)
+RETURNING added_at`
+		err = tx.QueryRowContext(ctx, query, userID, item.List, item.VideoID, item.Position).Scan(&item.AddedAt)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+				return ErrDuplicateWatchlistItem
+			}
+			return err
+		}
+		item.Watched, item.WatchedAt = false, nil
+		return nil
+	})
+}
+
+// Update moves an item to item.Position, shifting the items in between, and marks it
+// as watched or not according to item.Watched. A Position of 0, or one past the end of
+// the list, moves the item to the end. Marking an item as watched again keeps the time
+// it was first marked. It returns ErrRecordNotFound if the item doesn't exist.
+func (m WatchlistModel) Update(ctx context.Context, userID int64, item *WatchlistItem) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		count, err := lockWatchlist(ctx, tx, userID, item.List)
+		if err != nil {
+			return err
+		}
+		var current int32
+		err = tx.QueryRowContext(ctx, `
+SELECT position FROM watchlist_items
+WHERE user_id = $1 AND list = $2 AND video_id = $3`, userID, item.List, item.VideoID).Scan(&current)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		if item.Position < 1 || item.Position > count {
+			item.Position = count
+		}
+		// Close the gap at the item's current position and open one at the new position.
+		// Only the items in between move, up or down by one.
+		if item.Position < current {
+			_, err = tx.ExecContext(ctx, `
+UPDATE watchlist_items SET position = position + 1
+WHERE user_id = $1 AND list = $2 AND position >= $3 AND position < $4`, userID, item.List, item.Position, current)
+		} else if item.Position > current {
+			_, err = tx.ExecContext(ctx, `
+UPDATE watchlist_items SET position = position - 1
+WHERE user_id = $1 AND list = $2 AND position > $3 AND position <= $4`, userID, item.List, current, item.Position)
+		}
+		if err != nil {
+			return err
+		}
+		query := `
+UPDATE watchlist_items
+SET position = $1, watched_at = CASE WHEN $2 THEN coalesce(watched_at, NOW()) END
+WHERE user_id = $3 AND list = $4 AND video_id = $5
+RETURNING added_at, watched_at`
+		args := []interface{}{item.Position, item.Watched, userID, item.List, item.VideoID}
+		return tx.QueryRowContext(ctx, query, args...).Scan(&item.AddedAt, &item.WatchedAt)
+	})
+}
+
+// Remove takes a video off one of the user's lists, moving the items after it up by
+// one. It returns ErrRecordNotFound if the video isn't on the list.
+func (m WatchlistModel) Remove(ctx context.Context, userID int64, list string, videoID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		if _, err := lockWatchlist(ctx, tx, userID, list); err != nil {
+			return err
+		}
+		var position int32
+		err := tx.QueryRowContext(ctx, `
+DELETE FROM watchlist_items
+WHERE user_id = $1 AND list = $2 AND video_id = $3
+RETURNING position`, userID, list, videoID).Scan(&position)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, `
+UPDATE watchlist_items SET position = position - 1
+WHERE user_id = $1 AND list = $2 AND position > $3`, userID, list, position)
+		return err
+	})
+}
+
+// InWatchlist reports which of the videos are on any of the user's lists. Videos which
+// aren't on a list are left out of the map.
+func (m WatchlistModel) InWatchlist(ctx context.Context, userID int64, videoIDs []int64) (map[int64]bool, error) {
+	query := `
+SELECT DISTINCT video_id
+FROM watchlist_items
+WHERE user_id = $1 AND video_id = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, pq.Array(videoIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	in := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		in[id] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// lockWatchlist serializes changes to a user's lists by locking the user's row, since a
+// list has no row of its own to lock, and returns the number of items on the list.
+// Positions can only be kept without gaps if no two changes renumber a list at once.
+// Purging a video from the trash deletes its items without renumbering the lists they
+// were on, so any gaps that left are closed here first.
+func lockWatchlist(ctx context.Context, tx *sql.Tx, userID int64, list string) (int32, error) {
+	_, err := tx.ExecContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `
+UPDATE watchlist_items
+SET position = numbered.position
+FROM (
+	SELECT video_id, row_number() OVER (ORDER BY position) AS position
+	FROM watchlist_items
+	WHERE user_id = $1 AND list = $2
+) AS numbered
+WHERE watchlist_items.user_id = $1 AND watchlist_items.list = $2
+AND watchlist_items.video_id = numbered.video_id AND watchlist_items.position <> numbered.position`, userID, list)
+	if err != nil {
+		return 0, err
+	}
+	var count int32
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM watchlist_items WHERE user_id = $1 AND list = $2`,
+		userID, list).Scan(&count)
+	return count, err
+}
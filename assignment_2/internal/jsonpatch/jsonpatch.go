@@ -0,0 +1,327 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+// documents. Documents are the generic values produced by json.Unmarshal() into an
+// interface{}: map[string]interface{}, []interface{}, string, float64, bool and nil.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrTestFailed is returned by Apply() when a "test" operation doesn't match.
+	ErrTestFailed = errors.New("test operation failed")
+	// ErrPathNotFound is returned by Apply() when an operation refers to a location
+	// which doesn't exist in the document.
+	ErrPathNotFound = errors.New("path does not exist")
+)
+
+// MergePatch applies a JSON Merge Patch to target and returns the result. Objects in
+// the patch are merged recursively, a null member removes the member from the target,
+// and any other value replaces the target outright. The target is not modified.
+func MergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return deepCopy(patch)
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	result := make(map[string]interface{}, len(targetObj))
+	for name, value := range targetObj {
+		result[name] = deepCopy(value)
+	}
+	for name, value := range patchObj {
+		if value == nil {
+			delete(result, name)
+			continue
+		}
+		result[name] = MergePatch(result[name], value)
+	}
+	return result
+}
+
+// An Operation is a single step of a JSON Patch. Value is nil when the operation has no
+// "value" member, which is different from a member holding null.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// A Patch is a JSON Patch document: a list of operations applied in order.
+type Patch []Operation
+
+// Validate checks that every operation is one of the six defined by RFC 6902 and has
+// the members that operation needs. It doesn't look at the document being patched.
+func (p Patch) Validate() error {
+	for i, op := range p {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return fmt.Errorf("operation %d (%s) is missing a value", i, op.Op)
+			}
+		case "remove":
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return fmt.Errorf("operation %d (%s) has an invalid from: %w", i, op.Op, err)
+			}
+		case "":
+			return fmt.Errorf("operation %d is missing an op", i)
+		default:
+			return fmt.Errorf("operation %d has unknown op %q", i, op.Op)
+		}
+		if _, err := parsePointer(op.Path); err != nil {
+			return fmt.Errorf("operation %d (%s) has an invalid path: %w", i, op.Op, err)
+		}
+	}
+	return nil
+}
+
+// Apply runs the operations in order against doc and returns the result. The patch is
+// atomic: if any operation fails, an error is returned (wrapping ErrTestFailed or
+// ErrPathNotFound where appropriate) and doc is left as it was.
+func (p Patch) Apply(doc interface{}) (interface{}, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	doc = deepCopy(doc)
+	for i, op := range p {
+		var err error
+		doc, err = apply(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func apply(doc interface{}, op Operation) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	var value interface{}
+	if op.Value != nil {
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+	switch op.Op {
+	case "add":
+		return add(doc, path, value)
+	case "remove":
+		doc, _, err := remove(doc, path)
+		return doc, err
+	case "replace":
+		doc, _, err := remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "move":
+		from, _ := parsePointer(op.From)
+		// A location can't be moved into one of its own children.
+		if len(path) > len(from) && isPrefix(from, path) {
+			return nil, errors.New("cannot move a value into itself")
+		}
+		doc, moved, err := remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, moved)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		copied, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, deepCopy(copied))
+	case "test":
+		current, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped reference tokens. The
+// empty pointer refers to the whole document and has no tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%q must be empty or start with \"/\"", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex converts a reference token into an index for an array of length n. The
+// "-" token, and an index equal to n, are only allowed when adding.
+func arrayIndex(token string, n int, adding bool) (int, error) {
+	if token == "-" && adding {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, ErrPathNotFound
+	}
+	if i > n || (i == n && !adding) {
+		return 0, ErrPathNotFound
+	}
+	return i, nil
+}
+
+// get returns the value at path.
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, ErrPathNotFound
+		}
+	}
+	return doc, nil
+}
+
+// add inserts value at path, returning the updated document. Adding to an object member
+// replaces any existing value, while adding to an array shifts the later elements up.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[i+1:], node[i:])
+		node[i] = value
+		return set(doc, path[:len(path)-1], node)
+	default:
+		return nil, ErrPathNotFound
+	}
+}
+
+// remove deletes the value at path, returning the updated document and the value which
+// was removed.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[token]
+		if !ok {
+			return nil, nil, ErrPathNotFound
+		}
+		delete(node, token)
+		return doc, value, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[i]
+		node = append(node[:i], node[i+1:]...)
+		doc, err := set(doc, path[:len(path)-1], node)
+		return doc, value, err
+	default:
+		return nil, nil, ErrPathNotFound
+	}
+}
+
+// set replaces the value at an existing path. It's needed after an array changes length,
+// because the parent holds the old slice header.
+func set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = value
+	default:
+		return nil, ErrPathNotFound
+	}
+	return doc, nil
+}
+
+// deepCopy copies the maps and slices in a document, so that patching never changes
+// the caller's value.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		dup := make(map[string]interface{}, len(v))
+		for name, member := range v {
+			dup[name] = deepCopy(member)
+		}
+		return dup
+	case []interface{}:
+		dup := make([]interface{}, len(v))
+		for i, element := range v {
+			dup[i] = deepCopy(element)
+		}
+		return dup
+	default:
+		return v
+	}
+}
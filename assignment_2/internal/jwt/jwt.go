@@ -0,0 +1,257 @@
+// Package jwt issues and verifies the JSON Web Tokens (RFC 7519) used by the API's
+// stateless authentication mode. Tokens use the JWS compact serialization, signed with
+// HMAC-SHA256 ("HS256") or Ed25519 ("EdDSA"). Only the parts of the specifications that
+// the API needs are implemented: there's no encryption, and the only header fields are
+// "alg", "typ" and "kid".
+package jwt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+// clockSkew is how far in the future a token's issue time may be, to allow for the
+// clocks of the servers sharing the keys being slightly out.
+const clockSkew = 30 * time.Second
+
+var (
+	// ErrInvalidToken is returned by Verify() for a token which is malformed, has a bad
+	// signature, or doesn't have the expected claims.
+	ErrInvalidToken = errors.New("jwt: invalid token")
+	// ErrExpiredToken is returned by Verify() for a token which is otherwise valid but
+	// has expired.
+	ErrExpiredToken = errors.New("jwt: token has expired")
+)
+
+// Claims holds the claims carried by a token. Besides the registered claims, a token
+// says whether the user was activated and which permissions they had when it was
+// issued, so that requests can be authorized without a database query. Family is the
+// refresh token family the token was issued from, if any.
+//
+// IssuedAt is in seconds, like ExpiresAt, but with a fraction for the milliseconds (RFC
+// 7519 allows either), so that a token can be revoked by the time it was issued without
+// catching tokens issued later in the same second.
+type Claims struct {
+	Issuer      string   `json:"iss"`
+	Subject     string   `json:"sub"`
+	ID          string   `json:"jti"`
+	IssuedAt    float64  `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+	Activated   bool     `json:"act"`
+	Permissions []string `json:"perms,omitempty"`
+	Family      string   `json:"fam,omitempty"`
+}
+
+// NewClaims returns the claims for a token issued to subject at the given time, which
+// expires after ttl. The issue time is truncated to the millisecond, so the token never
+// appears to have been issued later than it was.
+func NewClaims(subject string, issuedAt time.Time, ttl time.Duration) *Claims {
+	return &Claims{
+		Subject:   subject,
+		IssuedAt:  float64(issuedAt.UnixMilli()) / 1000,
+		ExpiresAt: issuedAt.Add(ttl).Unix(),
+	}
+}
+
+// IssuedTime returns the time the token was issued.
+func (c *Claims) IssuedTime() time.Time {
+	return time.UnixMilli(int64(math.Round(c.IssuedAt * 1000)))
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid"`
+}
+
+// A Key is a signing key, identified by the "kid" header of the tokens it signs.
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+}
+
+// NewHMACKey returns an HS256 key. The secret must be at least 32 bytes long, the size
+// of the hash, as RFC 7518 requires.
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if len(secret) < sha256.Size {
+		return nil, fmt.Errorf("jwt: key %q: HS256 secret must be at least %d bytes", id, sha256.Size)
+	}
+	return &Key{ID: id, Algorithm: HS256, secret: secret}, nil
+}
+
+// NewEd25519Key returns an EdDSA key from a 32-byte Ed25519 seed.
+func NewEd25519Key(id string, seed []byte) (*Key, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("jwt: key %q: Ed25519 seed must be %d bytes", id, ed25519.SeedSize)
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+	return &Key{ID: id, Algorithm: EdDSA, private: private, public: private.Public().(ed25519.PublicKey)}, nil
+}
+
+// ParseKey parses a key in the form "<kid>:<alg>:<base64 secret or seed>", where alg is
+// HS256 or EdDSA. The secret may use standard or URL-safe base64, with or without
+// padding.
+func ParseKey(s string) (*Key, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, errors.New(`jwt: key must be in the form "<kid>:<alg>:<base64>"`)
+	}
+	id, algorithm := parts[0], parts[1]
+	material, err := decodeKeyMaterial(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: key %q: %w", id, err)
+	}
+	switch algorithm {
+	case HS256:
+		return NewHMACKey(id, material)
+	case EdDSA:
+		return NewEd25519Key(id, material)
+	default:
+		return nil, fmt.Errorf("jwt: key %q: unsupported algorithm %q", id, algorithm)
+	}
+}
+
+func decodeKeyMaterial(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+func (k *Key) sign(input []byte) []byte {
+	if k.Algorithm == EdDSA {
+		return ed25519.Sign(k.private, input)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	if k.Algorithm == EdDSA {
+		return ed25519.Verify(k.public, input, signature)
+	}
+	return hmac.Equal(k.sign(input), signature)
+}
+
+// A Keyset signs tokens with one key and verifies them with any of its keys, so that
+// keys can be rotated: a new key is added and made the signing key, and the old one is
+// kept until every token it signed has expired.
+type Keyset struct {
+	issuer  string
+	signing *Key
+	keys    map[string]*Key
+}
+
+// NewKeyset returns a Keyset which issues tokens from issuer, signed with the key whose
+// ID is signingKeyID.
+func NewKeyset(issuer, signingKeyID string, keys ...*Key) (*Keyset, error) {
+	ks := &Keyset{issuer: issuer, keys: make(map[string]*Key, len(keys))}
+	for _, key := range keys {
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key ID %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+	signing, ok := ks.keys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("jwt: no key with ID %q to sign with", signingKeyID)
+	}
+	ks.signing = signing
+	return ks, nil
+}
+
+// Sign sets the issuer claim, and a random ID if the claims don't have one, and returns
+// the signed token.
+func (ks *Keyset) Sign(claims *Claims) (string, error) {
+	claims.Issuer = ks.issuer
+	if claims.ID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		claims.ID = hex.EncodeToString(id)
+	}
+	h, err := json.Marshal(header{Algorithm: ks.signing.Algorithm, Type: "JWT", KeyID: ks.signing.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	signature := ks.signing.sign([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks a token's signature and claims at the given time, and returns the
+// claims. The algorithm in the header must be the one of the key named by its "kid",
+// which stops a token from choosing how it's verified (for example with "none").
+func (ks *Keyset) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, ok := ks.keys[h.KeyID]
+	if !ok || h.Algorithm != key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Issuer != ks.issuer || claims.Subject == "" || claims.ID == "" || claims.ExpiresAt == 0 {
+		return nil, ErrInvalidToken
+	}
+	if claims.IssuedTime().After(now.Add(clockSkew)) {
+		return nil, ErrInvalidToken
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// IsJWT reports whether a bearer token has the shape of a JWT, rather than being one of
+// the API's opaque tokens.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func decodeSegment(segment string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	return dec.Decode(dst)
+}
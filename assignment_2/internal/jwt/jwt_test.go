@@ -0,0 +1,247 @@
+package jwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeys(t *testing.T) (*Key, *Key) {
+	t.Helper()
+	hmacKey, err := NewHMACKey("hmac", bytes.Repeat([]byte("s"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, err := NewEd25519Key("ed", bytes.Repeat([]byte("e"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hmacKey, edKey
+}
+
+// replaceSegment returns token with its segment i replaced by the base64url encoding of
+// s.
+func replaceSegment(token string, i int, s string) string {
+	parts := strings.Split(token, ".")
+	parts[i] = base64.RawURLEncoding.EncodeToString([]byte(s))
+	return strings.Join(parts, ".")
+}
+
+func TestSignVerify(t *testing.T) {
+	hmacKey, edKey := newTestKeys(t)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 678*int(time.Millisecond), time.UTC)
+
+	tests := []struct {
+		name       string
+		signingKey *Key
+		// verifier returns the keyset to verify with, given the one the token was signed
+		// with.
+		verifier func(t *testing.T, signer *Keyset) *Keyset
+		// modify changes the signed token before it's verified.
+		modify  func(token string) string
+		claims  func(c *Claims)
+		at      time.Time
+		wantErr error
+	}{
+		{
+			name:       "HS256",
+			signingKey: hmacKey,
+		},
+		{
+			name:       "EdDSA",
+			signingKey: edKey,
+		},
+		{
+			name:       "Rotated key",
+			signingKey: hmacKey,
+			verifier: func(t *testing.T, signer *Keyset) *Keyset {
+				ks, err := NewKeyset("test", edKey.ID, hmacKey, edKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ks
+			},
+		},
+		{
+			name:       "Unknown key",
+			signingKey: hmacKey,
+			verifier: func(t *testing.T, signer *Keyset) *Keyset {
+				ks, err := NewKeyset("test", edKey.ID, edKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ks
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:       "Other issuer",
+			signingKey: hmacKey,
+			verifier: func(t *testing.T, signer *Keyset) *Keyset {
+				ks, err := NewKeyset("other", hmacKey.ID, hmacKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ks
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:       "Tampered claims",
+			signingKey: edKey,
+			modify: func(token string) string {
+				return replaceSegment(token, 1, `{"iss":"test","sub":"2","jti":"x","iat":1704164645,"exp":9999999999,"act":true,"perms":["videos:write"]}`)
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:       "Tampered signature",
+			signingKey: hmacKey,
+			modify: func(token string) string {
+				return replaceSegment(token, 2, strings.Repeat("x", 32))
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:       "Algorithm none",
+			signingKey: hmacKey,
+			modify: func(token string) string {
+				token = replaceSegment(token, 0, `{"alg":"none","typ":"JWT","kid":"hmac"}`)
+				return token[:strings.LastIndex(token, ".")+1]
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:       "Algorithm mismatch",
+			signingKey: hmacKey,
+			modify: func(token string) string {
+				return replaceSegment(token, 0, `{"alg":"EdDSA","typ":"JWT","kid":"hmac"}`)
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:       "Malformed",
+			signingKey: hmacKey,
+			modify:     func(token string) string { return token[:strings.LastIndex(token, ".")] },
+			wantErr:    ErrInvalidToken,
+		},
+		{
+			name:       "Missing subject",
+			signingKey: hmacKey,
+			claims:     func(c *Claims) { c.Subject = "" },
+			wantErr:    ErrInvalidToken,
+		},
+		{
+			name:       "Expired",
+			signingKey: hmacKey,
+			at:         now.Add(time.Hour),
+			wantErr:    ErrExpiredToken,
+		},
+		{
+			name:       "Issued within the clock skew",
+			signingKey: hmacKey,
+			at:         now.Add(-clockSkew),
+		},
+		{
+			name:       "Issued in the future",
+			signingKey: hmacKey,
+			at:         now.Add(-clockSkew - time.Second),
+			wantErr:    ErrInvalidToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewKeyset("test", tt.signingKey.ID, hmacKey, edKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims := NewClaims("1", now, time.Hour)
+			claims.Activated, claims.Permissions, claims.Family = true, []string{"videos:read"}, "family"
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+			token, err := signer.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsJWT(token) {
+				t.Errorf("got IsJWT(%q) false; want true", token)
+			}
+			if tt.modify != nil {
+				token = tt.modify(token)
+			}
+			verifier := signer
+			if tt.verifier != nil {
+				verifier = tt.verifier(t, signer)
+			}
+			at := tt.at
+			if at.IsZero() {
+				at = now
+			}
+
+			got, err := verifier.Verify(token, at)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Issuer != "test" || got.Subject != "1" || got.ID != claims.ID || got.ID == "" {
+				t.Errorf("got claims %+v; want %+v", got, claims)
+			}
+			if !got.IssuedTime().Equal(now.Truncate(time.Millisecond)) {
+				t.Errorf("got issue time %v; want %v", got.IssuedTime(), now.Truncate(time.Millisecond))
+			}
+			if !got.Activated || len(got.Permissions) != 1 || got.Family != "family" {
+				t.Errorf("got claims %+v; want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xfb}, 32))
+
+	tests := []struct {
+		name          string
+		s             string
+		wantAlgorithm string
+		wantErr       bool
+	}{
+		{"HS256", "k1:HS256:" + secret, HS256, false},
+		{"HS256 URL-safe unpadded", "k1:HS256:" + strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(secret), "="), HS256, false},
+		{"EdDSA", "k2:EdDSA:" + secret, EdDSA, false},
+		{"Short HS256 secret", "k1:HS256:" + base64.StdEncoding.EncodeToString([]byte("short")), "", true},
+		{"Wrong size EdDSA seed", "k2:EdDSA:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("e"), 64)), "", true},
+		{"Unknown algorithm", "k1:RS256:" + secret, "", true},
+		{"Missing ID", ":HS256:" + secret, "", true},
+		{"Missing parts", "k1:" + secret, "", true},
+		{"Invalid base64", "k1:HS256:!!!", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseKey(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+			}
+			if err == nil && key.Algorithm != tt.wantAlgorithm {
+				t.Errorf("got algorithm %q; want %q", key.Algorithm, tt.wantAlgorithm)
+			}
+		})
+	}
+}
+
+func TestNewKeyset(t *testing.T) {
+	hmacKey, edKey := newTestKeys(t)
+	if _, err := NewKeyset("test", "missing", hmacKey, edKey); err == nil {
+		t.Error("got no error for a missing signing key")
+	}
+	if _, err := NewKeyset("test", hmacKey.ID, hmacKey, hmacKey); err == nil {
+		t.Error("got no error for a duplicate key ID")
+	}
+}
@@ -0,0 +1,3 @@
+ALTER TABLE movies ADD COLUMN deleted_at timestamp(0) with time zone;
+ALTER TABLE movies ADD COLUMN deleted_by bigint REFERENCES users ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS movies_deleted_at_idx ON movies (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS video_revisions;
+DROP FUNCTION IF EXISTS video_revisions_immutable();
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS video_revisions (
+id bigserial PRIMARY KEY,
+video_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+version integer NOT NULL,
+action text NOT NULL,
+user_id bigint REFERENCES users ON DELETE SET NULL,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+before jsonb,
+after jsonb NOT NULL,
+UNIQUE (video_id, version)
+);
+-- Revisions are an audit trail, so refuse to change them once written. They are still
+-- deleted along with their video when the trash is purged.
+CREATE OR REPLACE FUNCTION video_revisions_immutable() RETURNS trigger AS $$
+BEGIN
+RAISE EXCEPTION 'video revisions cannot be modified';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER video_revisions_no_update BEFORE UPDATE ON video_revisions
+FOR EACH ROW EXECUTE FUNCTION video_revisions_immutable();
+-- Record the current state of every existing video as its baseline revision.
+INSERT INTO video_revisions (video_id, version, action, after)
+SELECT id, version, 'baseline', jsonb_build_object(
+'id', id,
+'title', title,
+'year', year,
+'runtime', runtime || ' mins',
+'genres', genres,
+'version', version,
+'deleted_at', deleted_at,
+'deleted_by', deleted_by
+)
+FROM movies;
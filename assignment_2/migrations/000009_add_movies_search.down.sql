@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS movies_search_vector_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_description_length_check;
+ALTER TABLE movies DROP COLUMN IF EXISTS language;
+ALTER TABLE movies DROP COLUMN IF EXISTS description;
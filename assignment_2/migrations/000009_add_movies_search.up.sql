@@ -0,0 +1,7 @@
+ALTER TABLE movies ADD COLUMN description text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN language regconfig NOT NULL DEFAULT 'english';
+ALTER TABLE movies ADD CONSTRAINT movies_description_length_check CHECK (octet_length(description) <= 10000);
+ALTER TABLE movies ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector(language, title), 'A') || setweight(to_tsvector(language, description), 'B')
+) STORED;
+CREATE INDEX IF NOT EXISTS movies_search_vector_idx ON movies USING GIN (search_vector);
@@ -0,0 +1,77 @@
+CREATE TABLE IF NOT EXISTS genres (
+id bigserial PRIMARY KEY,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+slug text NOT NULL UNIQUE,
+name text NOT NULL,
+parent_id bigint REFERENCES genres ON DELETE RESTRICT,
+version integer NOT NULL DEFAULT 1
+);
+-- An alias is stored in the same normalized form as a slug, and may only belong to one
+-- genre. The application also stops an alias from matching another genre's slug.
+CREATE TABLE IF NOT EXISTS genre_aliases (
+alias text PRIMARY KEY,
+genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS genre_aliases_genre_id_idx ON genre_aliases (genre_id);
+INSERT INTO permissions (code) VALUES ('genres:write');
+-- Seed the taxonomy with the genres which videos were previously restricted to.
+INSERT INTO genres (slug, name)
+VALUES
+('action', 'Action'),
+('adventure', 'Adventure'),
+('animation', 'Animation'),
+('biography', 'Biography'),
+('comedy', 'Comedy'),
+('crime', 'Crime'),
+('documentary', 'Documentary'),
+('drama', 'Drama'),
+('family', 'Family'),
+('fantasy', 'Fantasy'),
+('history', 'History'),
+('horror', 'Horror'),
+('music', 'Music'),
+('musical', 'Musical'),
+('mystery', 'Mystery'),
+('romance', 'Romance'),
+('sci-fi', 'Sci-Fi'),
+('sport', 'Sport'),
+('thriller', 'Thriller'),
+('war', 'War'),
+('western', 'Western');
+INSERT INTO genre_aliases (alias, genre_id)
+SELECT alias, genres.id
+FROM (VALUES
+('animated', 'animation'),
+('biopic', 'biography'),
+('science-fiction', 'sci-fi'),
+('scifi', 'sci-fi'),
+('sports', 'sport')
+) AS aliases(alias, slug)
+INNER JOIN genres ON genres.slug = aliases.slug;
+-- Backfill a genre for every spelling already used by a video, keyed by its slug (so
+-- "Sci-Fi" and "sci-fi" become the single genre "sci-fi"), and named after its most
+-- common spelling. The slug rule matches data.GenreSlug().
+INSERT INTO genres (slug, name)
+SELECT slug, (array_agg(genre ORDER BY uses DESC, genre))[1]
+FROM (
+SELECT genre, trim(both '-' from regexp_replace(lower(genre), '[^[:alnum:]]+', '-', 'g')) AS slug, count(*) AS uses
+FROM movies, unnest(genres) AS genre
+GROUP BY genre
+) AS spellings
+WHERE slug <> '' AND slug NOT IN (SELECT slug FROM genres) AND slug NOT IN (SELECT alias FROM genre_aliases)
+GROUP BY slug;
+-- Then replace each video's genres with the slugs of their canonical genres, keeping
+-- the original order and dropping any duplicates that the normalization creates.
+UPDATE movies SET genres = ARRAY(
+SELECT canonical
+FROM (
+SELECT coalesce(aliased.slug, normalized.slug) AS canonical, min(position) AS position
+FROM unnest(genres) WITH ORDINALITY AS g(genre, position)
+CROSS JOIN LATERAL (SELECT trim(both '-' from regexp_replace(lower(genre), '[^[:alnum:]]+', '-', 'g')) AS slug) AS normalized
+LEFT JOIN genre_aliases ON genre_aliases.alias = normalized.slug
+LEFT JOIN genres AS aliased ON aliased.id = genre_aliases.genre_id
+GROUP BY 1
+) AS slugs
+WHERE canonical <> ''
+ORDER BY position
+);
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'people:write';
+DROP TABLE IF EXISTS video_credits;
+DROP TABLE IF EXISTS people;
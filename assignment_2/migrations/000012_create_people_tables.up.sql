@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS people (
+id bigserial PRIMARY KEY,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+name text NOT NULL,
+birth_year integer,
+version integer NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS people_name_idx ON people USING GIN (to_tsvector('simple', name));
+-- A person can have several roles on the same video (such as director and writer), but
+-- only one credit for each role.
+CREATE TABLE IF NOT EXISTS video_credits (
+video_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+person_id bigint NOT NULL REFERENCES people ON DELETE RESTRICT,
+role text NOT NULL,
+character text NOT NULL DEFAULT '',
+billing_order integer NOT NULL,
+PRIMARY KEY (video_id, person_id, role)
+);
+CREATE INDEX IF NOT EXISTS video_credits_person_id_idx ON video_credits (person_id);
+INSERT INTO permissions (code) VALUES ('people:write');
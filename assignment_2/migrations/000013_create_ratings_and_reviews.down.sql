@@ -0,0 +1,7 @@
+DELETE FROM permissions WHERE code = 'reviews:moderate';
+DROP TABLE IF EXISTS video_reviews;
+DROP TABLE IF EXISTS video_ratings;
+DROP INDEX IF EXISTS movies_rating_count_idx;
+DROP INDEX IF EXISTS movies_rating_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating_count;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating;
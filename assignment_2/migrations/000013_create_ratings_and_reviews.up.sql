@@ -0,0 +1,30 @@
+-- The rating and rating_count columns hold the aggregate of a video's rows in
+-- video_ratings. They're recomputed in the same transaction as every change to those
+-- rows, so listings can sort by them without aggregating on every request.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS rating numeric(4, 2) NOT NULL DEFAULT 0;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS rating_count integer NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS movies_rating_idx ON movies (rating, id);
+CREATE INDEX IF NOT EXISTS movies_rating_count_idx ON movies (rating_count, id);
+CREATE TABLE IF NOT EXISTS video_ratings (
+video_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+score integer NOT NULL CHECK (score BETWEEN 1 AND 10),
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+PRIMARY KEY (video_id, user_id)
+);
+-- Each user can write one review of a video. New and edited reviews are pending until
+-- a moderator approves or rejects them.
+CREATE TABLE IF NOT EXISTS video_reviews (
+id bigserial PRIMARY KEY,
+video_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+body text NOT NULL,
+status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+version integer NOT NULL DEFAULT 1,
+UNIQUE (video_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS video_reviews_video_id_status_idx ON video_reviews (video_id, status, created_at);
+INSERT INTO permissions (code) VALUES ('reviews:moderate');
@@ -0,0 +1,12 @@
+-- A user's watchlists exist only through their items: each item belongs to the list
+-- named in the list column. Positions run from 1 within each list, with no gaps.
+CREATE TABLE IF NOT EXISTS watchlist_items (
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+list text NOT NULL,
+video_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+position integer NOT NULL CHECK (position > 0),
+added_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+watched_at timestamp(0) with time zone,
+PRIMARY KEY (user_id, list, video_id)
+);
+CREATE INDEX IF NOT EXISTS watchlist_items_user_id_video_id_idx ON watchlist_items (user_id, video_id);
@@ -0,0 +1,3 @@
+-- The blob key of the poster's original image, or '' if the video has no poster. The
+-- thumbnails are stored alongside it.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS poster text NOT NULL DEFAULT '';
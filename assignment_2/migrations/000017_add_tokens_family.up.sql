@@ -0,0 +1,6 @@
+-- Refresh tokens and the tokens they're exchanged for share a family, so that they can
+-- be revoked together. A refresh token is kept after it has been exchanged, with used_at
+-- set, so that reuse of a leaked token can be detected.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family) WHERE family <> '';
@@ -0,0 +1,12 @@
+-- Signed (JWT) access tokens aren't stored, so logging out can't delete them. Instead a
+-- revocation is recorded for the token's ID, or, when token_id is empty, for every token
+-- issued to the user before revoked_at. A row can be deleted once expiry has passed,
+-- because by then every token it covers has expired anyway.
+CREATE TABLE IF NOT EXISTS token_revocations (
+    id bigserial PRIMARY KEY,
+    token_id text NOT NULL DEFAULT '',
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    revoked_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL
+);
+CREATE INDEX IF NOT EXISTS token_revocations_expiry_idx ON token_revocations (expiry);
@@ -0,0 +1,2 @@
+ALTER TABLE token_revocations ALTER COLUMN revoked_at TYPE timestamp(0) with time zone;
+ALTER TABLE token_revocations DROP COLUMN IF EXISTS family;
@@ -0,0 +1,6 @@
+-- A revocation with a family revokes the signed tokens issued from that refresh token
+-- family. revoked_at keeps fractions of a second, because signed tokens record when they
+-- were issued to the millisecond, and a user who logs in again straight after logging
+-- out everywhere mustn't have the new token revoked too.
+ALTER TABLE token_revocations ADD COLUMN IF NOT EXISTS family text NOT NULL DEFAULT '';
+ALTER TABLE token_revocations ALTER COLUMN revoked_at TYPE timestamp with time zone;
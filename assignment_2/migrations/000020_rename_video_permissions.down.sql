@@ -0,0 +1,2 @@
+UPDATE permissions SET code = 'movies:read' WHERE code = 'videos:read';
+UPDATE permissions SET code = 'movies:write' WHERE code = 'videos:write';
@@ -0,0 +1,5 @@
+-- The routes check "videos:read" and "videos:write", so rename the permissions added by
+-- migration 000006 to match. Users keep the permissions they had, because the rows in
+-- users_permissions refer to the permission IDs rather than the codes.
+UPDATE permissions SET code = 'videos:read' WHERE code = 'movies:read';
+UPDATE permissions SET code = 'videos:write' WHERE code = 'movies:write';
@@ -0,0 +1,11 @@
+-- Lower pg_trgm's word_similarity_threshold from its default of 0.6 for every new
+-- connection, so that the <% operator in VideoModel.Suggest() can match titles with a
+-- typo. At 0.6 a single transposed letter in a short word (like "knigth" for "knight") is
+-- already too far away to match. The database's name isn't known in advance, so the
+-- statement is built from current_database(). Only the database's owner (or a superuser)
+-- can run it.
+DO $$
+BEGIN
+	EXECUTE format('ALTER DATABASE %I SET pg_trgm.word_similarity_threshold = 0.4', current_database());
+END
+$$;